@@ -0,0 +1,42 @@
+// Command tffake runs a fake testflinger server, tpr can use it by passing
+// its address in -server or $TPR_SERVER
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/fgimenez/validator/pkg/tffake"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:8000", "address to listen on")
+	queues := flag.String("queues", "", "comma separated list of queues to accept jobs for, any queue is accepted when empty")
+	failing := flag.String("fail", "", "comma separated list of queues whose jobs fail their test phase")
+	flag.Parse()
+
+	server := tffake.New(nil)
+	if *queues != "" {
+		server.Queues = map[string]string{}
+		for _, queue := range strings.Split(*queues, ",") {
+			server.Queues[queue] = "fake " + queue
+		}
+	}
+	fail := map[string]bool{}
+	for _, queue := range strings.Split(*failing, ",") {
+		fail[queue] = true
+	}
+	server.Outcome = func(job *tffake.Job) *tffake.Outcome {
+		if fail[job.Queue] {
+			return &tffake.Outcome{TestStatus: 1, TestOutput: "fake failure in " + job.Queue}
+		}
+		return &tffake.Outcome{TestOutput: "fake success in " + job.Queue}
+	}
+
+	fmt.Fprintf(os.Stderr, "fake testflinger server listening on http://%s\n", *addr)
+	log.Fatal(http.ListenAndServe(*addr, server))
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/fgimenez/validator/pkg/manifest"
+	"github.com/fgimenez/validator/pkg/runner"
+	"github.com/fgimenez/validator/pkg/types"
+)
+
+var cancelCmd = &command{
+	name:    "cancel",
+	summary: "cancel the jobs of a run which are not finished yet",
+	setup: func(fs *flag.FlagSet) func([]string) error {
+		path := fs.String("manifest", manifest.DefaultPath, "run manifest written by submit")
+		server := serverFlag(fs)
+		return func(args []string) error {
+			if err := noArgs(args); err != nil {
+				return err
+			}
+			m, err := manifest.Load(*path)
+			if err != nil {
+				return err
+			}
+			return cancelJobs(newRunner(*server), *path, m)
+		}
+	},
+}
+
+// cancelJobs cancels the outstanding jobs of the manifest and saves it with
+// their new states
+func cancelJobs(r *runner.Runner, path string, m *types.Manifest) error {
+	err := r.Cancel(m, func(job *types.Job) {
+		fmt.Printf("%s bucket %d in %s: job %s %s\n", job.System, job.Bucket, job.Queue, job.ID, job.State)
+	})
+	if saveErr := manifest.Save(path, m); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	return err
+}
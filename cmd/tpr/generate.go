@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/fgimenez/validator/pkg/flags"
+)
+
+var generateCmd = &command{
+	name:    "generate",
+	summary: "generate the testflinger job definitions and print their paths",
+	setup: func(fs *flag.FlagSet) func([]string) error {
+		options := flags.Register(fs)
+		return func(args []string) error {
+			if err := noArgs(args); err != nil {
+				return err
+			}
+			opts, err := validOptions(options)
+			if err != nil {
+				return err
+			}
+			cfgs, err := newRunner("").Run(opts)
+			if err != nil {
+				return err
+			}
+			for _, system := range opts.Systems {
+				fmt.Printf("%s:\n", system)
+				for _, cfg := range cfgs[system] {
+					fmt.Printf("    %s\n", cfg)
+				}
+			}
+			return nil
+		}
+	},
+}
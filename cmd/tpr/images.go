@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fgimenez/validator/pkg/cli"
+	"github.com/fgimenez/validator/pkg/imagedb"
+	"github.com/fgimenez/validator/pkg/imagesets"
+	"github.com/fgimenez/validator/pkg/models"
+	"github.com/fgimenez/validator/pkg/platforms"
+	"github.com/fgimenez/validator/pkg/seed"
+	"github.com/fgimenez/validator/pkg/storage"
+	"github.com/fgimenez/validator/pkg/store"
+	"github.com/fgimenez/validator/pkg/triggers"
+	"github.com/fgimenez/validator/pkg/ubuntuimage"
+)
+
+var imagesCmd = &command{
+	name:    "images",
+	summary: "manage the definitions of the images built by image-generator",
+	subcommands: []*command{
+		imagesLintCmd,
+		imagesDiffCmd,
+		imagesStatusCmd,
+		imagesDBCmd,
+		imagesBuildCmd,
+		imagesPublishCmd,
+		imagesPlatformsCmd,
+	},
+}
+
+var imagesLintCmd = &command{
+	name:    "lint",
+	args:    "[file...]",
+	summary: "check image sets files, " + imagesets.DefaultPath + " by default",
+	setup: func(fs *flag.FlagSet) func([]string) error {
+		return func(args []string) error {
+			if len(args) == 0 {
+				args = []string{imagesets.DefaultPath}
+			}
+			failed := false
+			for _, path := range args {
+				if _, err := imagesets.Load(path); err != nil {
+					fmt.Println(err)
+					failed = true
+				}
+			}
+			if failed {
+				return errFailed
+			}
+			return nil
+		}
+	},
+}
+
+var imagesDiffCmd = &command{
+	name:    "diff",
+	args:    "<old> <new>",
+	summary: "show the snaps added, removed or with another revision between the " + seed.FileName + " of two images, given by path or URL",
+	setup: func(fs *flag.FlagSet) func([]string) error {
+		return func(args []string) error {
+			if len(args) != 2 {
+				return usageErrorf("expected the manifests of the old and the new images")
+			}
+			old, warnings, err := seed.Load(args[0])
+			if err != nil {
+				return err
+			}
+			current, more, err := seed.Load(args[1])
+			if err != nil {
+				return err
+			}
+			for _, warning := range append(warnings, more...) {
+				fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+			}
+			changes := seed.Diff(old, current)
+			if len(changes) == 0 {
+				fmt.Println("no changes")
+			}
+			for _, change := range changes {
+				fmt.Println(change)
+			}
+			return nil
+		}
+	},
+}
+
+var imagesStatusCmd = &command{
+	name:    "status",
+	summary: "tell which images and metadata need rebuilding because of new revisions of their trigger snaps",
+	setup: func(fs *flag.FlagSet) func([]string) error {
+		path := fs.String("file", imagesets.DefaultPath, "image sets file")
+		storeURL := fs.String("store", store.DefaultURL, "URL of the snap store")
+		proxy := fs.String("proxy", "", "proxy used to reach the store, taken from the environment when empty")
+		remote := fs.String("remote", seed.PublicURL, "URL where the images are published, the published manifests aren't checked when empty")
+		output := fs.String("output", triggers.DefaultOutputDir, "directory with the images built locally, the local manifests aren't checked when empty")
+		asJSON := fs.Bool("json", false, "print the decisions as JSON")
+		return func(args []string) error {
+			if err := noArgs(args); err != nil {
+				return err
+			}
+			file, err := imagesets.Load(*path)
+			if err != nil {
+				return err
+			}
+			client := store.New(*storeURL)
+			if *proxy != "" {
+				if err := client.SetProxy(*proxy); err != nil {
+					return usageErrorf("%v", err)
+				}
+			}
+			e := &triggers.Evaluator{Store: client, RemoteURL: *remote, OutputDir: *output}
+			decisions := e.Evaluate(file)
+			if *asJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(decisions)
+			}
+			for _, d := range decisions {
+				status := "up to date"
+				if d.Rebuild {
+					status = "rebuild"
+				}
+				if d.Kind == imagedb.KindMetadata {
+					status += " (metadata)"
+				}
+				fmt.Printf("%s: %s\n", d.Image, status)
+				for _, reason := range d.Reasons {
+					fmt.Printf("    %s\n", reason)
+				}
+				for _, warning := range d.Warnings {
+					fmt.Printf("    warning: %s\n", warning)
+				}
+			}
+			return nil
+		}
+	},
+}
+
+var imagesDBCmd = &command{
+	name:    "db",
+	summary: "inspect the state of the images built by image-generator",
+	subcommands: []*command{
+		imagesDBListCmd,
+		imagesDBShowCmd,
+	},
+}
+
+// builtAt describes the build time of an entry, unknown for the ones migrated
+// from image-generator
+func builtAt(e *imagedb.Entry) string {
+	if e.BuiltAt == nil {
+		return "unknown"
+	}
+	return e.BuiltAt.Format(time.RFC3339)
+}
+
+var imagesDBListCmd = &command{
+	name:    "list",
+	summary: "list the images and metadata entries of the database",
+	setup: func(fs *flag.FlagSet) func([]string) error {
+		path := fs.String("db", imagedb.DefaultPath, "images database")
+		return func(args []string) error {
+			if err := noArgs(args); err != nil {
+				return err
+			}
+			db, err := imagedb.Load(*path)
+			if err != nil {
+				return err
+			}
+			for _, list := range []struct {
+				kind    string
+				entries []*imagedb.Entry
+			}{{imagedb.KindImage, db.Images}, {imagedb.KindMetadata, db.Metadata}} {
+				for _, e := range list.entries {
+					fmt.Printf("%-8s %s built %s\n", list.kind, e.Name, builtAt(e))
+				}
+			}
+			return nil
+		}
+	},
+}
+
+var imagesDBShowCmd = &command{
+	name:    "show",
+	args:    "<image>",
+	summary: "show the build time and the snap revisions of an image of the database",
+	setup: func(fs *flag.FlagSet) func([]string) error {
+		path := fs.String("db", imagedb.DefaultPath, "images database")
+		return func(args []string) error {
+			if len(args) != 1 {
+				return usageErrorf("expected the name of an image")
+			}
+			db, err := imagedb.Load(*path)
+			if err != nil {
+				return err
+			}
+			e, kind := db.Find(args[0])
+			if e == nil {
+				return fmt.Errorf("image %s not found in %s", args[0], *path)
+			}
+			fmt.Printf("%s (%s)\n", e.Name, kind)
+			fmt.Printf("platform: %s\nversion: %d\nchannel: %s\nbuilt: %s\nmanifest:\n", e.Platform, e.Version, e.Channel, builtAt(e))
+			for _, name := range e.Manifest.Names() {
+				fmt.Printf("    %s %d\n", name, e.Manifest[name])
+			}
+			return nil
+		}
+	},
+}
+
+// defaultLockWait is the time a build waits for the images database, which
+// image-generator keeps locked for its whole run
+const defaultLockWait = 6 * time.Hour
+
+var imagesBuildCmd = &command{
+	name:    "build",
+	args:    "<image>",
+	summary: "build an image of the image sets with ubuntu-image, compress it and record it in the images database",
+	setup: func(fs *flag.FlagSet) func([]string) error {
+		path := fs.String("file", imagesets.DefaultPath, "image sets file")
+		modelsDir := fs.String("models", models.DefaultDir, "directory with the model assertions")
+		output := fs.String("output", triggers.DefaultOutputDir, "directory where the image is written, in a directory named after it")
+		binary := fs.String("ubuntu-image", ubuntuimage.DefaultBinary, "ubuntu-image executable")
+		snapCommand := fs.Bool("snap-command", false, "use the snap subcommand of ubuntu-image for every version, always used from 20")
+		dbPath := fs.String("db", imagedb.DefaultPath, "images database where the build is recorded, not recorded when empty")
+		lockWait := fs.Duration("lock-wait", defaultLockWait, "time to wait for image-generator or another build to release the images database")
+		dryRun := fs.Bool("dry-run", false, "print the command line instead of building the image")
+		return func(args []string) error {
+			if len(args) != 1 {
+				return usageErrorf("expected the name of an image")
+			}
+			if *lockWait < 0 {
+				return usageErrorf("-lock-wait cannot be negative")
+			}
+			file, err := imagesets.Load(*path)
+			if err != nil {
+				return err
+			}
+			var set *imagesets.ImageSet
+			var platform string
+			for _, s := range file.Images {
+				for _, p := range s.Platforms {
+					if imagesets.ImageName(s, p) == args[0] {
+						set, platform = s, p
+					}
+				}
+			}
+			if set == nil {
+				return fmt.Errorf("image %s is not defined in %s", args[0], *path)
+			}
+
+			build := ubuntuimage.FromImageSet(set, platform, *modelsDir, *output)
+			build.Binary = *binary
+			build.SnapCommand = *snapCommand
+			if *dryRun {
+				cmd, err := build.Args()
+				if err != nil {
+					return err
+				}
+				fmt.Println(strings.Join(cmd, " "))
+				return nil
+			}
+			manifest, err := build.Run(&cli.Executor{}, os.Stdout)
+			if err != nil {
+				return err
+			}
+			if *dbPath == "" {
+				return nil
+			}
+			now := time.Now().UTC()
+			return imagedb.Update(*dbPath, *lockWait, func(db *imagedb.DB) error {
+				return db.Put(imagedb.KindImage, &imagedb.Entry{
+					Name:     args[0],
+					Version:  set.Version,
+					Channel:  set.Channel,
+					Platform: platform,
+					Snaps:    set.Snaps,
+					Triggers: set.Triggers,
+					Manifest: manifest,
+					BuiltAt:  &now,
+				})
+			})
+		}
+	},
+}
+
+// authorize sets the credentials of the bucket from the environment, the
+// requests are signed when TPR_STORAGE_ACCESS_KEY is set, with the keys of S3
+// or the HMAC keys of Google Cloud Storage, or else sent with the OAuth token
+// in TPR_STORAGE_TOKEN
+func authorize(b *storage.Bucket) error {
+	access := os.Getenv("TPR_STORAGE_ACCESS_KEY")
+	if access == "" {
+		b.Token = os.Getenv("TPR_STORAGE_TOKEN")
+		return nil
+	}
+	secret := os.Getenv("TPR_STORAGE_SECRET_KEY")
+	if secret == "" {
+		return fmt.Errorf("TPR_STORAGE_SECRET_KEY is required along with TPR_STORAGE_ACCESS_KEY")
+	}
+	region := os.Getenv("TPR_STORAGE_REGION")
+	if region == "" {
+		region = "us-east-1"
+		if b.Endpoint == storage.GCSEndpoint {
+			region = "auto"
+		}
+	}
+	b.Signer = &storage.SigV4{AccessKey: access, SecretKey: secret, Region: region}
+	return nil
+}
+
+var imagesPublishCmd = &command{
+	name:    "publish",
+	args:    "<image>...",
+	summary: "mirror built images to where they are published, deleting the files they no longer have",
+	setup: func(fs *flag.FlagSet) func([]string) error {
+		output := fs.String("output", triggers.DefaultOutputDir, "directory with the images built locally")
+		to := fs.String("to", storage.DefaultImages, "where the images are published, a local directory, gs://<bucket>[/<prefix>] or http(s)://<endpoint>/<bucket>[/<prefix>] for S3 and other S3 compatible endpoints")
+		proxy := fs.String("proxy", "", "proxy used to reach the bucket, taken from the environment when empty")
+		return func(args []string) error {
+			if len(args) == 0 {
+				return usageErrorf("expected the names of the images")
+			}
+			backend, err := storage.Open(*to)
+			if err != nil {
+				return usageErrorf("%v", err)
+			}
+			if b, ok := backend.(*storage.Bucket); ok {
+				if err := authorize(b); err != nil {
+					return usageErrorf("%v", err)
+				}
+				if *proxy != "" {
+					if err := b.SetProxy(*proxy); err != nil {
+						return usageErrorf("%v", err)
+					}
+				}
+			}
+			for _, image := range args {
+				// images are published compressed, as built by images build
+				raw, err := filepath.Glob(filepath.Join(*output, image, "*"+ubuntuimage.ImageExt))
+				if err != nil {
+					return err
+				}
+				if len(raw) > 0 {
+					return fmt.Errorf("cannot publish %s: %s is not compressed with xz", image, raw[0])
+				}
+				result, err := storage.Sync(backend, filepath.Join(*output, image), image, true)
+				if err != nil {
+					return fmt.Errorf("cannot publish %s: %v", image, err)
+				}
+				for _, key := range result.Uploaded {
+					fmt.Printf("uploaded %s\n", backend.URL(key))
+				}
+				for _, key := range result.Deleted {
+					fmt.Printf("deleted %s\n", backend.URL(key))
+				}
+				fmt.Printf("%s: %d uploaded, %d deleted, %d unchanged\n", image, len(result.Uploaded), len(result.Deleted), len(result.Unchanged))
+			}
+			return nil
+		}
+	},
+}
+
+// imagePlatform is a platform image-generator builds images for along with
+// the size of the images of each series, the default of ubuntu-image when
+// missing
+type imagePlatform struct {
+	*platforms.Platform
+	ImageSizes map[int]string `json:"image_sizes"`
+}
+
+var imagesPlatformsCmd = &command{
+	name:    "platforms",
+	summary: "list the platforms image-generator builds images for, with their architecture and series",
+	setup: func(fs *flag.FlagSet) func([]string) error {
+		asJSON := fs.Bool("json", false, "print the platforms as JSON, as image-generator reads them")
+		return func(args []string) error {
+			if err := noArgs(args); err != nil {
+				return err
+			}
+			var list []*imagePlatform
+			for _, name := range platforms.WithImages() {
+				p := &imagePlatform{Platform: platforms.MustGet(name), ImageSizes: map[int]string{}}
+				for _, series := range p.Series {
+					if size := p.ImageSizeFor(series); size != "" {
+						p.ImageSizes[series] = size
+					}
+				}
+				list = append(list, p)
+			}
+			if *asJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(list)
+			}
+			for _, p := range list {
+				series := make([]string, len(p.Series))
+				for i, s := range p.Series {
+					series[i] = strconv.Itoa(s)
+				}
+				fmt.Printf("%-12s %-6s %s\n", p.Name, p.Architecture, strings.Join(series, ","))
+			}
+			return nil
+		}
+	},
+}
@@ -1,31 +1,181 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"os"
+	"strings"
 
 	"github.com/fgimenez/validator/pkg/cli"
 	"github.com/fgimenez/validator/pkg/flags"
 	"github.com/fgimenez/validator/pkg/runner"
 	"github.com/fgimenez/validator/pkg/splitter"
 	"github.com/fgimenez/validator/pkg/testflinger"
+	"github.com/fgimenez/validator/pkg/tfapi"
 	"github.com/fgimenez/validator/pkg/types"
 )
 
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+// command is a tpr subcommand with its own set of flags
+type command struct {
+	name    string
+	args    string
+	summary string
+	// setup defines the command flags and returns the function executing the
+	// command with the remaining arguments once the flags are parsed
+	setup func(fs *flag.FlagSet) func(args []string) error
+	// subcommands are run instead of setup for commands grouping others
+	subcommands []*command
+}
+
+// usageError is returned by commands invoked with wrong arguments
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+func usageErrorf(format string, a ...interface{}) error {
+	return &usageError{msg: fmt.Sprintf(format, a...)}
+}
+
+// errFailed is returned by commands which completed but found failures that
+// have already been reported
+var errFailed = errors.New("failures found")
+
+func commands() []*command {
+	return []*command{
+		planCmd,
+		generateCmd,
+		submitCmd,
+		watchCmd,
+		reportCmd,
+		reserveCmd,
+		cancelCmd,
+		imagesCmd,
+		modelsCmd,
+	}
+}
+
 func main() {
-	options := flags.Parse()
+	os.Exit(run(os.Args[1:]))
+}
 
-	deps := &types.RunnerDependencies{
-		Cli:         &cli.Executor{},
-		Testflinger: &testflinger.Testflinger{},
-		Splitter:    &splitter.Splitter{},
+func run(args []string) int {
+	return runCommands("tpr", commands(), args)
+}
+
+// runCommands runs the command among cmds named by the first argument, the
+// prefix is the command line leading to them, ie "tpr images"
+func runCommands(prefix string, cmds []*command, args []string) int {
+	if len(args) == 0 {
+		usage(os.Stderr, prefix, cmds)
+		return exitUsage
+	}
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		usage(os.Stdout, prefix, cmds)
+		return exitOK
 	}
-	runner := runner.New(deps)
 
-	list, err := runner.Run(options)
-	if err != nil {
-		log.Fatalf(err.Error())
+	var cmd *command
+	for _, c := range cmds {
+		if c.name == args[0] {
+			cmd = c
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "%s: unknown command %q\n\n", prefix, args[0])
+		usage(os.Stderr, prefix, cmds)
+		return exitUsage
+	}
+	name := prefix + " " + cmd.name
+	if cmd.subcommands != nil {
+		return runCommands(name, cmd.subcommands, args[1:])
 	}
-	fmt.Println(list)
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s\n\n%s\n\nflags:\n", strings.TrimSpace(name+" [flags] "+cmd.args), cmd.summary)
+		fs.PrintDefaults()
+	}
+	exec := cmd.setup(fs)
+	if err := fs.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	err := exec(fs.Args())
+	switch err.(type) {
+	case nil:
+		return exitOK
+	case *flags.ValidationError:
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		return exitUsage
+	case *usageError:
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		fs.Usage()
+		return exitUsage
+	}
+	if err != errFailed {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+	}
+	return exitFailure
 }
 
+func usage(w io.Writer, prefix string, cmds []*command) {
+	fmt.Fprintf(w, "usage: %s <command> [flags] [arguments]\n\ncommands:\n", prefix)
+	for _, c := range cmds {
+		fmt.Fprintf(w, "    %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(w, "\nrun '%s <command> -h' for the flags of each command\n", prefix)
+}
+
+// noArgs checks that no positional arguments were given
+func noArgs(args []string) error {
+	if len(args) != 0 {
+		return usageErrorf("unexpected arguments %v", args)
+	}
+	return nil
+}
+
+// validOptions builds the options once the flags are parsed and checks them
+func validOptions(build func() *types.Options) (*types.Options, error) {
+	options := build()
+	if err := flags.Validate(options); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// serverFlag defines the flag selecting the testflinger server to talk to
+func serverFlag(fs *flag.FlagSet) *string {
+	return fs.String("server", os.Getenv("TPR_SERVER"), "URL of a testflinger server to use through its REST API instead of "+testflinger.Command+", defaults to $TPR_SERVER")
+}
+
+// newRunner returns a runner managing jobs through the REST API of the given
+// testflinger server, or through the command line client when it is empty
+func newRunner(server string) *runner.Runner {
+	executor := &cli.Executor{}
+	var client runner.Server = &testflinger.Client{Cli: executor}
+	if server != "" {
+		client = tfapi.New(server)
+	}
+	return runner.New(&runner.Dependencies{
+		Cli:         executor,
+		Testflinger: &testflinger.Testflinger{},
+		Splitter:    &splitter.Splitter{},
+		Server:      client,
+	})
+}
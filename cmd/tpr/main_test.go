@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fgimenez/validator/pkg/imagedb"
+	"github.com/fgimenez/validator/pkg/manifest"
+	"github.com/fgimenez/validator/pkg/storage"
+	"github.com/fgimenez/validator/pkg/storage/storagetest"
+	"github.com/fgimenez/validator/pkg/store/storetest"
+	"github.com/fgimenez/validator/pkg/tffake"
+)
+
+const fakeSpread = `#!/bin/sh
+for task in a b c d; do
+	echo "$2:tests/main/$task"
+done
+`
+
+// setup returns a fake testflinger server and the flags pointing tpr to it
+// and to a manifest in a temporary directory, spread is replaced by a script
+// listing four tasks
+func setup(t *testing.T) (*tffake.Server, []string) {
+	dir, err := ioutil.TempDir("", "tpr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := ioutil.WriteFile(filepath.Join(dir, "spread"), []byte(fakeSpread), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	fake := tffake.New(map[string]string{"dragonboard": "fake dragonboard", "pi4": "fake pi4"})
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, []string{"-server", server.URL, "-manifest", filepath.Join(dir, "run.json")}
+}
+
+func submitArgs(common []string, extra ...string) []string {
+	args := append([]string{"submit"}, common...)
+	args = append(args, "-executors", "2", "-commit", "abcdef1", "-spread-sha256", "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08")
+	return append(args, extra...)
+}
+
+func TestRun(t *testing.T) {
+	fake, common := setup(t)
+	fake.Outcome = func(job *tffake.Job) *tffake.Outcome {
+		if job.ID == "job-2" {
+			return &tffake.Outcome{TestStatus: 1, TestOutput: "tests/main/d failed"}
+		}
+		return &tffake.Outcome{}
+	}
+
+	if code := run(submitArgs(common)); code != exitOK {
+		t.Fatalf("expected submit to succeed, got exit code %d", code)
+	}
+	m, err := manifest.Load(common[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Jobs) != 2 || len(fake.Jobs()) != 2 || m.Commit != "abcdef1" {
+		t.Fatalf("expected 2 jobs testing abcdef1, got %+v", m)
+	}
+
+	if code := run(append([]string{"watch", "-interval", "0"}, common...)); code != exitOK {
+		t.Fatalf("expected watch to succeed, got exit code %d", code)
+	}
+	if m, err = manifest.Load(common[3]); err != nil {
+		t.Fatal(err)
+	}
+	for _, job := range m.Jobs {
+		if job.State != "complete" {
+			t.Errorf("expected job %s to be complete, got %q", job.ID, job.State)
+		}
+	}
+
+	if code := run(append([]string{"report"}, common...)); code != exitFailure {
+		t.Errorf("expected report to fail, got exit code %d", code)
+	}
+
+	if code := run(append([]string{"reserve", "-interval", "0", "-bucket", "1", "-ssh-key", "lp:me", "-debug"}, append(common, "tests/main/d")...)); code != exitOK {
+		t.Fatalf("expected reserve to succeed, got exit code %d", code)
+	}
+	jobs := fake.Jobs()
+	if len(jobs) != 3 || jobs[2].Definition["reserve_data"] == nil {
+		t.Errorf("expected a reservation job, got %v", jobs)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	fake, common := setup(t)
+	if code := run(submitArgs(common)); code != exitOK {
+		t.Fatalf("expected submit to succeed, got exit code %d", code)
+	}
+	if code := run(append([]string{"cancel"}, common...)); code != exitOK {
+		t.Fatalf("expected cancel to succeed, got exit code %d", code)
+	}
+	m, err := manifest.Load(common[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, job := range fake.Jobs() {
+		if job.States[job.State] != "cancelled" || m.Jobs[i].State != "cancelled" {
+			t.Errorf("expected job %s to be cancelled, got %s in the server and %q in the manifest", job.ID, job.States[job.State], m.Jobs[i].State)
+		}
+	}
+	if code := run(append([]string{"cancel"}, common...)); code != exitOK {
+		t.Errorf("expected cancelling again to do nothing, got exit code %d", code)
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	for answer, expected := range map[string]bool{"y\n": true, " YES\n": true, "n\n": false, "\n": false, "": false, "yeah\n": false} {
+		var out bytes.Buffer
+		if confirm(strings.NewReader(answer), &out, "proceed?") != expected {
+			t.Errorf("expected answer %q to be %v", answer, expected)
+		}
+		if out.String() != "proceed? [y/N] " {
+			t.Errorf("unexpected question %q", out.String())
+		}
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	t.Run("unknown queue", func(t *testing.T) {
+		fake, common := setup(t)
+		if code := run(submitArgs(common, "-queue", "pi9")); code != exitFailure {
+			t.Errorf("expected submit to fail, got exit code %d", code)
+		}
+		if len(fake.Jobs()) != 0 {
+			t.Errorf("expected no jobs, got %v", fake.Jobs())
+		}
+	})
+	t.Run("invalid options", func(t *testing.T) {
+		_, common := setup(t)
+		if code := run(submitArgs(common, "-executors", "0")); code != exitUsage {
+			t.Errorf("expected usage exit code, got %d", code)
+		}
+	})
+	t.Run("missing manifest", func(t *testing.T) {
+		_, common := setup(t)
+		if code := run(append([]string{"watch"}, common...)); code != exitFailure {
+			t.Errorf("expected watch to fail, got exit code %d", code)
+		}
+	})
+	t.Run("unknown command", func(t *testing.T) {
+		if code := run([]string{"frobnicate"}); code != exitUsage {
+			t.Errorf("expected usage exit code, got %d", code)
+		}
+	})
+}
+
+func TestImagesLint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	invalid := filepath.Join(dir, "image_sets.json")
+	ioutil.WriteFile(invalid, []byte(`{"images": [{"version": 16}]}`), 0644)
+
+	if code := run([]string{"images", "lint", filepath.Join("..", "..", "images", "image_sets.json")}); code != exitOK {
+		t.Errorf("expected the repository image sets to pass, got exit code %d", code)
+	}
+	if code := run([]string{"images", "lint", invalid}); code != exitFailure {
+		t.Errorf("expected invalid image sets to fail, got exit code %d", code)
+	}
+	if code := run([]string{"images"}); code != exitUsage {
+		t.Errorf("expected usage exit code without subcommand, got %d", code)
+	}
+	if code := run([]string{"images", "frobnicate"}); code != exitUsage {
+		t.Errorf("expected usage exit code for unknown subcommand, got %d", code)
+	}
+}
+
+func TestModelsLint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	invalid := filepath.Join(dir, "pi3-20.model")
+	ioutil.WriteFile(invalid, []byte("type: model\narchitecture: amd64\n"), 0644)
+
+	repository, err := filepath.Glob(filepath.Join("..", "..", "images", "models", "*.model"))
+	if err != nil || len(repository) == 0 {
+		t.Fatalf("expected the models of the repository, got %v, %v", repository, err)
+	}
+	if code := run(append([]string{"models", "lint"}, repository...)); code != exitOK {
+		t.Errorf("expected the repository models to pass, got exit code %d", code)
+	}
+	if code := run([]string{"models", "lint", invalid}); code != exitFailure {
+		t.Errorf("expected an invalid model to fail, got exit code %d", code)
+	}
+	if code := run([]string{"models", "lint", filepath.Join(dir, "missing.model")}); code != exitFailure {
+		t.Errorf("expected a missing model to fail, got exit code %d", code)
+	}
+}
+
+const fakeSnapSign = `#!/bin/sh
+[ "$1 $2 $3" = "sign -k mykey" ] || exit 1
+sed -e 's/[{}",]//g' -e 's/^ *//' -e '/^$/d'
+printf 'sign-key-sha3-384: fake\n\nsignature\n'
+`
+
+func TestModelsGenerate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "models")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "snap"), []byte(fakeSnapSign), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	matrix := filepath.Join(dir, "matrix.json")
+	ioutil.WriteFile(matrix, []byte(`{"authority-id": "canonical", "brand-id": "canonical", "series": [
+		{"version": 18, "platforms": [{"platform": "pc-amd64", "gadget": {"name": "pc", "track": "18"}, "kernel": {"name": "pc-kernel", "track": "18"}}]}
+	]}`), 0644)
+	out := filepath.Join(dir, "out")
+
+	if code := run([]string{"models", "generate", "-matrix", matrix, "-dir", out}); code != exitOK {
+		t.Fatalf("expected generate to succeed, got exit code %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(out, "pc-amd64-18-model.json")); err != nil {
+		t.Errorf("expected the unsigned body to be written, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "pc-amd64-18.model")); !os.IsNotExist(err) {
+		t.Errorf("expected no signed model without -key, got %v", err)
+	}
+
+	if code := run([]string{"models", "generate", "-matrix", matrix, "-dir", out, "-key", "mykey"}); code != exitOK {
+		t.Fatalf("expected generate to sign the models, got exit code %d", code)
+	}
+	if code := run([]string{"models", "lint", filepath.Join(out, "pc-amd64-18.model")}); code != exitOK {
+		t.Errorf("expected the signed model to pass lint, got exit code %d", code)
+	}
+	if code := run([]string{"models", "generate", "-matrix", matrix, "-dir", out, "-key", "otherkey"}); code != exitFailure {
+		t.Errorf("expected generate to fail when snap sign fails, got exit code %d", code)
+	}
+}
+
+func TestImagesDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	old := filepath.Join(dir, "old.manifest")
+	new := filepath.Join(dir, "new.manifest")
+	ioutil.WriteFile(old, []byte("core18 1705\nsnapd 7264\n"), 0644)
+	ioutil.WriteFile(new, []byte("core18 1754\nsnapd 7264\n"), 0644)
+
+	if code := run([]string{"images", "diff", old, new}); code != exitOK {
+		t.Errorf("expected diff to succeed, got exit code %d", code)
+	}
+	if code := run([]string{"images", "diff", old, filepath.Join(dir, "missing")}); code != exitFailure {
+		t.Errorf("expected a missing manifest to fail, got exit code %d", code)
+	}
+	if code := run([]string{"images", "diff", old}); code != exitUsage {
+		t.Errorf("expected usage exit code with one manifest, got %d", code)
+	}
+}
+
+func TestImagesStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sets := filepath.Join(dir, "image_sets.json")
+	ioutil.WriteFile(sets, []byte(`{"metadata": [], "images": [{"version": 18, "channel": "edge", "snaps": [], "platforms": ["pi3"], "triggers": [{"snap": {"name": "snapd", "channel": "edge"}}]}]}`), 0644)
+	os.MkdirAll(filepath.Join(dir, "pi3-18-edge"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "pi3-18-edge", "seed.manifest"), []byte("snapd 100\n"), 0644)
+
+	fake := storetest.New()
+	fake.Release("snapd", "edge", "armhf", 101)
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	args := []string{"images", "status", "-file", sets, "-store", server.URL, "-remote", "", "-output", dir}
+	if code := run(args); code != exitOK {
+		t.Errorf("expected status to succeed, got exit code %d", code)
+	}
+	if code := run(append(args, "-json")); code != exitOK {
+		t.Errorf("expected status with JSON output to succeed, got exit code %d", code)
+	}
+	if code := run(append(args, "-proxy", "squid.internal")); code != exitUsage {
+		t.Errorf("expected usage exit code for an invalid proxy, got %d", code)
+	}
+}
+
+func TestImagesDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "image_db.json")
+	ioutil.WriteFile(path, []byte(`{"images": [{"version": 18, "channel": "beta", "manifest": {"snapd": "7264"}, "snaps": [], "triggers": [], "platform": "pi3"}], "metadata": []}`), 0644)
+
+	if code := run([]string{"images", "db", "list", "-db", path}); code != exitOK {
+		t.Errorf("expected list to succeed, got exit code %d", code)
+	}
+	if code := run([]string{"images", "db", "show", "-db", path, "pi3-18-beta"}); code != exitOK {
+		t.Errorf("expected show to succeed, got exit code %d", code)
+	}
+	if code := run([]string{"images", "db", "show", "-db", path, "pi4-20-beta"}); code != exitFailure {
+		t.Errorf("expected show of an unknown image to fail, got exit code %d", code)
+	}
+	if code := run([]string{"images", "db", "show", "-db", path}); code != exitUsage {
+		t.Errorf("expected usage exit code without image, got %d", code)
+	}
+}
+
+const fakeUbuntuImage = `#!/bin/sh
+while [ $# -gt 0 ]; do
+	if [ "$1" = -O ]; then
+		printf 'core18 1705\nsnapd 7264\n' > "$2/seed.manifest"
+	fi
+	shift
+done
+`
+
+func TestImagesBuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	binary := filepath.Join(dir, "ubuntu-image")
+	ioutil.WriteFile(binary, []byte(fakeUbuntuImage), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "pi3-18.model"), []byte("type: model\n"), 0644)
+	sets := filepath.Join(dir, "image_sets.json")
+	ioutil.WriteFile(sets, []byte(`{"metadata": [], "images": [{"version": 18, "channel": "edge", "snaps": [], "platforms": ["pi3"], "triggers": [{"snap": {"name": "snapd", "channel": "edge"}}]}]}`), 0644)
+	db := filepath.Join(dir, "image_db.json")
+
+	args := []string{"images", "build", "-file", sets, "-models", dir, "-output", filepath.Join(dir, "output"), "-ubuntu-image", binary, "-db", db}
+	if code := run(append(args, "-dry-run", "pi3-18-edge")); code != exitOK {
+		t.Errorf("expected dry run to succeed, got exit code %d", code)
+	}
+	if _, err := os.Stat(db); !os.IsNotExist(err) {
+		t.Errorf("expected nothing recorded in a dry run, got %v", err)
+	}
+
+	if code := run(append(args, "pi3-18-edge")); code != exitOK {
+		t.Fatalf("expected build to succeed, got exit code %d", code)
+	}
+	d, err := imagedb.Load(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, kind := d.Find("pi3-18-edge"); e == nil || kind != imagedb.KindImage || e.Manifest["snapd"] != 7264 || e.BuiltAt == nil {
+		t.Errorf("expected the build to be recorded, got %+v", e)
+	}
+
+	if code := run(append(args, "pi4-20-edge")); code != exitFailure {
+		t.Errorf("expected an unknown image to fail, got exit code %d", code)
+	}
+}
+
+func TestImagesPublish(t *testing.T) {
+	dir, err := ioutil.TempDir("", "publish")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "output", "pi3-18-beta"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "output", "pi3-18-beta", "seed.manifest"), []byte("snapd 1\n"), 0644)
+
+	published := filepath.Join(dir, "published")
+	args := []string{"images", "publish", "-output", filepath.Join(dir, "output"), "-to", published}
+	if code := run(append(args, "pi3-18-beta")); code != exitOK {
+		t.Fatalf("expected publish to succeed, got exit code %d", code)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(published, "pi3-18-beta", "seed.manifest")); err != nil || string(data) != "snapd 1\n" {
+		t.Errorf("expected the published manifest, got %q, %v", data, err)
+	}
+
+	fake := storagetest.New()
+	fake.Token = "secret"
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	t.Setenv("TPR_STORAGE_TOKEN", "secret")
+	args = []string{"images", "publish", "-output", filepath.Join(dir, "output"), "-to", server.URL + "/spread/images"}
+	if code := run(append(args, "pi3-18-beta")); code != exitOK {
+		t.Fatalf("expected publish to a bucket to succeed, got exit code %d", code)
+	}
+	if _, ok := fake.Object("spread", "images/pi3-18-beta/seed.manifest"); !ok {
+		t.Errorf("expected the manifest to be published in the bucket")
+	}
+
+	// the requests are signed when there are keys
+	fake.SigV4 = &storage.SigV4{AccessKey: "access", SecretKey: "secret", Region: "us-east-1"}
+	ioutil.WriteFile(filepath.Join(dir, "output", "pi3-18-beta", "seed.manifest"), []byte("snapd 2\n"), 0644)
+	t.Setenv("TPR_STORAGE_ACCESS_KEY", "access")
+	if code := run(append(args, "pi3-18-beta")); code != exitUsage {
+		t.Errorf("expected usage exit code without secret key, got %d", code)
+	}
+	t.Setenv("TPR_STORAGE_SECRET_KEY", "secret")
+	if code := run(append(args, "pi3-18-beta")); code != exitOK {
+		t.Fatalf("expected signed publish to succeed, got exit code %d", code)
+	}
+	if data, _ := fake.Object("spread", "images/pi3-18-beta/seed.manifest"); string(data) != "snapd 2\n" {
+		t.Errorf("expected the manifest to be updated with signed requests, got %q", data)
+	}
+
+	if code := run(append(args, "pi3-18-edge")); code != exitFailure {
+		t.Errorf("expected publishing an image not built to fail, got exit code %d", code)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "output", "pi3-18-beta", "pi3.img"), nil, 0644)
+	if code := run(append(args, "pi3-18-beta")); code != exitFailure {
+		t.Errorf("expected publishing an uncompressed image to fail, got exit code %d", code)
+	}
+	os.Remove(filepath.Join(dir, "output", "pi3-18-beta", "pi3.img"))
+	if code := run(append(args, "-proxy", "squid.internal", "pi3-18-beta")); code != exitUsage {
+		t.Errorf("expected usage exit code for an invalid proxy, got %d", code)
+	}
+	if code := run(args); code != exitUsage {
+		t.Errorf("expected usage exit code without images, got %d", code)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/fgimenez/validator/pkg/cli"
+	"github.com/fgimenez/validator/pkg/models"
+)
+
+var modelsCmd = &command{
+	name:    "models",
+	summary: "manage the model assertions the images are built from",
+	subcommands: []*command{
+		modelsLintCmd,
+		modelsGenerateCmd,
+	},
+}
+
+var modelsLintCmd = &command{
+	name:    "lint",
+	args:    "[file...]",
+	summary: "check model assertions, the ones in " + models.DefaultDir + " by default",
+	setup: func(fs *flag.FlagSet) func([]string) error {
+		return func(args []string) error {
+			if len(args) == 0 {
+				files, err := models.Files(models.DefaultDir)
+				if err != nil {
+					return err
+				}
+				if len(files) == 0 {
+					return fmt.Errorf("no model assertions found in %s", models.DefaultDir)
+				}
+				args = files
+			}
+			failed := false
+			for _, path := range args {
+				if _, err := models.Load(path); err != nil {
+					fmt.Println(err)
+					failed = true
+				}
+			}
+			if failed {
+				return errFailed
+			}
+			return nil
+		}
+	},
+}
+
+var modelsGenerateCmd = &command{
+	name:    "generate",
+	summary: "write the model assertions declared in a matrix, signed with -key",
+	setup: func(fs *flag.FlagSet) func([]string) error {
+		matrixPath := fs.String("matrix", models.DefaultMatrix, "matrix declaring the models of each series and platform")
+		dir := fs.String("dir", models.DefaultDir, "directory where the models are written")
+		key := fs.String("key", "", "name of the key signing the models with snap sign, only the unsigned bodies are written when empty")
+		return func(args []string) error {
+			if err := noArgs(args); err != nil {
+				return err
+			}
+			matrix, err := models.LoadMatrix(*matrixPath)
+			if err != nil {
+				return err
+			}
+			generated, err := matrix.Generate(time.Now())
+			if err != nil {
+				return fmt.Errorf("%s: %v", *matrixPath, err)
+			}
+			executor := &cli.Executor{}
+			for _, g := range generated {
+				path, err := g.Write(*dir)
+				if err != nil {
+					return err
+				}
+				if *key != "" {
+					if path, err = g.Sign(executor, *key, *dir); err != nil {
+						return err
+					}
+				}
+				fmt.Println(path)
+			}
+			return nil
+		}
+	},
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/fgimenez/validator/pkg/flags"
+)
+
+var planCmd = &command{
+	name:    "plan",
+	summary: "list the spread tasks of the systems and show how they are split in buckets",
+	setup: func(fs *flag.FlagSet) func([]string) error {
+		options := flags.Register(fs)
+		return func(args []string) error {
+			if err := noArgs(args); err != nil {
+				return err
+			}
+			opts, err := validOptions(options)
+			if err != nil {
+				return err
+			}
+			buckets, err := newRunner("").Plan(opts)
+			if err != nil {
+				return err
+			}
+			system := ""
+			for _, bucket := range buckets {
+				if bucket.System != system {
+					system = bucket.System
+					fmt.Printf("%s:\n", system)
+				}
+				fmt.Printf("    bucket %d in %s (%d tasks):\n", bucket.Index, bucket.Queue, len(bucket.Tasks))
+				for _, task := range bucket.Tasks {
+					fmt.Printf("        %s\n", task)
+				}
+			}
+			return nil
+		}
+	},
+}
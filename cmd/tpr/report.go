@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/fgimenez/validator/pkg/manifest"
+)
+
+var reportCmd = &command{
+	name:    "report",
+	summary: "show the results of the jobs of a run, fails if any of them did",
+	setup: func(fs *flag.FlagSet) func([]string) error {
+		path := fs.String("manifest", manifest.DefaultPath, "run manifest written by submit")
+		server := serverFlag(fs)
+		verbose := fs.Bool("v", false, "print the test output of the failed jobs")
+		return func(args []string) error {
+			if err := noArgs(args); err != nil {
+				return err
+			}
+			m, err := manifest.Load(*path)
+			if err != nil {
+				return err
+			}
+			results, err := newRunner(*server).Report(m)
+			if err != nil {
+				return err
+			}
+			var systems, queues []string
+			bySystem := map[string][]int{}
+			byQueue := map[string][]int{}
+			for i, job := range m.Jobs {
+				if _, ok := bySystem[job.System]; !ok {
+					systems = append(systems, job.System)
+				}
+				bySystem[job.System] = append(bySystem[job.System], i)
+				if _, ok := byQueue[job.Queue]; !ok {
+					queues = append(queues, job.Queue)
+				}
+				byQueue[job.Queue] = append(byQueue[job.Queue], i)
+			}
+
+			failed := 0
+			for _, system := range systems {
+				fmt.Printf("%s:\n", system)
+				systemFailed := 0
+				for _, i := range bySystem[system] {
+					job := m.Jobs[i]
+					status := "PASS"
+					switch {
+					case job.TimedOut:
+						status = "TIMEOUT"
+						systemFailed++
+					case !results[i].Passed():
+						status = "FAIL"
+						systemFailed++
+					}
+					fmt.Printf("    bucket %d in %s: job %s %s %s (%d tasks)\n", job.Bucket, job.Queue, job.ID, results[i].JobState, status, len(job.Tasks))
+					if *verbose && !results[i].Passed() {
+						fmt.Println(results[i].TestOutput)
+					}
+				}
+				fmt.Printf("    %d jobs, %d failed\n", len(bySystem[system]), systemFailed)
+				failed += systemFailed
+			}
+			fmt.Printf("queues:\n")
+			for _, queue := range queues {
+				queueFailed := 0
+				for _, i := range byQueue[queue] {
+					if m.Jobs[i].TimedOut || !results[i].Passed() {
+						queueFailed++
+					}
+				}
+				fmt.Printf("    %s: %d jobs, %d failed\n", queue, len(byQueue[queue]), queueFailed)
+			}
+			fmt.Printf("total: %d jobs, %d failed\n", len(m.Jobs), failed)
+			if failed != 0 {
+				return errFailed
+			}
+			return nil
+		}
+	},
+}
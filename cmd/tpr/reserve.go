@@ -0,0 +1,156 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/fgimenez/validator/pkg/manifest"
+	"github.com/fgimenez/validator/pkg/runner"
+	"github.com/fgimenez/validator/pkg/testflinger"
+	"github.com/fgimenez/validator/pkg/types"
+)
+
+// defaultReserveTimeout is the number of seconds a device is kept reserved
+const defaultReserveTimeout = 3600
+
+// defaultReserveWait is the time given to the job to reserve a device, which
+// includes waiting in the queue and provisioning the device
+const defaultReserveWait = 4 * time.Hour
+
+var reserveCmd = &command{
+	name:    "reserve",
+	args:    "[task]",
+	summary: "reserve a device prepared like the one running a bucket of a run, to debug its failures",
+	setup: func(fs *flag.FlagSet) func([]string) error {
+		path := fs.String("manifest", manifest.DefaultPath, "run manifest written by submit")
+		server := serverFlag(fs)
+		system := fs.String("system", "", "system of the bucket to reserve a device for, can be omitted when the run has a single system")
+		bucket := fs.Int("bucket", -1, "index of the bucket to reserve a device for")
+		sshKeys := fs.String("ssh-key", "", "comma separated list of keys allowed to access the device, ie lp:user,gh:user")
+		timeout := fs.Int("timeout", defaultReserveTimeout, "seconds to keep the device reserved")
+		run := fs.Bool("run", false, "run the bucket tasks up to the given task before reserving the device")
+		debug := fs.Bool("debug", false, "run spread with -debug, implies -run")
+		shellAfter := fs.Bool("shell-after", false, "run spread with -shell-after, implies -run")
+		interval := fs.Duration("interval", defaultInterval, "time between job status checks")
+		wait := fs.Duration("wait", defaultReserveWait, "time to wait for the device to be reserved before cancelling the job, 0 waits until the job finishes")
+		return func(args []string) error {
+			if len(args) > 1 {
+				return usageErrorf("unexpected arguments %v", args[1:])
+			}
+			reservation := &testflinger.Reservation{
+				Timeout: *timeout,
+				Run:     *run || *debug || *shellAfter,
+			}
+			for _, key := range strings.Split(*sshKeys, ",") {
+				if key = strings.TrimSpace(key); key != "" {
+					reservation.SSHKeys = append(reservation.SSHKeys, key)
+				}
+			}
+			if len(reservation.SSHKeys) == 0 {
+				return usageErrorf("-ssh-key must list at least one key")
+			}
+			if reservation.Timeout < 1 {
+				return usageErrorf("-timeout must be at least 1")
+			}
+			if *wait < 0 {
+				return usageErrorf("-wait cannot be negative")
+			}
+			if *debug {
+				reservation.SpreadArgs = append(reservation.SpreadArgs, "-debug")
+			}
+			if *shellAfter {
+				reservation.SpreadArgs = append(reservation.SpreadArgs, "-shell-after")
+			}
+
+			m, err := manifest.Load(*path)
+			if err != nil {
+				return err
+			}
+			job, err := findJob(m, *system, *bucket)
+			if err != nil {
+				return err
+			}
+			tasks := job.Tasks
+			if len(args) == 1 {
+				if tasks, err = tasksUpTo(job.Tasks, args[0]); err != nil {
+					return err
+				}
+			}
+
+			definition := testflinger.NewReserveJob(m.Options, &types.Bucket{
+				System: job.System,
+				Index:  job.Bucket,
+				Queue:  job.Queue,
+				Tasks:  tasks,
+			}, reservation)
+			cfg, err := testflinger.WriteTemp(definition)
+			if err != nil {
+				return err
+			}
+			defer os.Remove(cfg)
+
+			// the job is cancelled on interrupt, a second one kills the process
+			interrupt := make(chan os.Signal, 1)
+			signal.Notify(interrupt, os.Interrupt)
+			stop := make(chan struct{})
+			go func() {
+				if _, ok := <-interrupt; ok {
+					signal.Stop(interrupt)
+					close(stop)
+				}
+			}()
+			defer close(interrupt)
+			defer signal.Stop(interrupt)
+
+			opts := &runner.ReserveOptions{Interval: *interval, Timeout: *wait, Stop: stop}
+			_, addresses, err := newRunner(*server).Reserve(cfg, definition, opts, func(id, state string) {
+				fmt.Printf("%s bucket %d in %s: job %s %s\n", job.System, job.Bucket, job.Queue, id, state)
+			})
+			if err != nil {
+				return err
+			}
+			fmt.Printf("device reserved for %d seconds, connect with:\n", reservation.Timeout)
+			for _, address := range addresses {
+				fmt.Printf("ssh %s\n", address)
+			}
+			return nil
+		}
+	},
+}
+
+// findJob returns the job of the manifest running the given bucket, the system
+// can be empty when all the jobs are for the same system
+func findJob(m *types.Manifest, system string, bucket int) (*types.Job, error) {
+	if bucket < 0 {
+		return nil, usageErrorf("-bucket must be given")
+	}
+	if system == "" {
+		for _, job := range m.Jobs {
+			if system != "" && job.System != system {
+				return nil, usageErrorf("-system must be given, the run has several systems")
+			}
+			system = job.System
+		}
+	}
+	for _, job := range m.Jobs {
+		if job.System == system && job.Bucket == bucket {
+			return job, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot find bucket %d of %s in the run", bucket, system)
+}
+
+// tasksUpTo returns the tasks of a bucket until the given one, included. The
+// task can be given without the backend and system prefix
+func tasksUpTo(tasks []string, task string) ([]string, error) {
+	for i, t := range tasks {
+		if t == task || strings.HasSuffix(t, ":"+task) {
+			return tasks[:i+1], nil
+		}
+	}
+	return nil, fmt.Errorf("cannot find task %s in the bucket", task)
+}
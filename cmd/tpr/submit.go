@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/fgimenez/validator/pkg/flags"
+	"github.com/fgimenez/validator/pkg/manifest"
+)
+
+var submitCmd = &command{
+	name:    "submit",
+	summary: "generate the job definitions, submit them to testflinger and record the run manifest",
+	setup: func(fs *flag.FlagSet) func([]string) error {
+		options := flags.Register(fs)
+		path := fs.String("manifest", manifest.DefaultPath, "file where the run manifest is written")
+		server := serverFlag(fs)
+		return func(args []string) error {
+			if err := noArgs(args); err != nil {
+				return err
+			}
+			opts, err := validOptions(options)
+			if err != nil {
+				return err
+			}
+			m, err := newRunner(*server).Submit(opts)
+			if len(m.Jobs) != 0 {
+				if err := manifest.Save(*path, m); err != nil {
+					return err
+				}
+				for _, job := range m.Jobs {
+					fmt.Printf("%s bucket %d in %s: job %s\n", job.System, job.Bucket, job.Queue, job.ID)
+				}
+				fmt.Printf("testing %s at %s\n", m.Options.Repo, m.Commit)
+				fmt.Printf("run manifest written to %s\n", *path)
+			}
+			return err
+		}
+	},
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/fgimenez/validator/pkg/manifest"
+	"github.com/fgimenez/validator/pkg/runner"
+	"github.com/fgimenez/validator/pkg/testflinger"
+	"github.com/fgimenez/validator/pkg/types"
+)
+
+const defaultInterval = time.Minute
+
+var watchCmd = &command{
+	name:    "watch",
+	summary: "follow the state of the jobs of a run until all of them are finished, on interrupt offers to cancel them",
+	setup: func(fs *flag.FlagSet) func([]string) error {
+		path := fs.String("manifest", manifest.DefaultPath, "run manifest written by submit")
+		server := serverFlag(fs)
+		interval := fs.Duration("interval", defaultInterval, "time between job status checks")
+		stall := fs.Duration("stall", 0, "cancel running jobs whose output doesn't change for this long, printing the output read, 0 disables it")
+		reschedule := fs.Int("reschedule", 0, "number of times the bucket of a stalled job is submitted again")
+		return func(args []string) error {
+			if err := noArgs(args); err != nil {
+				return err
+			}
+			if *stall < 0 || *reschedule < 0 {
+				return usageErrorf("-stall and -reschedule cannot be negative")
+			}
+			m, err := manifest.Load(*path)
+			if err != nil {
+				return err
+			}
+
+			interrupt := make(chan os.Signal, 1)
+			signal.Notify(interrupt, os.Interrupt)
+			stop := make(chan struct{})
+			go func() {
+				if _, ok := <-interrupt; ok {
+					close(stop)
+				}
+			}()
+			defer close(interrupt)
+			defer signal.Stop(interrupt)
+
+			r := newRunner(*server)
+			opts := &runner.WatchOptions{
+				Interval:   *interval,
+				Stall:      *stall,
+				Reschedule: *reschedule,
+				Stop:       stop,
+				// the output read to detect stalls is not returned again
+				Output: func(job *types.Job, output string) {
+					for _, line := range strings.Split(strings.TrimSuffix(output, "\n"), "\n") {
+						fmt.Printf("%s bucket %d: %s\n", job.System, job.Bucket, line)
+					}
+				},
+			}
+			err = r.Watch(m, opts, func(job *types.Job) {
+				state := job.State
+				switch {
+				case job.TimedOut:
+					state = "timed out"
+				case state == "":
+					state = "submitted"
+				}
+				fmt.Printf("%s bucket %d in %s: job %s %s\n", job.System, job.Bucket, job.Queue, job.ID, state)
+				if err := manifest.Save(*path, m); err != nil {
+					fmt.Fprintf(os.Stderr, "cannot update manifest: %v\n", err)
+				}
+			})
+			if err != runner.ErrStopped {
+				return err
+			}
+
+			// a second interrupt while asking kills the process
+			signal.Stop(interrupt)
+			pending := 0
+			for _, job := range m.Jobs {
+				if !testflinger.Finished(job.State) {
+					pending++
+				}
+			}
+			if !confirm(os.Stdin, os.Stdout, fmt.Sprintf("\ncancel the %d outstanding jobs?", pending)) {
+				return err
+			}
+			return cancelJobs(r, *path, m)
+		}
+	},
+}
+
+// confirm asks the given yes or no question, anything but yes is a no
+func confirm(r io.Reader, w io.Writer, question string) bool {
+	fmt.Fprintf(w, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(r).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
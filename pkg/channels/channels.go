@@ -0,0 +1,59 @@
+// Package channels validates the snap channels given to the tools, in the
+// command line and in the image sets and models
+package channels
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Risks are the risk levels a channel can refer to
+var Risks = []string{"stable", "candidate", "beta", "edge"}
+
+var (
+	trackRegexp  = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]*$`)
+	branchRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+)
+
+// Validate checks that the given channel has the form
+// [<track>/]<risk>[/<branch>] with a known risk, ie edge or 20/edge
+func Validate(channel string) error {
+	parts := strings.Split(channel, "/")
+	var track, risk, branch string
+	switch len(parts) {
+	case 1:
+		risk = parts[0]
+	case 2:
+		// track/risk or risk/branch
+		if isRisk(parts[0]) {
+			risk, branch = parts[0], parts[1]
+		} else {
+			track, risk = parts[0], parts[1]
+		}
+	case 3:
+		track, risk, branch = parts[0], parts[1], parts[2]
+	default:
+		return fmt.Errorf("must have the form [<track>/]<risk>[/<branch>], got %q", channel)
+	}
+
+	if !isRisk(risk) {
+		return fmt.Errorf("must refer to one of the risks %s, got %q", strings.Join(Risks, ", "), channel)
+	}
+	if track != "" && !trackRegexp.MatchString(track) || len(parts) == 3 && track == "" {
+		return fmt.Errorf("has an invalid track in %q", channel)
+	}
+	if branch != "" && !branchRegexp.MatchString(branch) || len(parts) > 1 && track == "" && branch == "" {
+		return fmt.Errorf("has an invalid branch in %q", channel)
+	}
+	return nil
+}
+
+func isRisk(risk string) bool {
+	for _, r := range Risks {
+		if r == risk {
+			return true
+		}
+	}
+	return false
+}
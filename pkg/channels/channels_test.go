@@ -0,0 +1,20 @@
+package channels_test
+
+import (
+	"testing"
+
+	"github.com/fgimenez/validator/pkg/channels"
+)
+
+func TestValidate(t *testing.T) {
+	for _, channel := range []string{"edge", "stable", "20/edge", "latest/beta", "beta/fix-123", "18/candidate/hotfix"} {
+		if err := channels.Validate(channel); err != nil {
+			t.Errorf("expected channel %q to be valid, got %v", channel, err)
+		}
+	}
+	for _, channel := range []string{"", "edgy", "20/", "/edge", "edge/", "20/edgy", "Latest/edge", "a/edge/b/c", "/edge/b"} {
+		if err := channels.Validate(channel); err == nil {
+			t.Errorf("expected channel %q to be invalid", channel)
+		}
+	}
+}
@@ -1,6 +1,12 @@
 package cli
 
-import "os/exec"
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
 
 var (
 	execCommand = exec.Command
@@ -17,3 +23,25 @@ func (e *Executor) ExecCommand(cmds ...string) (output string, err error) {
 	output = string(outputByte)
 	return
 }
+
+// OutputCommand runs the given command and returns only its standard output,
+// the standard error is included in the error when the command fails
+func (e *Executor) OutputCommand(cmds ...string) (string, error) {
+	cmd := execCommand(cmds[0], cmds[1:]...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil && stderr.Len() != 0 {
+		err = fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return string(output), err
+}
+
+// StreamCommand runs the given command writing its output to w as it is
+// produced
+func (e *Executor) StreamCommand(w io.Writer, cmds ...string) error {
+	cmd := execCommand(cmds[0], cmds[1:]...)
+	cmd.Stdout = w
+	cmd.Stderr = w
+	return cmd.Run()
+}
@@ -1,6 +1,7 @@
 package cli
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"os/exec"
@@ -47,6 +48,22 @@ func TestHelperProcessErr(t *testing.T) {
 	baseHelperProcess(1)
 }
 
+func TestHelperProcessWarning(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	fmt.Fprint(os.Stderr, "mywarning")
+	baseHelperProcess(0)
+}
+
+func TestHelperProcessErrWithWarning(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	fmt.Fprint(os.Stderr, "mywarning")
+	baseHelperProcess(1)
+}
+
 func baseHelperProcess(exitValue int) {
 	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
 		return
@@ -78,3 +95,52 @@ func TestExecCommandErrWithError(t *testing.T) {
 		t.Errorf("expected output %q, obtained %q", execOutput, actualOutput)
 	}
 }
+
+func TestOutputCommand(t *testing.T) {
+	s.helperProcess = "TestHelperProcessWarning"
+	defer func() { s.helperProcess = "TestHelperProcess" }()
+
+	actualOutput, err := s.subject.OutputCommand("mycmd")
+	if err != nil {
+		t.Errorf("returned error %v", err)
+	}
+	if actualOutput != execOutput {
+		t.Errorf("expected output %q without the standard error, obtained %q", execOutput, actualOutput)
+	}
+}
+
+func TestOutputCommandWithError(t *testing.T) {
+	s.helperProcess = "TestHelperProcessErrWithWarning"
+	defer func() { s.helperProcess = "TestHelperProcess" }()
+
+	actualOutput, err := s.subject.OutputCommand("mycmd")
+	if err == nil || err.Error() != "exit status 1: mywarning" {
+		t.Errorf("expected error including the standard error, got %v", err)
+	}
+	if actualOutput != execOutput {
+		t.Errorf("expected output %q, obtained %q", execOutput, actualOutput)
+	}
+}
+
+func TestStreamCommand(t *testing.T) {
+	var out bytes.Buffer
+	if err := s.subject.StreamCommand(&out, "mycmd"); err != nil {
+		t.Errorf("returned error %v", err)
+	}
+	if out.String() != execOutput {
+		t.Errorf("expected output %q, obtained %q", execOutput, out.String())
+	}
+}
+
+func TestStreamCommandWithError(t *testing.T) {
+	s.helperProcess = "TestHelperProcessErr"
+	defer func() { s.helperProcess = "TestHelperProcess" }()
+
+	var out bytes.Buffer
+	if err := s.subject.StreamCommand(&out, "mycmd"); err == nil {
+		t.Error("not returned expected error")
+	}
+	if out.String() != execOutput {
+		t.Errorf("expected output %q, obtained %q", execOutput, out.String())
+	}
+}
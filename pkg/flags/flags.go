@@ -2,37 +2,309 @@ package flags
 
 import (
 	"flag"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/fgimenez/validator/pkg/profiles"
 	"github.com/fgimenez/validator/pkg/types"
 )
 
 const (
-	DefaultSystem    = "external:ubuntu-core-16-arm-64"
+	DefaultPlatform  = "dragonboard"
 	DefaultExecutors = 4
 	DefaultChannel   = "edge"
 	DefaultFrom      = "target"
 	DefaultRelease   = "master"
-	DefaultQueue     = "dragonboard"
+	DefaultRepo      = "https://github.com/snapcore/snapd"
+	DefaultSpreadFmt = "https://niemeyer.s3.amazonaws.com/spread-%s.tar.gz"
+	// SpreadReleasesURL is where the tarballs of the spread releases are
+	// published, in a directory per version
+	SpreadReleasesURL = "https://github.com/snapcore/spread/releases/download"
+	DefaultArch       = "amd64"
+	DefaultTimeout    = 4 * time.Hour
 )
 
+// The default system and queue are the ones of the profile of the default
+// platform, for its first series
+var (
+	DefaultSystem = profiles.MustGet(DefaultPlatform).System
+	DefaultQueue  = profiles.MustGet(DefaultPlatform).Queue
+)
+
+// profileFlag is a flag.Value holding a comma separated list of names of
+// known profiles
+type profileFlag []*profiles.Profile
+
+func (p *profileFlag) String() string {
+	var names []string
+	for _, profile := range *p {
+		names = append(names, profile.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (p *profileFlag) Set(value string) error {
+	*p = nil
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		profile, err := profiles.Get(name)
+		if err != nil {
+			return err
+		}
+		*p = append(*p, profile)
+	}
+	return nil
+}
+
+// listFlag is a flag.Value holding a comma separated list of values
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// queuesFlag is a flag.Value holding a comma separated list of queues, each
+// of them optionally followed by its weight, ie dragonboard:2,dragonboard-2
+type queuesFlag []types.Queue
+
+func (q *queuesFlag) String() string {
+	var items []string
+	for _, queue := range *q {
+		if queue.Weight == 1 {
+			items = append(items, queue.Name)
+		} else {
+			items = append(items, fmt.Sprintf("%s:%d", queue.Name, queue.Weight))
+		}
+	}
+	return strings.Join(items, ",")
+}
+
+func (q *queuesFlag) Set(value string) error {
+	*q = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		queue := types.Queue{Name: item, Weight: 1}
+		if i := strings.LastIndex(item, ":"); i != -1 {
+			weight, err := strconv.Atoi(item[i+1:])
+			if err != nil {
+				return fmt.Errorf("invalid weight in %q", item)
+			}
+			queue = types.Queue{Name: item[:i], Weight: weight}
+		}
+		*q = append(*q, queue)
+	}
+	return nil
+}
+
+// refreshFlag is a flag.Value holding a comma separated list of snaps to
+// refresh, given as name=channel, name@revision or path/to/file.snap with an
+// optional :path/to/file.assert, by default the .assert file next to the snap
+type refreshFlag []types.Refresh
+
+func (r *refreshFlag) String() string {
+	var items []string
+	for _, refresh := range *r {
+		switch {
+		case refresh.File != "":
+			items = append(items, refresh.File+":"+refresh.Assertion)
+		case refresh.Revision != "":
+			items = append(items, refresh.Name+"@"+refresh.Revision)
+		default:
+			items = append(items, refresh.Name+"="+refresh.Channel)
+		}
+	}
+	return strings.Join(items, ",")
+}
+
+func (r *refreshFlag) Set(value string) error {
+	*r = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		refresh, err := parseRefresh(item)
+		if err != nil {
+			return err
+		}
+		*r = append(*r, refresh)
+	}
+	return nil
+}
+
+func parseRefresh(item string) (types.Refresh, error) {
+	// the file part ends with .snap, directories may contain it too
+	file, assertion := item, ""
+	if i := strings.Index(item, ".snap:"); i != -1 {
+		file, assertion = item[:i+len(".snap")], item[i+len(".snap:"):]
+		if assertion == "" {
+			return types.Refresh{}, fmt.Errorf("invalid snap file in %q, expected file.snap[:file.assert]", item)
+		}
+	}
+	if strings.HasSuffix(file, ".snap") {
+		if assertion == "" {
+			assertion = strings.TrimSuffix(file, ".snap") + ".assert"
+		}
+		// snap files are named after the snap, ie snapd_123.snap
+		name := strings.SplitN(filepath.Base(file), "_", 2)[0]
+		name = strings.TrimSuffix(name, ".snap")
+		return types.Refresh{Name: name, File: file, Assertion: assertion}, nil
+	}
+	if i := strings.Index(item, "@"); i != -1 {
+		return types.Refresh{Name: item[:i], Revision: item[i+1:]}, nil
+	}
+	if i := strings.Index(item, "="); i != -1 {
+		return types.Refresh{Name: item[:i], Channel: item[i+1:]}, nil
+	}
+	return types.Refresh{}, fmt.Errorf("invalid refresh %q, expected name=channel, name@revision or file.snap", item)
+}
+
 // Parse analyzes the given flags and return them inside an Options struct
 func Parse() *types.Options {
+	options := Register(flag.CommandLine)
+	flag.Parse()
+	return options()
+}
+
+// Register defines the options flags in the given flag set, the returned
+// function builds the Options once the flag set has been parsed
+func Register(fs *flag.FlagSet) func() *types.Options {
 	var (
-		system    = flag.String("system", DefaultSystem, "spread system to execute the test on")
-		executors = flag.Int("executors", DefaultExecutors, "number of parallel testflinger executors")
-		channel   = flag.String("channel", DefaultChannel, "channel of the target snap to test")
-		from      = flag.String("from", DefaultFrom, "determines the channel from which initially provision the image, the target or stable")
-		release   = flag.String("release", DefaultRelease, "release branch")
-		queue     = flag.String("queue", DefaultQueue, "testflinger queue")
+		systems    = &listFlag{DefaultSystem}
+		executors  = fs.Int("executors", DefaultExecutors, "number of parallel testflinger executors")
+		channel    = fs.String("channel", DefaultChannel, "channel of the target snap to test")
+		from       = fs.String("from", DefaultFrom, "determines how to initially provision the device: from the target channel, from stable refreshing to the target channel or from the image given in -image")
+		image      = fs.String("image", "", "URL of the image to provision the device with when -from is image, ie one of the xz images published by image-generator")
+		imageHash  = fs.String("image-sha256", "", "SHA-256 checksum of the image given in -image")
+		refresh    = &refreshFlag{}
+		release    = fs.String("release", DefaultRelease, "release branch")
+		repo       = fs.String("repo", DefaultRepo, "URL of the snapd repository to clone")
+		ref        = fs.String("ref", "", "refspec to fetch from the repository and test instead of the release branch, ie pull/1234/head")
+		commit     = fs.String("commit", "", "commit to test, by default the one the ref or release branch points to when the jobs are generated")
+		spread     = fs.String("spread", "", "URL or local path of the spread tarball used by the jobs, local files are uploaded along with the job, by default the one for -spread-arch in "+fmt.Sprintf(DefaultSpreadFmt, "<arch>"))
+		spreadArch = fs.String("spread-arch", DefaultArch, "architecture of the testflinger agent hosts, used to pick the default spread tarball")
+		spreadHash = fs.String("spread-sha256", "", "SHA-256 checksum of the spread tarball, required for every source including the default one, which is replaced by each spread release")
+		spreadVer  = fs.String("spread-version", "", "release of spread whose tarball for -spread-arch is used, from "+SpreadReleasesURL+"/<version>, instead of -spread")
+		queues     = &queuesFlag{{Name: DefaultQueue, Weight: 1}}
+		profile    = &profileFlag{}
+		outputDir  = fs.String("output", "", "directory where the job definitions are written as <system>-<bucket>.yaml, replacing the ones of previous runs, a new temporary one by default")
+		timeout    = fs.Duration("timeout", DefaultTimeout, "overall timeout of each job, testflinger stops the job once reached, 0 uses the lab default")
 	)
-	flag.Parse()
+	fs.Var(refresh, "refresh", "comma separated list of snaps to refresh after provisioning, as name=channel, name@revision or file.snap[:file.assert] to sideload, by default core is refreshed to -channel when -from is stable")
+	fs.Var(systems, "system", "comma separated list of spread systems to execute the test on")
+	fs.Var(queues, "queue", "comma separated list of testflinger queues, each of them optionally followed by :weight to get a bigger share of the buckets")
+	fs.Var(profile, "profile", fmt.Sprintf("comma separated list of `names` of device profiles, each setting a system, the queue it runs in and the image published for it used when -from is image, <platform>-<series> or just the platform for its first series, explicit flags take precedence (%s)", strings.Join(profiles.Names(), ", ")))
+
+	return func() *types.Options {
+		options := &types.Options{
+			Systems:   *systems,
+			Executors: *executors,
+			Channel:   *channel,
+			From:      *from,
+			Image:     *image,
+			ImageHash: *imageHash,
+			Refresh:   *refresh,
+			Release:   *release,
+			Repo:      *repo,
+			Ref:       *ref,
+			Commit:    *commit,
+			Spread:    spreadSource(*spread, *spreadArch, *spreadHash, *spreadVer),
+			Queues:    *queues,
+			Timeout:   *timeout,
+			OutputDir: *outputDir,
+		}
+		if len(*profile) != 0 {
+			applyProfiles(options, *profile, explicitFlags(fs))
+		}
+		return options
+	}
+}
+
+// SpreadRelease returns the URL of the tarball of a spread release for the
+// given architecture
+func SpreadRelease(version, arch string) string {
+	return fmt.Sprintf("%s/%s/spread-%s.tar.gz", SpreadReleasesURL, version, arch)
+}
+
+// spreadSource tells if the given spread location is a URL or a local path,
+// the default one depends on the architecture and the version if given
+func spreadSource(location, arch, hash, version string) types.Spread {
+	if location == "" {
+		location = fmt.Sprintf(DefaultSpreadFmt, arch)
+		if version != "" {
+			location = SpreadRelease(version, arch)
+		}
+	}
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		return types.Spread{URL: location, Hash: hash, Version: version}
+	}
+	return types.Spread{Path: location, Hash: hash, Version: version}
+}
+
+// explicitFlags returns the names of the flags given in the command line
+func explicitFlags(fs *flag.FlagSet) map[string]bool {
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	return explicit
+}
+
+// applyProfiles fills the options with the profile values, except for those
+// given explicitly. Each profile adds its system, the systems of several
+// profiles run in the queues of their profiles, shared by the profiles with
+// the same system. Devices provisioned from an image get the one published
+// for the profile on the tested channel
+func applyProfiles(options *types.Options, list profileFlag, explicit map[string]bool) {
+	options.Profile = list.String()
+	// a single image can only provision the system of a single profile
+	if options.From == "image" && !explicit["image"] && len(list) == 1 {
+		options.Image = list[0].ImageURL(options.Channel)
+	}
+	systemQueues := map[string][]types.Queue{}
+	var systems []string
+	for _, profile := range list {
+		if _, ok := systemQueues[profile.System]; !ok {
+			systems = append(systems, profile.System)
+		}
+		queue := types.Queue{Name: profile.Queue, Weight: 1}
+		if !containsQueue(systemQueues[profile.System], queue) {
+			systemQueues[profile.System] = append(systemQueues[profile.System], queue)
+		}
+	}
+	if !explicit["system"] {
+		options.Systems = systems
+	}
+	if explicit["queue"] {
+		return
+	}
+	options.Queues = systemQueues[systems[0]]
+	if len(systems) > 1 {
+		options.SystemQueues = systemQueues
+	}
+}
 
-	return &types.Options{
-		System:    *system,
-		Executors: *executors,
-		Channel:   *channel,
-		From:      *from,
-		Release:   *release,
-		Queue:     *queue,
+func containsQueue(queues []types.Queue, queue types.Queue) bool {
+	for _, q := range queues {
+		if q.Name == queue.Name {
+			return true
+		}
 	}
+	return false
 }
@@ -2,10 +2,14 @@ package flags_test
 
 import (
 	"flag"
+	"io/ioutil"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/fgimenez/validator/pkg/flags"
+	"github.com/fgimenez/validator/pkg/seed"
 	"github.com/fgimenez/validator/pkg/types"
 )
 
@@ -14,7 +18,7 @@ func TestParseReturnsParsedFlags(t *testing.T) {
 	parsedFlags = flags.Parse()
 
 	if v, ok := parsedFlags.(*types.Options); !ok {
-		t.Errorf("Parse didn't return options: %q", v)
+		t.Errorf("Parse didn't return options: %v", v)
 	}
 }
 
@@ -24,8 +28,20 @@ func TestParseSetsSystemToFlagValue(t *testing.T) {
 	os.Args = []string{"", "-system", "my-system"}
 	parsedFlags := flags.Parse()
 
-	if parsedFlags.System != "my-system" {
-		t.Errorf("system wasn't parsed: %q instead of my-system", parsedFlags.System)
+	if len(parsedFlags.Systems) != 1 || parsedFlags.Systems[0] != "my-system" {
+		t.Errorf("system wasn't parsed: %q instead of [my-system]", parsedFlags.Systems)
+	}
+}
+
+func TestParseSetsSystemsToFlagValues(t *testing.T) {
+	resetFlag()
+
+	os.Args = []string{"", "-system", "my-system1, my-system2,,my-system3"}
+	parsedFlags := flags.Parse()
+
+	expected := []string{"my-system1", "my-system2", "my-system3"}
+	if strings.Join(parsedFlags.Systems, " ") != strings.Join(expected, " ") {
+		t.Errorf("systems weren't parsed: %q instead of %q", parsedFlags.Systems, expected)
 	}
 }
 
@@ -35,8 +51,8 @@ func TestParseSetsSystemToDefaultValue(t *testing.T) {
 	os.Args = []string{""}
 	parsedFlags := flags.Parse()
 
-	if parsedFlags.System != flags.DefaultSystem {
-		t.Errorf("system wasn't set to default: %q instead of %q", parsedFlags.System, flags.DefaultSystem)
+	if len(parsedFlags.Systems) != 1 || parsedFlags.Systems[0] != flags.DefaultSystem {
+		t.Errorf("system wasn't set to default: %q instead of [%q]", parsedFlags.Systems, flags.DefaultSystem)
 	}
 }
 
@@ -47,7 +63,7 @@ func TestParseSetsexecutorsToFlagValue(t *testing.T) {
 	parsedFlags := flags.Parse()
 
 	if parsedFlags.Executors != 4 {
-		t.Errorf("executors wasn't parsed: %q instead of 4", parsedFlags.Executors)
+		t.Errorf("executors wasn't parsed: %d instead of 4", parsedFlags.Executors)
 	}
 }
 
@@ -58,7 +74,7 @@ func TestParseSetsExecutorsToDefaultValue(t *testing.T) {
 	parsedFlags := flags.Parse()
 
 	if parsedFlags.Executors != flags.DefaultExecutors {
-		t.Errorf("executors wasn't set to default: %q instead of %q", parsedFlags.Executors, flags.DefaultExecutors)
+		t.Errorf("executors wasn't set to default: %d instead of %d", parsedFlags.Executors, flags.DefaultExecutors)
 	}
 }
 
@@ -128,6 +144,193 @@ func TestParseSetsReleaseToDefaultValue(t *testing.T) {
 	}
 }
 
+func TestParseSetsProfileValues(t *testing.T) {
+	resetFlag()
+
+	os.Args = []string{"", "-profile", "pi3"}
+	parsedFlags := flags.Parse()
+
+	if parsedFlags.Profile != "pi3-16" {
+		t.Errorf("profile wasn't parsed: %q instead of pi3-16", parsedFlags.Profile)
+	}
+	if len(parsedFlags.Queues) != 1 || parsedFlags.Queues[0].Name != "pi3" {
+		t.Errorf("queue wasn't set from profile: %v instead of [pi3]", parsedFlags.Queues)
+	}
+	if len(parsedFlags.Systems) != 1 || parsedFlags.Systems[0] != "external:ubuntu-core-16-arm-32" {
+		t.Errorf("system wasn't set from profile: %q instead of [external:ubuntu-core-16-arm-32]", parsedFlags.Systems)
+	}
+}
+
+func TestParseSetsProfileSystemOfSeries(t *testing.T) {
+	resetFlag()
+
+	os.Args = []string{"", "-profile", "pi3-20"}
+	parsedFlags := flags.Parse()
+
+	if len(parsedFlags.Queues) != 1 || parsedFlags.Queues[0].Name != "pi3" {
+		t.Errorf("queue wasn't set from profile: %v instead of [pi3]", parsedFlags.Queues)
+	}
+	if len(parsedFlags.Systems) != 1 || parsedFlags.Systems[0] != "external:ubuntu-core-20-arm-32" {
+		t.Errorf("system wasn't set from profile: %q instead of [external:ubuntu-core-20-arm-32]", parsedFlags.Systems)
+	}
+}
+
+func TestParseSetsProfileImage(t *testing.T) {
+	resetFlag()
+
+	os.Args = []string{"", "-profile", "pi3-18", "-from", "image", "-channel", "beta"}
+	parsedFlags := flags.Parse()
+
+	if parsedFlags.Image != seed.PublicURL+"/pi3-18-beta/pi3.img.xz" {
+		t.Errorf("image wasn't set from profile: %q", parsedFlags.Image)
+	}
+
+	resetFlag()
+	os.Args = []string{"", "-profile", "pi3-18", "-from", "image", "-image", "https://example.com/pi3.img.xz"}
+	if parsedFlags = flags.Parse(); parsedFlags.Image != "https://example.com/pi3.img.xz" {
+		t.Errorf("image wasn't kept: %q", parsedFlags.Image)
+	}
+
+	resetFlag()
+	os.Args = []string{"", "-profile", "pi3-18"}
+	if parsedFlags = flags.Parse(); parsedFlags.Image != "" {
+		t.Errorf("expected no image when not provisioning from one, got %q", parsedFlags.Image)
+	}
+}
+
+func TestParseSetsQueuesOfSeveralProfiles(t *testing.T) {
+	resetFlag()
+
+	os.Args = []string{"", "-profile", "pi3-16,pi3-20,cm3-16,dragonboard"}
+	parsedFlags := flags.Parse()
+
+	if parsedFlags.Profile != "pi3-16,pi3-20,cm3-16,dragonboard-16" {
+		t.Errorf("profiles weren't parsed: %q", parsedFlags.Profile)
+	}
+	expectedSystems := []string{"external:ubuntu-core-16-arm-32", "external:ubuntu-core-20-arm-32", "external:ubuntu-core-16-arm-64"}
+	if !reflect.DeepEqual(parsedFlags.Systems, expectedSystems) {
+		t.Errorf("systems weren't set from profiles: %q instead of %q", parsedFlags.Systems, expectedSystems)
+	}
+	expectedQueues := map[string][]types.Queue{
+		"external:ubuntu-core-16-arm-32": {{Name: "pi3", Weight: 1}, {Name: "cm3", Weight: 1}},
+		"external:ubuntu-core-20-arm-32": {{Name: "pi3", Weight: 1}},
+		"external:ubuntu-core-16-arm-64": {{Name: "dragonboard", Weight: 1}},
+	}
+	if !reflect.DeepEqual(parsedFlags.SystemQueues, expectedQueues) {
+		t.Errorf("queues of the systems weren't set from profiles: %v instead of %v", parsedFlags.SystemQueues, expectedQueues)
+	}
+}
+
+func TestParseExplicitFlagsOverrideProfile(t *testing.T) {
+	resetFlag()
+
+	os.Args = []string{"", "-queue", "pi3-2", "-profile", "pi3"}
+	parsedFlags := flags.Parse()
+
+	if len(parsedFlags.Queues) != 1 || parsedFlags.Queues[0].Name != "pi3-2" {
+		t.Errorf("queue wasn't kept: %v instead of [pi3-2]", parsedFlags.Queues)
+	}
+	if len(parsedFlags.Systems) != 1 || parsedFlags.Systems[0] != "external:ubuntu-core-16-arm-32" {
+		t.Errorf("system wasn't set from profile: %q instead of [external:ubuntu-core-16-arm-32]", parsedFlags.Systems)
+	}
+}
+
+func TestParseWithoutProfileKeepsDefaults(t *testing.T) {
+	resetFlag()
+
+	os.Args = []string{""}
+	parsedFlags := flags.Parse()
+
+	if parsedFlags.Profile != "" {
+		t.Errorf("profile wasn't empty: %q", parsedFlags.Profile)
+	}
+	if len(parsedFlags.Queues) != 1 || parsedFlags.Queues[0] != (types.Queue{Name: flags.DefaultQueue, Weight: 1}) {
+		t.Errorf("queue wasn't set to default: %v instead of [%s]", parsedFlags.Queues, flags.DefaultQueue)
+	}
+}
+
+func TestParseSetsQueuesToFlagValues(t *testing.T) {
+	resetFlag()
+
+	os.Args = []string{"", "-queue", "dragonboard:2, dragonboard-2"}
+	parsedFlags := flags.Parse()
+
+	expected := []types.Queue{{Name: "dragonboard", Weight: 2}, {Name: "dragonboard-2", Weight: 1}}
+	if len(parsedFlags.Queues) != 2 || parsedFlags.Queues[0] != expected[0] || parsedFlags.Queues[1] != expected[1] {
+		t.Errorf("queues weren't parsed: %v instead of %v", parsedFlags.Queues, expected)
+	}
+}
+
+func TestParseRejectsInvalidQueueWeight(t *testing.T) {
+	resetFlag()
+	flag.CommandLine.SetOutput(ioutil.Discard)
+
+	os.Args = []string{"", "-queue", "dragonboard:two"}
+	flags.Register(flag.CommandLine)
+	if err := flag.CommandLine.Parse(os.Args[1:]); err == nil {
+		t.Error("expected error for invalid queue weight")
+	}
+}
+
+func TestParseSetsRefreshToFlagValues(t *testing.T) {
+	resetFlag()
+
+	os.Args = []string{"", "-refresh", "snapd=20/edge,core18@1234, /tmp/pi-kernel_12.snap,/tmp/gadget.snap:/tmp/other.assert,/tmp/my.snapshots/core.snap,/tmp/my.snapshots/pc.snap:/tmp/my.snapshots/pc.assert"}
+	parsedFlags := flags.Parse()
+
+	expected := []types.Refresh{
+		{Name: "snapd", Channel: "20/edge"},
+		{Name: "core18", Revision: "1234"},
+		{Name: "pi-kernel", File: "/tmp/pi-kernel_12.snap", Assertion: "/tmp/pi-kernel_12.assert"},
+		{Name: "gadget", File: "/tmp/gadget.snap", Assertion: "/tmp/other.assert"},
+		{Name: "core", File: "/tmp/my.snapshots/core.snap", Assertion: "/tmp/my.snapshots/core.assert"},
+		{Name: "pc", File: "/tmp/my.snapshots/pc.snap", Assertion: "/tmp/my.snapshots/pc.assert"},
+	}
+	if len(parsedFlags.Refresh) != len(expected) {
+		t.Fatalf("refresh wasn't parsed: %v instead of %v", parsedFlags.Refresh, expected)
+	}
+	for i := range expected {
+		if parsedFlags.Refresh[i] != expected[i] {
+			t.Errorf("refresh wasn't parsed: %v instead of %v", parsedFlags.Refresh[i], expected[i])
+		}
+	}
+}
+
+func TestParseRejectsInvalidRefresh(t *testing.T) {
+	for _, value := range []string{"snapd", "/tmp/snapd.snapx", "/tmp/snapd.snap:", "/tmp/my.snapshots/core"} {
+		resetFlag()
+		flag.CommandLine.SetOutput(ioutil.Discard)
+
+		flags.Register(flag.CommandLine)
+		if err := flag.CommandLine.Parse([]string{"-refresh", value}); err == nil {
+			t.Errorf("expected error for invalid refresh %q", value)
+		}
+	}
+}
+
+func TestParseSetsSpreadSource(t *testing.T) {
+	for _, tc := range []struct {
+		args     []string
+		expected types.Spread
+	}{
+		{[]string{""}, types.Spread{URL: "https://niemeyer.s3.amazonaws.com/spread-amd64.tar.gz"}},
+		{[]string{"", "-spread-arch", "arm64", "-spread-sha256", "myhash"}, types.Spread{URL: "https://niemeyer.s3.amazonaws.com/spread-arm64.tar.gz", Hash: "myhash"}},
+		{[]string{"", "-spread", "https://example.com/spread.tar.gz"}, types.Spread{URL: "https://example.com/spread.tar.gz"}},
+		{[]string{"", "-spread", "./spread.tar.gz"}, types.Spread{Path: "./spread.tar.gz"}},
+		{[]string{"", "-spread-version", "v1.2.0", "-spread-arch", "arm64", "-spread-sha256", "myhash"}, types.Spread{URL: "https://github.com/snapcore/spread/releases/download/v1.2.0/spread-arm64.tar.gz", Hash: "myhash", Version: "v1.2.0"}},
+		{[]string{"", "-spread", "./spread.tar.gz", "-spread-version", "v1.2.0"}, types.Spread{Path: "./spread.tar.gz", Version: "v1.2.0"}},
+	} {
+		resetFlag()
+
+		os.Args = tc.args
+		parsedFlags := flags.Parse()
+
+		if parsedFlags.Spread != tc.expected {
+			t.Errorf("spread wasn't parsed from %v: %v instead of %v", tc.args, parsedFlags.Spread, tc.expected)
+		}
+	}
+}
+
 // from flag.ResetForTesting
 func resetFlag() {
 	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
@@ -0,0 +1,182 @@
+package flags
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/fgimenez/validator/pkg/channels"
+	"github.com/fgimenez/validator/pkg/profiles"
+	"github.com/fgimenez/validator/pkg/testflinger"
+	"github.com/fgimenez/validator/pkg/types"
+)
+
+// Valid values for the from option
+var FromValues = []string{"target", "stable", "image"}
+
+var (
+	// spread systems are given as backend:system, optionally followed by
+	// the path of the tasks to select, ie external:ubuntu-core-16-64:tests/main/
+	systemRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]+:[a-zA-Z0-9_.-]+(:\S+)?$`)
+	queueRegexp  = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+	sha256Regexp = regexp.MustCompile(`^[a-f0-9]{64}$`)
+	snapRegexp   = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+	commitRegexp = regexp.MustCompile(`^[a-f0-9]{7,40}$`)
+	refRegexp    = regexp.MustCompile(`^[a-zA-Z0-9_.][a-zA-Z0-9_./-]*$`)
+)
+
+// ValidationError gathers all the problems found in a set of options
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid options:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// Validate checks the given options and returns a ValidationError describing
+// every problem found, or nil if there are none
+func Validate(options *types.Options) error {
+	var problems []string
+	add := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	if options.Executors < 1 {
+		add("-executors must be at least 1, got %d", options.Executors)
+	}
+	if options.Timeout < 0 {
+		add("-timeout cannot be negative, got %v", options.Timeout)
+	}
+	if options.OutputDir != "" {
+		if info, err := os.Stat(options.OutputDir); err == nil && !info.IsDir() {
+			add("-output must be a directory, %s is a file", options.OutputDir)
+		}
+	}
+	if !contains(FromValues, options.From) {
+		add("-from must be one of %s, got %q", strings.Join(FromValues, ", "), options.From)
+	}
+	if options.From == "image" {
+		if u, err := url.Parse(options.Image); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("-image must be an http or https URL when -from is image, got %q", options.Image)
+		}
+		if !sha256Regexp.MatchString(options.ImageHash) {
+			add("-image-sha256 must be the hex encoded SHA-256 checksum of the image, got %q", options.ImageHash)
+		}
+		// the image is built for the series of a single system
+		if len(options.Systems) > 1 {
+			add("-image can only provision a single system, got %d systems in -system", len(options.Systems))
+		}
+	} else if options.Image != "" || options.ImageHash != "" {
+		add("-image and -image-sha256 can only be used when -from is image")
+	}
+	for _, refresh := range options.Refresh {
+		switch {
+		case refresh.File != "":
+			if _, err := os.Stat(refresh.File); err != nil {
+				add("-refresh cannot use %s: %v", refresh.File, err)
+			}
+			if _, err := testflinger.AssertedRevision(refresh.Assertion); err != nil {
+				add("-refresh cannot use %v", err)
+			}
+		case refresh.Revision != "":
+			if n, err := strconv.Atoi(refresh.Revision); err != nil || n < 1 {
+				add("-refresh revision of %s must be a positive number, got %q", refresh.Name, refresh.Revision)
+			}
+		default:
+			if err := channels.Validate(refresh.Channel); err != nil {
+				add("-refresh channel of %s %v", refresh.Name, err)
+			}
+		}
+		if !snapRegexp.MatchString(refresh.Name) {
+			add("-refresh must refer to a valid snap name, got %q", refresh.Name)
+		}
+	}
+	if err := channels.Validate(options.Channel); err != nil {
+		add("-channel %v", err)
+	}
+	if len(options.Systems) == 0 {
+		add("-system must list at least one spread system")
+	}
+	seen := map[string]bool{}
+	for _, system := range options.Systems {
+		if !systemRegexp.MatchString(system) {
+			add("-system must have the form backend:system, ie %s, got %q", DefaultSystem, system)
+		}
+		if seen[system] {
+			add("-system lists %q more than once", system)
+		}
+		seen[system] = true
+	}
+	if len(options.Queues) == 0 {
+		add("-queue must list at least one testflinger queue")
+	}
+	seen = map[string]bool{}
+	for _, queue := range options.Queues {
+		if !queueRegexp.MatchString(queue.Name) {
+			add("-queue must be a testflinger queue name, ie %s, got %q", DefaultQueue, queue.Name)
+		}
+		if queue.Weight < 1 {
+			add("-queue weight of %s must be at least 1, got %d", queue.Name, queue.Weight)
+		}
+		if seen[queue.Name] {
+			add("-queue lists %q more than once", queue.Name)
+		}
+		seen[queue.Name] = true
+	}
+	if strings.TrimSpace(options.Release) == "" || strings.ContainsAny(options.Release, " \t\n") {
+		add("-release must be a branch name without spaces, got %q", options.Release)
+	}
+	if strings.TrimSpace(options.Repo) == "" || strings.ContainsAny(options.Repo, " \t\n") {
+		add("-repo must be a git repository URL, got %q", options.Repo)
+	}
+	if options.Ref != "" && !refRegexp.MatchString(options.Ref) {
+		add("-ref must be a refspec like pull/1234/head, got %q", options.Ref)
+	}
+	if options.Commit != "" && !commitRegexp.MatchString(options.Commit) {
+		add("-commit must be a hex encoded commit SHA, got %q", options.Commit)
+	}
+	if spread := options.Spread; spread.Version != "" {
+		if strings.HasPrefix(spread.Version, "-") || strings.ContainsAny(spread.Version, "/ \t\n") {
+			add("-spread-version must be a release of spread, ie v1.0.0, got %q", spread.Version)
+		} else if !strings.HasPrefix(spread.URL, SpreadReleasesURL+"/"+spread.Version+"/") {
+			add("-spread-version cannot be used along with -spread")
+		}
+	}
+	if spread := options.Spread; spread.Path != "" {
+		if _, err := os.Stat(spread.Path); err != nil {
+			add("-spread cannot use %s: %v", spread.Path, err)
+		}
+	}
+	if spread := options.Spread; !sha256Regexp.MatchString(spread.Hash) {
+		source := spread.URL
+		if source == "" {
+			source = spread.Path
+		}
+		add("-spread-sha256 must be the hex encoded SHA-256 checksum of %s, got %q", source, spread.Hash)
+	}
+	if options.Profile != "" {
+		for _, name := range strings.Split(options.Profile, ",") {
+			if _, err := profiles.Get(name); err != nil {
+				add("-profile %v", err)
+			}
+		}
+	}
+
+	if len(problems) != 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func contains(list []string, item string) bool {
+	for _, i := range list {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
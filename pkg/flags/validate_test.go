@@ -0,0 +1,168 @@
+package flags_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fgimenez/validator/pkg/flags"
+	"github.com/fgimenez/validator/pkg/types"
+)
+
+const testHash = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+func validOptions() *types.Options {
+	return &types.Options{
+		Systems:   []string{flags.DefaultSystem},
+		Executors: flags.DefaultExecutors,
+		Channel:   flags.DefaultChannel,
+		From:      flags.DefaultFrom,
+		Release:   flags.DefaultRelease,
+		Repo:      flags.DefaultRepo,
+		Queues:    []types.Queue{{Name: flags.DefaultQueue, Weight: 1}},
+		Spread:    types.Spread{URL: "https://example.com/spread-amd64.tar.gz", Hash: testHash},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snap, assertion := filepath.Join(dir, "snapd_1.snap"), filepath.Join(dir, "snapd_1.assert")
+	ioutil.WriteFile(snap, nil, 0644)
+	ioutil.WriteFile(assertion, []byte("type: snap-revision\nsnap-revision: 1\n"), 0644)
+
+	t.Run("spread release is valid", func(t *testing.T) {
+		options := validOptions()
+		options.Spread = types.Spread{URL: flags.SpreadRelease("v1.2.0", "amd64"), Hash: testHash, Version: "v1.2.0"}
+		if err := flags.Validate(options); err != nil {
+			t.Errorf("expected nil error, got %v", err)
+		}
+	})
+	t.Run("local spread is valid", func(t *testing.T) {
+		options := validOptions()
+		options.Spread = types.Spread{Path: snap, Hash: testHash}
+		if err := flags.Validate(options); err != nil {
+			t.Errorf("expected nil error, got %v", err)
+		}
+	})
+	t.Run("refreshes are valid", func(t *testing.T) {
+		options := validOptions()
+		options.Refresh = []types.Refresh{
+			{Name: "snapd", Channel: "latest/edge"},
+			{Name: "core18", Revision: "1234"},
+			{Name: "snapd", File: snap, Assertion: assertion},
+		}
+		if err := flags.Validate(options); err != nil {
+			t.Errorf("expected nil error, got %v", err)
+		}
+	})
+	t.Run("defaults are valid", func(t *testing.T) {
+		if err := flags.Validate(validOptions()); err != nil {
+			t.Errorf("expected nil error, got %v", err)
+		}
+	})
+	t.Run("from image is valid", func(t *testing.T) {
+		options := validOptions()
+		options.From = "image"
+		options.Image = "https://storage.googleapis.com/snapd-spread-tests/images/pi3-16-edge/pi3.img.xz"
+		options.ImageHash = testHash
+		if err := flags.Validate(options); err != nil {
+			t.Errorf("expected nil error, got %v", err)
+		}
+	})
+	t.Run("system with tasks path is valid", func(t *testing.T) {
+		options := validOptions()
+		options.Systems = []string{"external:ubuntu-core-16-64:tests/main/", flags.DefaultSystem}
+		if err := flags.Validate(options); err != nil {
+			t.Errorf("expected nil error, got %v", err)
+		}
+	})
+
+	for _, tc := range []struct {
+		name    string
+		modify  func(*types.Options)
+		problem string
+	}{
+		{"zero executors", func(o *types.Options) { o.Executors = 0 }, "-executors must be at least 1"},
+		{"negative executors", func(o *types.Options) { o.Executors = -2 }, "-executors must be at least 1"},
+		{"negative timeout", func(o *types.Options) { o.Timeout = -time.Minute }, "-timeout cannot be negative"},
+		{"unknown from", func(o *types.Options) { o.From = "myfrom" }, "-from must be one of target, stable, image"},
+		{"image without from image", func(o *types.Options) { o.Image = "https://example.com/pi3.img.xz" }, "-image and -image-sha256 can only be used"},
+		{"from image without url", func(o *types.Options) { o.From, o.ImageHash = "image", testHash }, "-image must be an http or https URL"},
+		{"from image with local path", func(o *types.Options) { o.From, o.Image, o.ImageHash = "image", "/tmp/pi3.img.xz", testHash }, "-image must be an http or https URL"},
+		{"from image with several systems", func(o *types.Options) {
+			o.From, o.Image, o.ImageHash = "image", "https://example.com/pi3.img.xz", testHash
+			o.Systems = []string{"external:ubuntu-core-16-arm-32", "external:ubuntu-core-18-arm-32"}
+		}, "-image can only provision a single system, got 2 systems"},
+		{"from image without checksum", func(o *types.Options) { o.From, o.Image = "image", "https://example.com/pi3.img.xz" }, "-image-sha256 must be the hex encoded"},
+		{"refresh to unknown channel", func(o *types.Options) { o.Refresh = []types.Refresh{{Name: "snapd", Channel: "edgy"}} }, "-refresh channel of snapd must refer to"},
+		{"refresh to invalid revision", func(o *types.Options) { o.Refresh = []types.Refresh{{Name: "snapd", Revision: "x1"}} }, "-refresh revision of snapd must be a positive number"},
+		{"refresh with invalid name", func(o *types.Options) { o.Refresh = []types.Refresh{{Name: "Snapd", Channel: "edge"}} }, "-refresh must refer to a valid snap name"},
+		{"refresh from missing file", func(o *types.Options) {
+			o.Refresh = []types.Refresh{{Name: "snapd", File: "/nonexistent/snapd.snap", Assertion: assertion}}
+		}, "-refresh cannot use /nonexistent/snapd.snap"},
+		{"sideload without snap-revision", func(o *types.Options) {
+			o.Refresh = []types.Refresh{{Name: "snapd", File: snap, Assertion: snap}}
+		}, "-refresh cannot use " + snap + " has no snap-revision assertion"},
+		{"output is a file", func(o *types.Options) { o.OutputDir = snap }, "-output must be a directory"},
+		{"empty repo", func(o *types.Options) { o.Repo = "" }, "-repo must be a git repository URL"},
+		{"invalid ref", func(o *types.Options) { o.Ref = "-pull/1/head" }, "-ref must be a refspec"},
+		{"invalid commit", func(o *types.Options) { o.Commit = "HEAD" }, "-commit must be a hex encoded commit SHA"},
+		{"spread without checksum", func(o *types.Options) { o.Spread.Hash = "" }, "-spread-sha256 must be the hex encoded SHA-256 checksum of https://example.com/spread-amd64.tar.gz"},
+		{"spread release without checksum", func(o *types.Options) {
+			o.Spread = types.Spread{URL: flags.SpreadRelease("v1.2.0", "amd64"), Version: "v1.2.0"}
+		}, "-spread-sha256 must be the hex encoded SHA-256 checksum of " + flags.SpreadRelease("v1.2.0", "amd64")},
+		{"invalid spread version", func(o *types.Options) { o.Spread.Version = "../v1" }, "-spread-version must be a release of spread"},
+		{"spread version along with tarball", func(o *types.Options) { o.Spread.Version = "v1.2.0" }, "-spread-version cannot be used along with -spread"},
+		{"missing spread file", func(o *types.Options) { o.Spread = types.Spread{Path: "/nonexistent/spread.tar.gz", Hash: testHash} }, "-spread cannot use /nonexistent/spread.tar.gz"},
+		{"empty channel", func(o *types.Options) { o.Channel = "" }, "-channel"},
+		{"unknown channel", func(o *types.Options) { o.Channel = "mychannel" }, "-channel must refer to one of the risks"},
+		{"system without backend", func(o *types.Options) { o.Systems = []string{"ubuntu-core-16-64"} }, "-system must have the form backend:system"},
+		{"no systems", func(o *types.Options) { o.Systems = nil }, "-system must list at least one"},
+		{"repeated system", func(o *types.Options) { o.Systems = append(o.Systems, o.Systems[0]) }, "-system lists"},
+		{"empty queue", func(o *types.Options) { o.Queues[0].Name = "" }, "-queue must be a testflinger queue name"},
+		{"no queues", func(o *types.Options) { o.Queues = nil }, "-queue must list at least one"},
+		{"zero weight", func(o *types.Options) { o.Queues[0].Weight = 0 }, "-queue weight of dragonboard must be at least 1"},
+		{"repeated queue", func(o *types.Options) { o.Queues = append(o.Queues, o.Queues[0]) }, "-queue lists"},
+		{"empty release", func(o *types.Options) { o.Release = " " }, "-release must be a branch name"},
+		{"unknown profile", func(o *types.Options) { o.Profile = "pi9" }, "-profile unknown profile"},
+		{"unknown profile in list", func(o *types.Options) { o.Profile = "pi3-16,pi3-22" }, "-profile unknown profile \"pi3-22\""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			options := validOptions()
+			tc.modify(options)
+			err := flags.Validate(options)
+			verr, ok := err.(*flags.ValidationError)
+			if !ok {
+				t.Fatalf("expected validation error, got %v", err)
+			}
+			if len(verr.Problems) != 1 || !strings.HasPrefix(verr.Problems[0], tc.problem) {
+				t.Errorf("expected problem starting with %q, got %v", tc.problem, verr.Problems)
+			}
+		})
+	}
+
+	t.Run("problems are aggregated", func(t *testing.T) {
+		options := validOptions()
+		options.Executors = 0
+		options.From = "myfrom"
+		options.Queues = nil
+		err := flags.Validate(options)
+		verr, ok := err.(*flags.ValidationError)
+		if !ok {
+			t.Fatalf("expected validation error, got %v", err)
+		}
+		if len(verr.Problems) != 3 {
+			t.Errorf("expected 3 problems, got %v", verr.Problems)
+		}
+		if strings.Count(err.Error(), "\n  - ") != 3 {
+			t.Errorf("expected one line per problem, got %q", err.Error())
+		}
+	})
+}
@@ -0,0 +1,259 @@
+// Package imagedb stores the state of the images built by image-generator,
+// the image_db.json file, replacing it atomically and keeping a single
+// writer with a lock
+package imagedb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/fgimenez/validator/pkg/imagesets"
+	"github.com/fgimenez/validator/pkg/seed"
+)
+
+// DefaultPath is the location of the database next to the image sets
+const DefaultPath = "images/image_db.json"
+
+// Schema is the version of the format written by Save, files without schema
+// are the ones written by image-generator, version 0
+const Schema = 1
+
+// Kinds of entries, images are built and published while only the metadata
+// of the others is kept
+const (
+	KindImage    = "image"
+	KindMetadata = "metadata"
+)
+
+// DB is the content of the database
+type DB struct {
+	Schema   int      `json:"schema"`
+	Images   []*Entry `json:"images"`
+	Metadata []*Entry `json:"metadata"`
+}
+
+// Entry is the state of an image, BuiltAt is nil for the entries migrated
+// from files without schema
+type Entry struct {
+	Name     string               `json:"name"`
+	Version  int                  `json:"version"`
+	Channel  string               `json:"channel"`
+	Platform string               `json:"platform"`
+	Snaps    []*imagesets.Snap    `json:"snaps"`
+	Triggers []*imagesets.Trigger `json:"triggers"`
+	Manifest seed.Manifest        `json:"manifest"`
+	BuiltAt  *time.Time           `json:"built_at,omitempty"`
+}
+
+// Load reads the database at the given path migrating it to the current
+// schema, an empty database is returned when the file doesn't exist
+func Load(path string) (*DB, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &DB{Schema: Schema}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	db, err := decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return db, nil
+}
+
+func decode(data []byte) (*DB, error) {
+	var header struct {
+		Schema int `json:"schema"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, err
+	}
+	migrate, ok := migrations[header.Schema]
+	switch {
+	case header.Schema == Schema:
+		var db DB
+		if err := strictUnmarshal(data, &db); err != nil {
+			return nil, err
+		}
+		return &db, nil
+	case header.Schema > Schema:
+		return nil, fmt.Errorf("schema %d is newer than the supported %d", header.Schema, Schema)
+	case !ok:
+		return nil, fmt.Errorf("unknown schema %d", header.Schema)
+	}
+	migrated, err := migrate(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot migrate from schema %d: %v", header.Schema, err)
+	}
+	return decode(migrated)
+}
+
+func strictUnmarshal(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// migrations convert the content of a file from the schema they are keyed by
+// to the next one
+var migrations = map[int]func([]byte) ([]byte, error){
+	0: migrate0,
+}
+
+// legacyEntry is an entry written by image-generator before it wrote the
+// schema, its manifest holds the revisions as strings when they come from a
+// seed.manifest and as numbers when they were read back from a database
+type legacyEntry struct {
+	Version  int                       `json:"version"`
+	Channel  string                    `json:"channel"`
+	Platform string                    `json:"platform"`
+	Snaps    []*imagesets.Snap         `json:"snaps"`
+	Triggers []*imagesets.Trigger      `json:"triggers"`
+	Manifest map[string]legacyRevision `json:"manifest"`
+}
+
+// legacyRevision is a revision written either as a number or as a string
+type legacyRevision string
+
+func (r *legacyRevision) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*r = legacyRevision(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf("revision must be a number or a string, got %s", data)
+	}
+	*r = legacyRevision(n)
+	return nil
+}
+
+func migrate0(data []byte) ([]byte, error) {
+	var legacy struct {
+		Images   []*legacyEntry `json:"images"`
+		Metadata []*legacyEntry `json:"metadata"`
+	}
+	if err := strictUnmarshal(data, &legacy); err != nil {
+		return nil, err
+	}
+	db := &DB{Schema: 1}
+	for _, list := range []struct {
+		from []*legacyEntry
+		to   *[]*Entry
+	}{{legacy.Images, &db.Images}, {legacy.Metadata, &db.Metadata}} {
+		for _, l := range list.from {
+			e := &Entry{
+				Version:  l.Version,
+				Channel:  l.Channel,
+				Platform: l.Platform,
+				Snaps:    l.Snaps,
+				Triggers: l.Triggers,
+				Manifest: seed.Manifest{},
+			}
+			e.Name = imagesets.ImageName(&imagesets.ImageSet{Version: e.Version, Channel: e.Channel, Snaps: e.Snaps}, e.Platform)
+			for snap, revision := range l.Manifest {
+				n, err := strconv.Atoi(string(revision))
+				if err != nil {
+					return nil, fmt.Errorf("invalid revision %q of %s in %s", revision, snap, e.Name)
+				}
+				e.Manifest[snap] = n
+			}
+			*list.to = append(*list.to, e)
+		}
+	}
+	return json.Marshal(db)
+}
+
+// Save writes the database to the given path, replacing the previous file
+// only once the new one is complete
+func (db *DB) Save(path string) error {
+	db.Schema = Schema
+	data, err := json.MarshalIndent(db, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Find returns the entry of the image with the given name and its kind
+func (db *DB) Find(name string) (*Entry, string) {
+	for _, e := range db.Images {
+		if e.Name == name {
+			return e, KindImage
+		}
+	}
+	for _, e := range db.Metadata {
+		if e.Name == name {
+			return e, KindMetadata
+		}
+	}
+	return nil, ""
+}
+
+// Put adds the entry to the list of the given kind, replacing the one with the
+// same name
+func (db *DB) Put(kind string, e *Entry) error {
+	list := &db.Images
+	switch kind {
+	case KindImage:
+	case KindMetadata:
+		list = &db.Metadata
+	default:
+		return fmt.Errorf("unknown kind %q", kind)
+	}
+	for i, existing := range *list {
+		if existing.Name == e.Name {
+			(*list)[i] = e
+			return nil
+		}
+	}
+	*list = append(*list, e)
+	sort.SliceStable(*list, func(i, j int) bool { return (*list)[i].Name < (*list)[j].Name })
+	return nil
+}
+
+// Update runs f on the database at path holding its lock, waiting up to
+// timeout to take it, and saves it when f succeeds
+func Update(path string, timeout time.Duration, f func(db *DB) error) error {
+	lock, err := Lock(path, timeout)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	db, err := Load(path)
+	if err != nil {
+		return err
+	}
+	if err := f(db); err != nil {
+		return err
+	}
+	return db.Save(path)
+}
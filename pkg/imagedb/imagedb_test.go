@@ -0,0 +1,209 @@
+package imagedb_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fgimenez/validator/pkg/imagedb"
+	"github.com/fgimenez/validator/pkg/imagesets"
+	"github.com/fgimenez/validator/pkg/seed"
+)
+
+// legacy is a database written by image-generator
+const legacy = `{"images": [{"version": 18, "channel": "beta", "manifest": {"core18": "1705", "snapd": "7264"}, "snaps": [{"name": "pc-kernel", "channel": "18/edge"}], "triggers": [{"snap": {"name": "snapd", "channel": "beta"}}], "platform": "pi3"}], "metadata": [{"version": 16, "channel": "edge", "manifest": {}, "snaps": [], "triggers": [], "platform": "pc-amd64"}]}`
+
+// generated is a database written by image-generator since it writes the
+// schema
+const generated = `{"schema": 1, "images": [{"name": "pi3-18-beta-pc-kernel_18/edge", "version": 18, "channel": "beta", "manifest": {"core18": 1705, "snapd": 7264}, "snaps": [{"name": "pc-kernel", "channel": "18/edge"}], "triggers": [{"snap": {"name": "snapd", "channel": "beta"}}], "platform": "pi3", "built_at": "2020-06-01T10:00:00Z"}], "metadata": [{"name": "pc-amd64-16-edge", "version": 16, "channel": "edge", "manifest": {}, "snaps": [], "triggers": [], "platform": "pc-amd64"}]}`
+
+func tempPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "imagedb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "image_db.json")
+}
+
+func TestLoadMissing(t *testing.T) {
+	db, err := imagedb.Load(tempPath(t))
+	if err != nil || db.Schema != imagedb.Schema || len(db.Images) != 0 {
+		t.Errorf("expected an empty database, got %+v, %v", db, err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	path := tempPath(t)
+	ioutil.WriteFile(path, []byte(legacy), 0644)
+	db, err := imagedb.Load(path)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if db.Schema != imagedb.Schema || len(db.Images) != 1 || len(db.Metadata) != 1 {
+		t.Fatalf("unexpected database %+v", db)
+	}
+	e, kind := db.Find("pi3-18-beta-pc-kernel_18/edge")
+	if e == nil || kind != imagedb.KindImage {
+		t.Fatalf("expected the image to be found, got %+v, %s", e, kind)
+	}
+	if !reflect.DeepEqual(e.Manifest, seed.Manifest{"core18": 1705, "snapd": 7264}) || e.BuiltAt != nil || e.Triggers[0].Snap.Name != "snapd" {
+		t.Errorf("unexpected migrated entry %+v", e)
+	}
+	if _, kind := db.Find("pc-amd64-16-edge"); kind != imagedb.KindMetadata {
+		t.Errorf("expected the metadata entry to be found, got %q", kind)
+	}
+
+	// revisions read back from a database are written as numbers
+	ioutil.WriteFile(path, []byte(strings.Replace(legacy, `"1705"`, `1705`, 1)), 0644)
+	db, err = imagedb.Load(path)
+	if err != nil {
+		t.Fatalf("expected numeric revisions to be migrated, got %v", err)
+	}
+	if e, _ := db.Find("pi3-18-beta-pc-kernel_18/edge"); e == nil || e.Manifest["core18"] != 1705 {
+		t.Errorf("unexpected migrated entry %+v", e)
+	}
+
+	ioutil.WriteFile(path, []byte(strings.Replace(legacy, `"1705"`, `"x1"`, 1)), 0644)
+	if _, err := imagedb.Load(path); err == nil || !strings.Contains(err.Error(), "cannot migrate from schema 0") {
+		t.Errorf("expected migration error, got %v", err)
+	}
+}
+
+func TestImageGenerator(t *testing.T) {
+	path := tempPath(t)
+	ioutil.WriteFile(path, []byte(generated), 0644)
+	db, err := imagedb.Load(path)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	e, kind := db.Find("pi3-18-beta-pc-kernel_18/edge")
+	if e == nil || kind != imagedb.KindImage {
+		t.Fatalf("expected the image to be found, got %+v, %s", e, kind)
+	}
+	builtAt := time.Date(2020, 6, 1, 10, 0, 0, 0, time.UTC)
+	if !reflect.DeepEqual(e.Manifest, seed.Manifest{"core18": 1705, "snapd": 7264}) || e.BuiltAt == nil || !e.BuiltAt.Equal(builtAt) {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if e, kind := db.Find("pc-amd64-16-edge"); kind != imagedb.KindMetadata || e.BuiltAt != nil {
+		t.Errorf("expected the metadata entry without build time, got %+v, %q", e, kind)
+	}
+
+	if err := db.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := imagedb.Load(path)
+	if err != nil || !reflect.DeepEqual(saved, db) {
+		t.Errorf("expected the database to round trip, got %+v, %v", saved, err)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	path := tempPath(t)
+	for content, expected := range map[string]string{
+		`{"schema": 2, "images": []}`:                  "schema 2 is newer than the supported 1",
+		`{"schema": -1}`:                               "unknown schema -1",
+		`{"schema": 1, "images": [{"platfrom": "x"}]}`: `unknown field "platfrom"`,
+		`{`: "unexpected end of JSON input",
+	} {
+		ioutil.WriteFile(path, []byte(content), 0644)
+		if _, err := imagedb.Load(path); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error containing %q for %s, got %v", expected, content, err)
+		}
+	}
+}
+
+func TestSave(t *testing.T) {
+	path := tempPath(t)
+	built := time.Date(2020, 5, 4, 10, 0, 0, 0, time.UTC)
+	db := &imagedb.DB{}
+	for _, name := range []string{"pi3-18-edge", "pc-amd64-18-edge"} {
+		db.Put(imagedb.KindImage, &imagedb.Entry{Name: name, Version: 18, Channel: "edge", Manifest: seed.Manifest{"snapd": 1}, BuiltAt: &built})
+	}
+	db.Put(imagedb.KindImage, &imagedb.Entry{Name: "pi3-18-edge", Manifest: seed.Manifest{"snapd": 2}, BuiltAt: &built})
+	db.Put(imagedb.KindMetadata, &imagedb.Entry{Name: "pi2-16-edge", Manifest: seed.Manifest{"core": 1}})
+	if err := db.Put("other", &imagedb.Entry{}); err == nil {
+		t.Errorf("expected error for an unknown kind")
+	}
+	if err := db.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := imagedb.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, db) {
+		t.Errorf("expected %+v, got %+v", db, loaded)
+	}
+	if len(loaded.Images) != 2 || loaded.Images[0].Name != "pc-amd64-18-edge" || loaded.Images[1].Manifest["snapd"] != 2 {
+		t.Errorf("expected the entries sorted and replaced, got %+v", loaded.Images)
+	}
+	if data, _ := ioutil.ReadFile(path); strings.Count(string(data), "built_at") != 2 {
+		t.Errorf("expected the build time to be omitted when unknown, got %s", data)
+	}
+	// no temporary files are left behind
+	files, _ := ioutil.ReadDir(filepath.Dir(path))
+	if len(files) != 1 {
+		t.Errorf("expected only the database in the directory, got %d files", len(files))
+	}
+}
+
+func TestLock(t *testing.T) {
+	path := tempPath(t)
+	lock, err := imagedb.Lock(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := imagedb.Lock(path, 0); err == nil {
+		t.Fatalf("expected the second lock to fail")
+	} else if _, ok := err.(*imagedb.LockedError); !ok {
+		t.Errorf("expected a locked error, got %v", err)
+	}
+	start := time.Now()
+	if _, err := imagedb.Lock(path, 50*time.Millisecond); err == nil {
+		t.Fatalf("expected the lock to fail once the timeout expires")
+	} else if _, ok := err.(*imagedb.LockedError); !ok || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("expected a locked error after waiting, got %v in %v", err, time.Since(start))
+	}
+	err = imagedb.Update(path, 0, func(db *imagedb.DB) error { return nil })
+	if _, ok := err.(*imagedb.LockedError); !ok {
+		t.Errorf("expected update to fail while locked, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		lock.Unlock()
+	}()
+	lock, err = imagedb.Lock(path, 10*time.Second)
+	if err != nil {
+		t.Fatalf("expected the lock to be taken once released, got %v", err)
+	}
+	lock.Unlock()
+}
+
+func TestUpdate(t *testing.T) {
+	path := tempPath(t)
+	entry := &imagedb.Entry{Name: "pi3-18-edge", Platform: "pi3", Snaps: []*imagesets.Snap{}}
+	err := imagedb.Update(path, 0, func(db *imagedb.DB) error { return db.Put(imagedb.KindMetadata, entry) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	failure := errors.New("failed")
+	err = imagedb.Update(path, 0, func(db *imagedb.DB) error {
+		db.Metadata = nil
+		return failure
+	})
+	if err != failure {
+		t.Errorf("expected the error of the update, got %v", err)
+	}
+	db, err := imagedb.Load(path)
+	if err != nil || len(db.Metadata) != 1 || db.Metadata[0].Platform != "pi3" {
+		t.Errorf("expected only the successful update to be saved, got %+v, %v", db, err)
+	}
+}
@@ -0,0 +1,65 @@
+package imagedb
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// LockedError is returned by Lock when another process holds the lock
+type LockedError struct {
+	Path string
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%s is locked by another process", e.Path)
+}
+
+// FileLock is an exclusive lock of a database, held until Unlock is called or
+// the process exits
+type FileLock struct {
+	f *os.File
+}
+
+// lockInterval is how often Lock tries again to take a lock held by another
+// process
+var lockInterval = time.Second
+
+// Lock takes the lock of the database at path, <path>.lock, waiting up to
+// timeout for other processes to release it, a LockedError is returned once
+// it expires and right away when it is zero. image-generator takes the same
+// lock for its whole run, so a build can't interleave with its updates and
+// has to wait for the run to finish
+func Lock(path string, timeout time.Duration) (*FileLock, error) {
+	lockPath := path + ".lock"
+	f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return &FileLock{f: f}, nil
+		}
+		left := time.Until(deadline)
+		if err != syscall.EWOULDBLOCK || left <= 0 {
+			f.Close()
+			if err == syscall.EWOULDBLOCK {
+				return nil, &LockedError{Path: path}
+			}
+			return nil, fmt.Errorf("cannot lock %s: %v", lockPath, err)
+		}
+		if left > lockInterval {
+			left = lockInterval
+		}
+		time.Sleep(left)
+	}
+}
+
+// Unlock releases the lock
+func (l *FileLock) Unlock() error {
+	defer l.f.Close()
+	return syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+}
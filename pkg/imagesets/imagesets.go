@@ -0,0 +1,314 @@
+// Package imagesets loads and validates images/image_sets.json, the
+// definition of the images built by image-generator
+package imagesets
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// DefaultPath is the location of the image sets in the repository
+const DefaultPath = "images/image_sets.json"
+
+// File is the content of an image sets file, image-generator builds the
+// images of both lists but only keeps the manifests of the metadata ones
+type File struct {
+	Metadata []*ImageSet `json:"metadata"`
+	Images   []*ImageSet `json:"images"`
+}
+
+// ImageSet is a group of images built for several platforms from the same
+// base version, channel and extra snaps
+type ImageSet struct {
+	Version   int        `json:"version"`
+	Channel   string     `json:"channel"`
+	Snaps     []*Snap    `json:"snaps"`
+	Platforms []string   `json:"platforms"`
+	Triggers  []*Trigger `json:"triggers"`
+}
+
+// Snap is a snap included in the images from the given channel
+type Snap struct {
+	Name    string `json:"name"`
+	Channel string `json:"channel"`
+}
+
+// Trigger rebuilds the images when a new revision of the snap is released to
+// its channel
+type Trigger struct {
+	Snap *Snap `json:"snap"`
+}
+
+// Problem is an issue found in the file, Path is the JSON path of the value
+// with the issue, ie images[1].snaps
+type Problem struct {
+	Line    int
+	Path    string
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Path == "" {
+		return fmt.Sprintf("%d: %s", p.Line, p.Message)
+	}
+	return fmt.Sprintf("%d: %s: %s", p.Line, p.Path, p.Message)
+}
+
+// Error reports all the problems found in a file
+type Error struct {
+	File     string
+	Problems []Problem
+}
+
+func (e *Error) Error() string {
+	lines := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		lines[i] = e.File + ":" + p.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Load reads and validates the image sets file at the given path
+func Load(path string) (*File, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file, problems := Parse(data)
+	if len(problems) != 0 {
+		return nil, &Error{File: path, Problems: problems}
+	}
+	return file, nil
+}
+
+// Parse decodes and validates the content of an image sets file, the file is
+// only returned when no problems are found
+func Parse(data []byte) (*File, []Problem) {
+	var raw interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, []Problem{syntaxProblem(data, err)}
+	}
+	d := &decoder{lines: lineIndex(data)}
+	file := d.file(raw)
+	if len(d.problems) == 0 {
+		d.validate(file)
+	}
+	if len(d.problems) != 0 {
+		sort.SliceStable(d.problems, func(i, j int) bool { return d.problems[i].Line < d.problems[j].Line })
+		return nil, d.problems
+	}
+	return file, nil
+}
+
+// syntaxProblem returns the problem for an error decoding JSON at the line
+// where it happened
+func syntaxProblem(data []byte, err error) Problem {
+	offset := int64(len(data))
+	if e, ok := err.(*json.SyntaxError); ok {
+		offset = e.Offset
+	}
+	return Problem{Line: bytes.Count(data[:offset], []byte("\n")) + 1, Message: err.Error()}
+}
+
+// lineIndex returns the line where each JSON path of the given valid document
+// starts, paths have the form images[1].snaps[0].name and the root is ""
+func lineIndex(data []byte) map[string]int {
+	lines := map[string]int{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var walk func(path string)
+	walk = func(path string) {
+		tok, err := dec.Token()
+		if err != nil {
+			return
+		}
+		// the offset is past the first token of the value, which has no line
+		// breaks in it
+		lines[path] = bytes.Count(data[:dec.InputOffset()], []byte("\n")) + 1
+		switch tok {
+		case json.Delim('{'):
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return
+				}
+				walk(join(path, key.(string)))
+			}
+			dec.Token()
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				walk(fmt.Sprintf("%s[%d]", path, i))
+			}
+			dec.Token()
+		}
+	}
+	walk("")
+	return lines
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// decoder builds the typed file from the generic JSON values, recording a
+// problem for each value of the wrong type
+type decoder struct {
+	lines    map[string]int
+	problems []Problem
+}
+
+func (d *decoder) add(path, format string, a ...interface{}) {
+	d.problems = append(d.problems, Problem{Line: d.lines[path], Path: path, Message: fmt.Sprintf(format, a...)})
+}
+
+// object returns the fields of the object at path, reporting missing and
+// unknown fields
+func (d *decoder) object(path string, v interface{}, required []string, optional ...string) map[string]interface{} {
+	fields, ok := v.(map[string]interface{})
+	if !ok {
+		d.add(path, "must be an object, got %s", kind(v))
+		return nil
+	}
+	known := map[string]bool{}
+	for _, key := range append(required, optional...) {
+		known[key] = true
+	}
+	var keys []string
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !known[key] {
+			d.add(join(path, key), "unknown field")
+		}
+	}
+	for _, key := range required {
+		if _, ok := fields[key]; !ok {
+			d.add(path, "missing field %q", key)
+		}
+	}
+	return fields
+}
+
+func (d *decoder) list(path string, v interface{}) []interface{} {
+	items, ok := v.([]interface{})
+	if !ok {
+		d.add(path, "must be a list, got %s", kind(v))
+	}
+	return items
+}
+
+func (d *decoder) str(path string, v interface{}) string {
+	s, ok := v.(string)
+	if !ok {
+		d.add(path, "must be a string, got %s", kind(v))
+	}
+	return s
+}
+
+func (d *decoder) integer(path string, v interface{}) int {
+	n, ok := v.(json.Number)
+	if !ok {
+		d.add(path, "must be a number, got %s", kind(v))
+		return 0
+	}
+	i, err := n.Int64()
+	if err != nil {
+		d.add(path, "must be an integer, got %s", n)
+	}
+	return int(i)
+}
+
+func (d *decoder) file(v interface{}) *File {
+	fields := d.object("", v, []string{"metadata", "images"})
+	file := &File{}
+	if metadata, ok := fields["metadata"]; ok {
+		for i, item := range d.list("metadata", metadata) {
+			file.Metadata = append(file.Metadata, d.imageSet(fmt.Sprintf("metadata[%d]", i), item))
+		}
+	}
+	if images, ok := fields["images"]; ok {
+		for i, item := range d.list("images", images) {
+			file.Images = append(file.Images, d.imageSet(fmt.Sprintf("images[%d]", i), item))
+		}
+	}
+	return file
+}
+
+func (d *decoder) imageSet(path string, v interface{}) *ImageSet {
+	fields := d.object(path, v, []string{"version", "channel", "snaps", "platforms", "triggers"})
+	set := &ImageSet{}
+	if fields == nil {
+		return set
+	}
+	if v, ok := fields["version"]; ok {
+		set.Version = d.integer(join(path, "version"), v)
+	}
+	if v, ok := fields["channel"]; ok {
+		set.Channel = d.str(join(path, "channel"), v)
+	}
+	if v, ok := fields["snaps"]; ok {
+		for i, item := range d.list(join(path, "snaps"), v) {
+			set.Snaps = append(set.Snaps, d.snap(fmt.Sprintf("%s.snaps[%d]", path, i), item))
+		}
+	}
+	if v, ok := fields["platforms"]; ok {
+		for i, item := range d.list(join(path, "platforms"), v) {
+			set.Platforms = append(set.Platforms, d.str(fmt.Sprintf("%s.platforms[%d]", path, i), item))
+		}
+	}
+	if v, ok := fields["triggers"]; ok {
+		for i, item := range d.list(join(path, "triggers"), v) {
+			itemPath := fmt.Sprintf("%s.triggers[%d]", path, i)
+			trigger := &Trigger{Snap: &Snap{}}
+			if fields := d.object(itemPath, item, []string{"snap"}); fields != nil {
+				if snap, ok := fields["snap"]; ok {
+					trigger.Snap = d.snap(join(itemPath, "snap"), snap)
+				}
+			}
+			set.Triggers = append(set.Triggers, trigger)
+		}
+	}
+	return set
+}
+
+func (d *decoder) snap(path string, v interface{}) *Snap {
+	fields := d.object(path, v, []string{"name", "channel"})
+	snap := &Snap{}
+	if v, ok := fields["name"]; ok {
+		snap.Name = d.str(join(path, "name"), v)
+	}
+	if v, ok := fields["channel"]; ok {
+		snap.Channel = d.str(join(path, "channel"), v)
+	}
+	return snap
+}
+
+// kind describes the type of a decoded JSON value
+func kind(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		if v == "" {
+			return "an empty string"
+		}
+		return "a string"
+	case json.Number:
+		return "a number"
+	case bool:
+		return "a boolean"
+	case []interface{}:
+		return "a list"
+	}
+	return "an object"
+}
@@ -0,0 +1,130 @@
+package imagesets_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/fgimenez/validator/pkg/imagesets"
+)
+
+const valid = `{
+   "metadata":[],
+   "images":[
+      {
+         "version":18,
+         "channel":"beta",
+         "snaps":[
+            {
+               "name":"pc-kernel",
+               "channel":"18/edge"
+            }
+         ],
+         "platforms":[
+            "pi3",
+            "pc-amd64"
+         ],
+         "triggers":[
+            {
+               "snap":{
+                  "name":"snapd",
+                  "channel":"beta"
+               }
+            }
+         ]
+      }
+   ]
+}
+`
+
+func TestParse(t *testing.T) {
+	file, problems := imagesets.Parse([]byte(valid))
+	if len(problems) != 0 {
+		t.Fatalf("expected no problems, got %v", problems)
+	}
+	if len(file.Images) != 1 || len(file.Metadata) != 0 {
+		t.Fatalf("expected 1 image set and no metadata, got %d and %d", len(file.Images), len(file.Metadata))
+	}
+	set := file.Images[0]
+	if set.Version != 18 || set.Channel != "beta" || len(set.Platforms) != 2 || set.Snaps[0].Channel != "18/edge" || set.Triggers[0].Snap.Name != "snapd" {
+		t.Errorf("unexpected image set %+v", set)
+	}
+	if name := imagesets.ImageName(set, "pi3"); name != "pi3-18-beta-pc-kernel_18/edge" {
+		t.Errorf("unexpected image name %s", name)
+	}
+}
+
+// metadataSet returns a metadata image set in a single line with the image of
+// pi3 of the valid content for the given version
+func metadataSet(version int) string {
+	return fmt.Sprintf(`{"version":%d,"channel":"beta","snaps":[{"name":"pc-kernel","channel":"18/edge"}],"platforms":["pi3"],"triggers":[{"snap":{"name":"snapd","channel":"beta"}}]}`, version)
+}
+
+func TestParseProblems(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		old, new string
+		expected string
+	}{
+		{"syntax error", `"metadata":[],`, `"metadata":[]`, "3: invalid character"},
+		{"missing metadata", `"metadata":[],`, ``, `1: missing field "metadata"`},
+		{"metadata as object", `"metadata":[],`, `"metadata":{},`, "2: metadata: must be a list, got an object"},
+		{"unsupported metadata version", `"metadata":[],`, `"metadata":[` + metadataSet(22) + `],`, "2: metadata[0].version: must be one of 16, 18, 20, got 22"},
+		{"image already in metadata", `"metadata":[],`, `"metadata":[` + metadataSet(18) + `],`, "14: images[0].platforms[0]: image pi3-18-beta-pc-kernel_18/edge is already defined in metadata[0]"},
+		{"snaps as empty string", `"snaps":[
+            {
+               "name":"pc-kernel",
+               "channel":"18/edge"
+            }
+         ],`, `"snaps":"",`, `7: images[0].snaps: must be a list, got an empty string`},
+		{"unknown field", `"version":18,`, `"version":18, "platform":"pi3",`, "5: images[0].platform: unknown field"},
+		{"missing field", `"version":18,`, ``, `4: images[0]: missing field "version"`},
+		{"version as string", `"version":18`, `"version":"18"`, "5: images[0].version: must be a number, got a string"},
+		{"unsupported version", `"version":18`, `"version":22`, "5: images[0].version: must be one of 16, 18, 20, got 22"},
+		{"unsupported channel", `"channel":"beta"`, `"channel":"18/beta"`, `6: images[0].channel: must be one of edge, beta, candidate, stable, got "18/beta"`},
+		{"unknown platform", `"pi3",`, `"pi5",`, `14: images[0].platforms[0]: must be one of`},
+		{"repeated platform", `"pc-amd64"`, `"pi3"`, "15: images[0].platforms[1]: image pi3-18-beta-pc-kernel_18/edge is already defined in images[0]"},
+		{"platform without the version", `"pi3",`, `"pi4",`, "14: images[0].platforms[0]: platform pi4 has no images of version 18"},
+		{"invalid snap channel", `"channel":"18/edge"`, `"channel":"18/edgy"`, `10: images[0].snaps[0].channel: must refer to one of the risks`},
+		{"trigger snap not in image", `"name":"snapd"`, `"name":"core"`, "19: images[0].triggers[0].snap: snap core is not in the images"},
+		{"trigger from another channel", `"channel":"beta"
+               }`, `"channel":"edge"
+               }`, "19: images[0].triggers[0].snap: snap snapd is in the images from beta, not from edge"},
+		{"no triggers", `"triggers":[
+            {
+               "snap":{
+                  "name":"snapd",
+                  "channel":"beta"
+               }
+            }
+         ]`, `"triggers":[]`, "17: images[0].triggers: must list at least one trigger"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			content := strings.Replace(valid, tc.old, tc.new, 1)
+			if content == valid {
+				t.Fatalf("%q not found in the valid content", tc.old)
+			}
+			_, problems := imagesets.Parse([]byte(content))
+			if len(problems) != 1 || !strings.HasPrefix(problems[0].String(), tc.expected) {
+				t.Errorf("expected problem starting with %q, got %v", tc.expected, problems)
+			}
+		})
+	}
+}
+
+func TestLoadRepositoryImageSets(t *testing.T) {
+	if _, err := imagesets.Load("../../" + imagesets.DefaultPath); err != nil {
+		t.Errorf("expected the image sets of the repository to be valid, got:\n%v", err)
+	}
+}
+
+func TestLoadError(t *testing.T) {
+	err := (&imagesets.Error{File: "image_sets.json", Problems: []imagesets.Problem{
+		{Line: 3, Path: "images[0].version", Message: "must be a number"},
+		{Line: 7, Message: "invalid character"},
+	}}).Error()
+	expected := "image_sets.json:3: images[0].version: must be a number\nimage_sets.json:7: invalid character"
+	if err != expected {
+		t.Errorf("expected %q, got %q", expected, err)
+	}
+}
@@ -0,0 +1,151 @@
+package imagesets
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/fgimenez/validator/pkg/channels"
+	"github.com/fgimenez/validator/pkg/platforms"
+)
+
+// Values supported by image-generator
+var (
+	Platforms = platforms.WithImages()
+	Channels  = []string{"edge", "beta", "candidate", "stable"}
+	Versions  = []int{16, 18, 20}
+)
+
+// BaseSnaps are the snaps every image of a version contains from the channel
+// of the image, besides the ones listed in the image set
+var BaseSnaps = map[int][]string{
+	16: {"core"},
+	18: {"core18", "snapd"},
+	20: {"core20", "snapd"},
+}
+
+var snapNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// validate checks the values of the decoded file, the names of the images
+// are unique among both lists as image-generator writes them to the same
+// directories
+func (d *decoder) validate(file *File) {
+	images := map[string]string{}
+	for i, set := range file.Metadata {
+		d.validateSet(fmt.Sprintf("metadata[%d]", i), set, images)
+	}
+	for i, set := range file.Images {
+		d.validateSet(fmt.Sprintf("images[%d]", i), set, images)
+	}
+}
+
+// validateSet checks the given image set, images holds the path of the sets
+// defining each image name seen so far
+func (d *decoder) validateSet(path string, set *ImageSet, images map[string]string) {
+	// the snaps of the images are only known with a valid base
+	base := true
+	if !containsInt(Versions, set.Version) {
+		d.add(join(path, "version"), "must be one of %s, got %d", joinInts(Versions), set.Version)
+		base = false
+	}
+	if !contains(Channels, set.Channel) {
+		d.add(join(path, "channel"), "must be one of %s, got %q", strings.Join(Channels, ", "), set.Channel)
+		base = false
+	}
+
+	// channel of each snap in the images, by name
+	snaps := map[string]string{}
+	for _, name := range BaseSnaps[set.Version] {
+		snaps[name] = set.Channel
+	}
+	listed := map[string]bool{}
+	for j, snap := range set.Snaps {
+		snapPath := fmt.Sprintf("%s.snaps[%d]", path, j)
+		d.validateSnap(snapPath, snap)
+		if listed[snap.Name] {
+			d.add(snapPath, "snap %s is listed more than once", snap.Name)
+		}
+		listed[snap.Name] = true
+		snaps[snap.Name] = snap.Channel
+	}
+
+	if len(set.Platforms) == 0 {
+		d.add(join(path, "platforms"), "must list at least one platform")
+	}
+	for j, platform := range set.Platforms {
+		platformPath := fmt.Sprintf("%s.platforms[%d]", path, j)
+		if !contains(Platforms, platform) {
+			d.add(platformPath, "must be one of %s, got %q", strings.Join(Platforms, ", "), platform)
+			continue
+		}
+		if base && !platforms.MustGet(platform).Supports(set.Version) {
+			d.add(platformPath, "platform %s has no images of version %d", platform, set.Version)
+		}
+		name := ImageName(set, platform)
+		if previous, ok := images[name]; ok {
+			d.add(platformPath, "image %s is already defined in %s", name, previous)
+		}
+		images[name] = path
+	}
+
+	if len(set.Triggers) == 0 {
+		d.add(join(path, "triggers"), "must list at least one trigger")
+	}
+	for j, trigger := range set.Triggers {
+		snapPath := fmt.Sprintf("%s.triggers[%d].snap", path, j)
+		d.validateSnap(snapPath, trigger.Snap)
+		channel, ok := snaps[trigger.Snap.Name]
+		switch {
+		case !base || trigger.Snap.Name == "":
+		case !ok:
+			d.add(snapPath, "snap %s is not in the images", trigger.Snap.Name)
+		case channel != trigger.Snap.Channel:
+			d.add(snapPath, "snap %s is in the images from %s, not from %s", trigger.Snap.Name, channel, trigger.Snap.Channel)
+		}
+	}
+}
+
+func (d *decoder) validateSnap(path string, snap *Snap) {
+	if !snapNameRegexp.MatchString(snap.Name) {
+		d.add(join(path, "name"), "must be a valid snap name, got %q", snap.Name)
+	}
+	if err := channels.Validate(snap.Channel); err != nil {
+		d.add(join(path, "channel"), "%v", err)
+	}
+}
+
+// ImageName returns the name image-generator gives to the image of the set
+// for the given platform
+func ImageName(set *ImageSet, platform string) string {
+	name := fmt.Sprintf("%s-%d-%s", platform, set.Version, set.Channel)
+	for _, snap := range set.Snaps {
+		name = fmt.Sprintf("%s-%s_%s", name, snap.Name, snap.Channel)
+	}
+	return name
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func joinInts(values []int) string {
+	items := make([]string, len(values))
+	for i, v := range values {
+		items[i] = fmt.Sprint(v)
+	}
+	return strings.Join(items, ", ")
+}
@@ -0,0 +1,34 @@
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/fgimenez/validator/pkg/types"
+)
+
+// DefaultPath is the file where run manifests are stored if not told otherwise
+const DefaultPath = "tpr-run.json"
+
+// Load reads a run manifest from the given path
+func Load(path string) (*types.Manifest, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m types.Manifest
+	if err := json.Unmarshal(content, &m); err != nil {
+		return nil, fmt.Errorf("cannot decode manifest %s: %v", path, err)
+	}
+	return &m, nil
+}
+
+// Save writes the given run manifest to path
+func Save(path string, m *types.Manifest) error {
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(content, '\n'), 0644)
+}
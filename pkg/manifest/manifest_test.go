@@ -0,0 +1,55 @@
+package manifest_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fgimenez/validator/pkg/manifest"
+	"github.com/fgimenez/validator/pkg/types"
+)
+
+func TestSaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "run.json")
+
+	m := &types.Manifest{
+		Options: &types.Options{Systems: []string{"mysystem"}, Queues: []types.Queue{{Name: "myqueue", Weight: 2}}},
+		Jobs: []*types.Job{
+			{ID: "job1", Bucket: 0, Cfg: "cfg1", Tasks: []string{"task1", "task2"}},
+			{ID: "job2", Bucket: 1, Cfg: "cfg2", Tasks: []string{"task3"}, State: "complete"},
+		},
+	}
+	if err := manifest.Save(path, m); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	loaded, err := manifest.Load(path)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if loaded.Options.Systems[0] != "mysystem" || loaded.Options.Queues[0].Weight != 2 {
+		t.Errorf("options not loaded: %+v", loaded.Options)
+	}
+	if len(loaded.Jobs) != 2 || loaded.Jobs[0].Tasks[1] != "task2" || loaded.Jobs[1].State != "complete" {
+		t.Errorf("jobs not loaded: %+v", loaded.Jobs)
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		if _, err := manifest.Load(filepath.Join(dir, "missing.json")); err == nil {
+			t.Error("expected error for missing manifest")
+		}
+	})
+	t.Run("invalid content", func(t *testing.T) {
+		invalid := filepath.Join(dir, "invalid.json")
+		ioutil.WriteFile(invalid, []byte("{"), 0644)
+		if _, err := manifest.Load(invalid); err == nil {
+			t.Error("expected error for invalid manifest")
+		}
+	})
+}
@@ -0,0 +1,270 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fgimenez/validator/pkg/platforms"
+	"github.com/fgimenez/validator/pkg/types"
+)
+
+// DefaultMatrix is the location of the matrix the models are generated from
+const DefaultMatrix = DefaultDir + "/matrix.json"
+
+// Matrix declares the models generated for each series and platform
+type Matrix struct {
+	AuthorityID string    `json:"authority-id"`
+	BrandID     string    `json:"brand-id"`
+	Series      []*Series `json:"series"`
+}
+
+// Series holds the models of a version of Ubuntu Core, Grade, Risk, Base and
+// Snapd are only used from 20
+type Series struct {
+	Version int `json:"version"`
+	// Timestamp of the models, the time they are generated when empty
+	Timestamp string `json:"timestamp,omitempty"`
+	Grade     string `json:"grade,omitempty"`
+	// Risk of the default channels of the snaps
+	Risk      string           `json:"risk,omitempty"`
+	Base      *SnapSpec        `json:"base,omitempty"`
+	Snapd     *SnapSpec        `json:"snapd,omitempty"`
+	Platforms []*PlatformModel `json:"platforms"`
+}
+
+// PlatformModel is the model of a series for a platform, the model name is
+// ubuntu-core-<version>-<platform> and the timestamp the one of the series
+// unless given. Revision is only written when given, for the models signed
+// again with the same name
+type PlatformModel struct {
+	Platform    string    `json:"platform"`
+	Model       string    `json:"model,omitempty"`
+	Revision    int       `json:"revision,omitempty"`
+	DisplayName string    `json:"display-name,omitempty"`
+	Timestamp   string    `json:"timestamp,omitempty"`
+	Gadget      *SnapSpec `json:"gadget"`
+	Kernel      *SnapSpec `json:"kernel"`
+}
+
+// SnapSpec is a snap of the model, the ID is only required from 20
+type SnapSpec struct {
+	Name  string `json:"name"`
+	ID    string `json:"id,omitempty"`
+	Track string `json:"track,omitempty"`
+}
+
+// header returns the value of a gadget or kernel header, name=track
+func (s *SnapSpec) header() string {
+	if s.Track == "" {
+		return s.Name
+	}
+	return s.Name + "=" + s.Track
+}
+
+// Generated is the unsigned body of a model assertion, Name is the file name
+// of the model without extension, <platform>-<version>
+type Generated struct {
+	Name string
+	Body []byte
+}
+
+// assertion holds the headers of a model in the order they are written
+type assertion struct {
+	Type         string           `json:"type"`
+	AuthorityID  string           `json:"authority-id"`
+	Revision     string           `json:"revision,omitempty"`
+	Series       string           `json:"series"`
+	BrandID      string           `json:"brand-id"`
+	Model        string           `json:"model"`
+	Architecture string           `json:"architecture"`
+	Base         string           `json:"base,omitempty"`
+	DisplayName  string           `json:"display-name,omitempty"`
+	Gadget       string           `json:"gadget,omitempty"`
+	Kernel       string           `json:"kernel,omitempty"`
+	Grade        string           `json:"grade,omitempty"`
+	Snaps        []*assertionSnap `json:"snaps,omitempty"`
+	Timestamp    string           `json:"timestamp"`
+}
+
+type assertionSnap struct {
+	DefaultChannel string `json:"default-channel"`
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	Type           string `json:"type"`
+}
+
+// LoadMatrix reads the matrix at the given path
+func LoadMatrix(path string) (*Matrix, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var m Matrix
+	if err := dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &m, nil
+}
+
+// Generate returns the bodies of the models in the matrix, sorted as in the
+// matrix, now is the timestamp of the series without one
+func (m *Matrix) Generate(now time.Time) ([]*Generated, error) {
+	if m.AuthorityID == "" || m.BrandID == "" {
+		return nil, fmt.Errorf("authority-id and brand-id are required")
+	}
+	var result []*Generated
+	names := map[string]bool{}
+	for _, series := range m.Series {
+		base, err := baseOf(series.Version)
+		if err != nil {
+			return nil, err
+		}
+		if series.Version >= 20 {
+			if err := series.validate(); err != nil {
+				return nil, fmt.Errorf("series %d: %v", series.Version, err)
+			}
+		}
+		timestamp := series.Timestamp
+		if timestamp == "" {
+			timestamp = now.UTC().Format(time.RFC3339)
+		}
+		for _, p := range series.Platforms {
+			a, err := m.assertion(series, p, base, timestamp)
+			if err != nil {
+				return nil, fmt.Errorf("series %d: %s: %v", series.Version, p.Platform, err)
+			}
+			name := fmt.Sprintf("%s-%d", p.Platform, series.Version)
+			if names[name] {
+				return nil, fmt.Errorf("series %d: %s is listed more than once", series.Version, p.Platform)
+			}
+			names[name] = true
+			body, err := json.MarshalIndent(a, "", "  ")
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, &Generated{Name: name, Body: append(body, '\n')})
+		}
+	}
+	return result, nil
+}
+
+// baseOf returns the base header of the models of the given version
+func baseOf(version int) (string, error) {
+	for base, v := range Bases {
+		if v == version {
+			return base, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported series %d", version)
+}
+
+func (s *Series) validate() error {
+	if !contains(Grades, s.Grade) {
+		return fmt.Errorf("grade must be one of %s, got %q", strings.Join(Grades, ", "), s.Grade)
+	}
+	if s.Risk == "" {
+		return fmt.Errorf("risk is required")
+	}
+	if s.Base == nil || s.Snapd == nil {
+		return fmt.Errorf("base and snapd are required")
+	}
+	return nil
+}
+
+func (m *Matrix) assertion(series *Series, p *PlatformModel, base, timestamp string) (*assertion, error) {
+	platform, err := platforms.Get(p.Platform)
+	if err != nil {
+		return nil, err
+	}
+	if p.Gadget == nil || p.Gadget.Name == "" || p.Kernel == nil || p.Kernel.Name == "" {
+		return nil, fmt.Errorf("gadget and kernel are required")
+	}
+	a := &assertion{
+		Type:         "model",
+		AuthorityID:  m.AuthorityID,
+		Series:       "16",
+		BrandID:      m.BrandID,
+		Model:        p.Model,
+		Architecture: platform.Architecture,
+		Base:         base,
+		DisplayName:  p.DisplayName,
+		Timestamp:    timestamp,
+	}
+	if p.Timestamp != "" {
+		a.Timestamp = p.Timestamp
+	}
+	if p.Revision < 0 {
+		return nil, fmt.Errorf("revision cannot be negative, got %d", p.Revision)
+	}
+	if p.Revision > 0 {
+		a.Revision = strconv.Itoa(p.Revision)
+	}
+	if a.Model == "" {
+		a.Model = fmt.Sprintf("ubuntu-core-%d-%s", series.Version, p.Platform)
+	}
+	if series.Version < 20 {
+		a.Gadget, a.Kernel = p.Gadget.header(), p.Kernel.header()
+		return a, nil
+	}
+
+	a.Grade = series.Grade
+	for _, snap := range []struct {
+		spec *SnapSpec
+		kind string
+	}{{p.Gadget, "gadget"}, {p.Kernel, "kernel"}, {series.Base, "base"}, {series.Snapd, "snapd"}} {
+		if snap.spec.ID == "" {
+			return nil, fmt.Errorf("%s %s has no id", snap.kind, snap.spec.Name)
+		}
+		track := snap.spec.Track
+		if track == "" {
+			track = "latest"
+		}
+		a.Snaps = append(a.Snaps, &assertionSnap{
+			DefaultChannel: track + "/" + series.Risk,
+			ID:             snap.spec.ID,
+			Name:           snap.spec.Name,
+			Type:           snap.kind,
+		})
+	}
+	return a, nil
+}
+
+// BodyPath returns the path of the unsigned body of the model in dir
+func BodyPath(dir, name string) string {
+	return filepath.Join(dir, name+"-model.json")
+}
+
+// Write saves the unsigned body of the model to dir, returning its path
+func (g *Generated) Write(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	path := BodyPath(dir, g.Name)
+	return path, ioutil.WriteFile(path, g.Body, 0644)
+}
+
+// Sign signs the body written to dir with snap sign using the given key and
+// saves the assertion next to it as <name>.model, returning its path
+func (g *Generated) Sign(cli types.Cli, key, dir string) (string, error) {
+	body := BodyPath(dir, g.Name)
+	// snap sign only reads the body from stdin, its warnings go to stderr
+	// and must not end up in the assertion
+	output, err := cli.OutputCommand("sh", "-c", `snap sign -k "$1" < "$2"`, "sh", key, body)
+	if err != nil {
+		return "", fmt.Errorf("cannot sign %s: %v", body, err)
+	}
+	if _, err := Parse([]byte(output)); err != nil {
+		return "", fmt.Errorf("cannot sign %s, unexpected output of snap sign: %v", body, err)
+	}
+	path := filepath.Join(dir, g.Name+".model")
+	return path, ioutil.WriteFile(path, []byte(output), 0644)
+}
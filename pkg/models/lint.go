@@ -0,0 +1,205 @@
+package models
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fgimenez/validator/pkg/channels"
+	"github.com/fgimenez/validator/pkg/platforms"
+)
+
+// Bases maps the base header of the models to the version of Ubuntu Core they
+// are for, models without base are for 16
+var Bases = map[string]int{
+	"":       16,
+	"core18": 18,
+	"core20": 20,
+}
+
+// Grades are the values accepted in the grade header
+var Grades = []string{"dangerous", "signed", "secured"}
+
+// SnapTypes are the types of snaps every model for 20 onwards must list
+var SnapTypes = []string{"gadget", "kernel", "base", "snapd"}
+
+// required are the headers every model assertion has
+var required = []string{"type", "authority-id", "series", "brand-id", "model", "architecture", "timestamp", "sign-key-sha3-384"}
+
+var fileRegexp = regexp.MustCompile(`^(.+)-(\d+)\.model$`)
+
+// Problem is an issue found in a model assertion
+type Problem struct {
+	Line    int
+	Message string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%d: %s", p.Line, p.Message)
+}
+
+// Error reports all the problems found in a model file
+type Error struct {
+	File     string
+	Problems []Problem
+}
+
+func (e *Error) Error() string {
+	lines := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		lines[i] = e.File + ":" + p.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Load reads and lints the model assertion at the given path
+func Load(path string) (*Model, error) {
+	m, err := ParseFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if problems := Lint(filepath.Base(path), m); len(problems) != 0 {
+		return nil, &Error{File: path, Problems: problems}
+	}
+	return m, nil
+}
+
+// Files returns the model assertions in the given directory
+func Files(dir string) ([]string, error) {
+	return filepath.Glob(filepath.Join(dir, "*.model"))
+}
+
+// Lint checks the model against the conventions of the repository, name is
+// the file name of the model, <platform>-<version>.model
+func Lint(name string, m *Model) []Problem {
+	l := &linter{m: m}
+	for _, header := range required {
+		if _, ok := m.Lines[header]; !ok {
+			l.add(1, "missing header %q", header)
+		}
+	}
+	if v, ok := m.Headers["type"]; ok && v != "model" {
+		l.add(m.Lines["type"], "type must be model, got %q", v)
+	}
+	if v, ok := m.Headers["series"]; ok && v != "16" {
+		l.add(m.Lines["series"], "series must be 16, got %q", v)
+	}
+
+	base := m.Headers["base"]
+	version, ok := Bases[base]
+	if !ok {
+		l.add(m.Lines["base"], "unsupported base %q", base)
+	}
+
+	match := fileRegexp.FindStringSubmatch(name)
+	if match == nil {
+		l.add(1, "file name %s must have the form <platform>-<version>.model", name)
+	} else {
+		l.lintName(match[1], match[2], version, ok)
+	}
+
+	if ok && version >= 20 {
+		l.lintSnaps(base)
+	} else if ok {
+		for _, header := range []string{"gadget", "kernel"} {
+			if _, ok := m.Lines[header]; !ok {
+				l.add(1, "missing header %q", header)
+			}
+		}
+		for _, header := range []string{"grade", "snaps"} {
+			if line, ok := m.Lines[header]; ok {
+				l.add(line, "header %q is only supported from 20", header)
+			}
+		}
+	}
+
+	if m.Signature == "" {
+		l.add(m.End, "the assertion is not signed")
+	}
+	sort.SliceStable(l.problems, func(i, j int) bool { return l.problems[i].Line < l.problems[j].Line })
+	return l.problems
+}
+
+type linter struct {
+	m        *Model
+	problems []Problem
+}
+
+func (l *linter) add(line int, format string, a ...interface{}) {
+	l.problems = append(l.problems, Problem{Line: line, Message: fmt.Sprintf(format, a...)})
+}
+
+// lintName checks the file name matches the platform and base of the model
+func (l *linter) lintName(platform, version string, base int, known bool) {
+	p, err := platforms.Get(platform)
+	if err != nil {
+		l.add(1, "file name platform: %v", err)
+	} else if arch, ok := l.m.Headers["architecture"]; ok && arch != p.Architecture {
+		l.add(l.m.Lines["architecture"], "architecture must be %s for %s, got %s", p.Architecture, platform, arch)
+	}
+	if n, _ := strconv.Atoi(version); p != nil && !p.Supports(n) {
+		l.add(1, "platform %s has no images of version %s", platform, version)
+	}
+	if known && version != fmt.Sprint(base) {
+		l.add(l.m.Lines["base"], "file name is for %s but the model is for %d", version, base)
+	}
+}
+
+// lintSnaps checks the headers of the models for 20 onwards
+func (l *linter) lintSnaps(base string) {
+	m := l.m
+	if v, ok := m.Headers["grade"]; !ok {
+		l.add(1, "missing header %q", "grade")
+	} else if !contains(Grades, v) {
+		l.add(m.Lines["grade"], "grade must be one of %s, got %q", strings.Join(Grades, ", "), v)
+	}
+	for _, header := range []string{"gadget", "kernel"} {
+		if line, ok := m.Lines[header]; ok {
+			l.add(line, "header %q is replaced by the snaps list from 20", header)
+		}
+	}
+	if _, ok := m.Lines["snaps"]; !ok {
+		l.add(1, "missing header %q", "snaps")
+		return
+	}
+
+	types := map[string]bool{}
+	names := map[string]bool{}
+	for _, snap := range m.Snaps {
+		for _, field := range []struct{ name, value string }{{"name", snap.Name}, {"id", snap.ID}, {"type", snap.Type}} {
+			if field.value == "" {
+				l.add(snap.Line, "snap is missing %q", field.name)
+			}
+		}
+		if snap.DefaultChannel != "" {
+			if err := channels.Validate(snap.DefaultChannel); err != nil {
+				l.add(snap.Line, "snap %s default-channel %v", snap.Name, err)
+			}
+		}
+		if names[snap.Name] && snap.Name != "" {
+			l.add(snap.Line, "snap %s is listed more than once", snap.Name)
+		}
+		names[snap.Name] = true
+		if snap.Type == "base" && snap.Name != base {
+			l.add(snap.Line, "base snap %s does not match the base header %s", snap.Name, base)
+		}
+		types[snap.Type] = true
+	}
+	for _, t := range SnapTypes {
+		if !types[t] {
+			l.add(m.Lines["snaps"], "snaps must include a snap of type %s", t)
+		}
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+// Package models parses the model assertions used to build the images, the
+// files under images/models
+package models
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// DefaultDir is where the model assertions are kept in the repository
+const DefaultDir = "images/models"
+
+// Model is a model assertion, only the headers and snaps are decoded
+type Model struct {
+	// Headers holds the value of the single line headers, Lines the line
+	// where each header, including snaps, is defined
+	Headers map[string]string
+	Lines   map[string]int
+	Snaps   []*Snap
+	// Signature is the body following the headers, which end at line End
+	Signature string
+	End       int
+}
+
+// Snap is an entry of the snaps header of the models for series 20 onwards
+type Snap struct {
+	Name           string
+	ID             string
+	Type           string
+	DefaultChannel string
+	// Line is where the entry starts
+	Line int
+}
+
+// Header returns the value of the given single line header
+func (m *Model) Header(name string) string {
+	return m.Headers[name]
+}
+
+// ParseError is returned for content which isn't a model assertion
+type ParseError struct {
+	Line int
+	Msg  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// ParseFile reads the model assertion in the given file
+func ParseFile(path string) (*Model, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%v", path, err)
+	}
+	return m, nil
+}
+
+// Parse decodes a model assertion, the headers end at the first empty line
+func Parse(data []byte) (*Model, error) {
+	m := &Model{Headers: map[string]string{}, Lines: map[string]int{}}
+	lines := strings.Split(string(data), "\n")
+	inSnaps := false
+	var snap *Snap
+	for i, line := range lines {
+		n := i + 1
+		if line == "" {
+			m.End = n
+			m.Signature = strings.TrimSpace(strings.Join(lines[i+1:], "\n"))
+			break
+		}
+
+		switch {
+		case inSnaps && strings.TrimSpace(line) == "-" && strings.HasPrefix(line, "  "):
+			snap = &Snap{Line: n}
+			m.Snaps = append(m.Snaps, snap)
+		case inSnaps && strings.HasPrefix(line, "    ") && snap != nil:
+			key, value, err := splitHeader(strings.TrimSpace(line), n)
+			if err != nil {
+				return nil, err
+			}
+			switch key {
+			case "name":
+				snap.Name = value
+			case "id":
+				snap.ID = value
+			case "type":
+				snap.Type = value
+			case "default-channel":
+				snap.DefaultChannel = value
+			default:
+				return nil, &ParseError{n, fmt.Sprintf("unknown snap header %q", key)}
+			}
+		case strings.HasPrefix(line, " "):
+			return nil, &ParseError{n, fmt.Sprintf("unexpected indentation in %q", line)}
+		default:
+			key, value, err := splitHeader(line, n)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := m.Lines[key]; ok {
+				return nil, &ParseError{n, fmt.Sprintf("repeated header %q", key)}
+			}
+			m.Lines[key] = n
+			inSnaps, snap = key == "snaps", nil
+			if inSnaps {
+				if value != "" {
+					return nil, &ParseError{n, "snaps must be a list"}
+				}
+				continue
+			}
+			m.Headers[key] = value
+		}
+	}
+	if m.End == 0 {
+		m.End = len(lines)
+	}
+	if len(m.Lines) == 0 {
+		return nil, &ParseError{1, "no headers found"}
+	}
+	return m, nil
+}
+
+// splitHeader returns the name and value of a "name: value" line
+func splitHeader(line string, n int) (string, string, error) {
+	i := strings.Index(line, ":")
+	if i <= 0 {
+		return "", "", &ParseError{n, fmt.Sprintf("expected header in %q", line)}
+	}
+	return line[:i], strings.TrimSpace(line[i+1:]), nil
+}
@@ -0,0 +1,310 @@
+package models_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fgimenez/validator/pkg/models"
+)
+
+const valid = `type: model
+authority-id: canonical
+series: 16
+brand-id: canonical
+model: ubuntu-core-20-pi
+architecture: armhf
+base: core20
+grade: dangerous
+snaps:
+  -
+    default-channel: 20/edge
+    id: YbGa9O3dAXl88YLI6Y1bGG74pwBxZyKg
+    name: pi
+    type: gadget
+  -
+    default-channel: 20/edge
+    id: jeIuP6tfFrvAdic8DMWqHmoaoukAPNbJ
+    name: pi-kernel
+    type: kernel
+  -
+    default-channel: latest/edge
+    id: DLqre5XGLbDqg9jPtiAhRRjDuPVa5X1q
+    name: core20
+    type: base
+  -
+    default-channel: latest/edge
+    id: PMrrV4ml8uWuEUDBT8dSGnKUYbevVhc4
+    name: snapd
+    type: snapd
+timestamp: 2020-04-29T11:18:00.0Z
+sign-key-sha3-384: 9tydnLa6MTJ-jaQTFUXEwHl1yRx7ZS4K5cyFDhYDcPzhS7uyEkDxdUjg9g08BtNn
+
+AcLBXAQAAQoABgUCXqmLygAKCRDgT5vottzAEjtpD
+`
+
+const valid18 = `type: model
+authority-id: canonical
+series: 16
+brand-id: canonical
+model: ubuntu-core-18-amd64
+architecture: amd64
+base: core18
+gadget: pc=18
+kernel: pc-kernel=18
+timestamp: 2018-08-13T09:00:00+00:00
+sign-key-sha3-384: 9tydnLa6MTJ-jaQTFUXEwHl1yRx7ZS4K5cyFDhYDcPzhS7uyEkDxdUjg9g08BtNn
+
+AcLBXAQAAQoABgUCW7faJAAKCRDgT5vottzAEo4TD
+`
+
+func TestParse(t *testing.T) {
+	m, err := models.Parse([]byte(valid))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if m.Header("model") != "ubuntu-core-20-pi" || m.Header("grade") != "dangerous" || m.Lines["snaps"] != 9 {
+		t.Errorf("unexpected headers %v at %v", m.Headers, m.Lines)
+	}
+	if len(m.Snaps) != 4 {
+		t.Fatalf("expected 4 snaps, got %d", len(m.Snaps))
+	}
+	snap := m.Snaps[1]
+	if snap.Name != "pi-kernel" || snap.Type != "kernel" || snap.ID != "jeIuP6tfFrvAdic8DMWqHmoaoukAPNbJ" || snap.DefaultChannel != "20/edge" || snap.Line != 15 {
+		t.Errorf("unexpected snap %+v", snap)
+	}
+	if m.Signature != "AcLBXAQAAQoABgUCXqmLygAKCRDgT5vottzAEjtpD" || m.End != 32 {
+		t.Errorf("unexpected signature %q ending headers at %d", m.Signature, m.End)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		old, new string
+		expected string
+	}{
+		{"not a header", "series: 16", "series 16", `line 3: expected header in "series 16"`},
+		{"repeated header", "series: 16", "series: 16\nseries: 16", `line 4: repeated header "series"`},
+		{"unknown snap header", "    name: pi\n", "    title: pi\n", `line 13: unknown snap header "title"`},
+		{"snaps not a list", "snaps:\n", "snaps: pi\n", "line 9: snaps must be a list"},
+		{"indented header", "model:", "  model:", "line 5: unexpected indentation"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			content := strings.Replace(valid, tc.old, tc.new, 1)
+			if content == valid {
+				t.Fatalf("%q not found in the valid content", tc.old)
+			}
+			_, err := models.Parse([]byte(content))
+			if err == nil || !strings.HasPrefix(err.Error(), tc.expected) {
+				t.Errorf("expected error starting with %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestLint(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		file     string
+		content  string
+		old, new string
+		expected string
+	}{
+		{"valid 20", "pi3-20.model", valid, "", "", ""},
+		{"valid 18", "pc-amd64-18.model", valid18, "", "", ""},
+		{"missing header", "pi3-20.model", valid, "brand-id: canonical\n", "", `1: missing header "brand-id"`},
+		{"wrong type", "pi3-20.model", valid, "type: model", "type: serial", `1: type must be model, got "serial"`},
+		{"architecture of another platform", "pi4-20.model", valid, "", "", "6: architecture must be arm64 for pi4, got armhf"},
+		{"unknown platform", "pi5-20.model", valid, "", "", `1: file name platform: unknown platform "pi5"`},
+		{"bad file name", "pi3.model", valid, "", "", "1: file name pi3.model must have the form <platform>-<version>.model"},
+		{"file name of another version", "pi3-18.model", valid, "", "", "7: file name is for 18 but the model is for 20"},
+		{"version without images", "pc-i386-20.model", valid, "architecture: armhf", "architecture: i386", "1: platform pc-i386 has no images of version 20"},
+		{"unsupported base", "pi3-20.model", valid, "base: core20", "base: core22", `7: unsupported base "core22"`},
+		{"missing grade", "pi3-20.model", valid, "grade: dangerous\n", "", `1: missing header "grade"`},
+		{"unknown grade", "pi3-20.model", valid, "grade: dangerous", "grade: risky", `8: grade must be one of dangerous, signed, secured, got "risky"`},
+		{"gadget header in 20", "pi3-20.model", valid, "grade: dangerous", "grade: dangerous\ngadget: pi", `9: header "gadget" is replaced by the snaps list from 20`},
+		{"missing snap id", "pi3-20.model", valid, "    id: PMrrV4ml8uWuEUDBT8dSGnKUYbevVhc4\n", "", `25: snap is missing "id"`},
+		{"missing snapd", "pi3-20.model", valid, "    type: snapd\n", "    type: app\n", "9: snaps must include a snap of type snapd"},
+		{"invalid default channel", "pi3-20.model", valid, "20/edge", "20/edgy", "10: snap pi default-channel must refer to one of the risks"},
+		{"repeated snap", "pi3-20.model", valid, "name: snapd", "name: pi", "25: snap pi is listed more than once"},
+		{"base snap of another base", "pi3-20.model", valid, "name: core20", "name: core18", "20: base snap core18 does not match the base header core20"},
+		{"missing kernel before 20", "pc-amd64-18.model", valid18, "kernel: pc-kernel=18\n", "", `1: missing header "kernel"`},
+		{"grade before 20", "pc-amd64-18.model", valid18, "base: core18", "base: core18\ngrade: signed", `8: header "grade" is only supported from 20`},
+		{"not signed", "pc-amd64-18.model", valid18, "\nAcLBXAQAAQoABgUCW7faJAAKCRDgT5vottzAEo4TD\n", "", "12: the assertion is not signed"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			content := strings.Replace(tc.content, tc.old, tc.new, 1)
+			if tc.old != "" && content == tc.content {
+				t.Fatalf("%q not found in the valid content", tc.old)
+			}
+			m, err := models.Parse([]byte(content))
+			if err != nil {
+				t.Fatalf("expected no error parsing, got %v", err)
+			}
+			problems := models.Lint(tc.file, m)
+			if tc.expected == "" {
+				if len(problems) != 0 {
+					t.Errorf("expected no problems, got %v", problems)
+				}
+				return
+			}
+			if len(problems) != 1 || !strings.HasPrefix(problems[0].String(), tc.expected) {
+				t.Errorf("expected problem starting with %q, got %v", tc.expected, problems)
+			}
+		})
+	}
+}
+
+func TestLoadRepositoryModels(t *testing.T) {
+	files, err := models.Files("../../" + models.DefaultDir)
+	if err != nil || len(files) == 0 {
+		t.Fatalf("expected the models of the repository, got %v, %v", files, err)
+	}
+	for _, path := range files {
+		if _, err := models.Load(path); err != nil {
+			t.Errorf("expected the models of the repository to be valid, got:\n%v", err)
+		}
+	}
+}
+
+func TestGenerateRepositoryMatrix(t *testing.T) {
+	matrix, err := models.LoadMatrix("../../" + models.DefaultMatrix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated, err := matrix.Generate(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, _ := models.Files("../../" + models.DefaultDir)
+	if len(generated) != len(files) {
+		t.Errorf("expected a model for each of the %d files, got %d", len(files), len(generated))
+	}
+	for _, g := range generated {
+		m, err := models.ParseFile(filepath.Join("../..", models.DefaultDir, g.Name+".model"))
+		if err != nil {
+			t.Errorf("expected the generated %s to be in the repository, got %v", g.Name, err)
+			continue
+		}
+		var body map[string]interface{}
+		if err := json.Unmarshal(g.Body, &body); err != nil {
+			t.Fatal(err)
+		}
+		for key, value := range body {
+			if key == "snaps" {
+				continue
+			}
+			if m.Header(key) != value {
+				t.Errorf("%s: expected %s %q, got %q", g.Name, key, m.Header(key), value)
+			}
+		}
+		// the headers added by snap sign aren't generated
+		for key := range m.Headers {
+			if _, ok := body[key]; !ok && key != "sign-key-sha3-384" {
+				t.Errorf("%s: expected header %s to be generated", g.Name, key)
+			}
+		}
+		snaps, _ := body["snaps"].([]interface{})
+		if len(snaps) != len(m.Snaps) {
+			t.Errorf("%s: expected %d snaps, got %d", g.Name, len(m.Snaps), len(snaps))
+			continue
+		}
+		for i, snap := range m.Snaps {
+			expected := map[string]interface{}{"name": snap.Name, "id": snap.ID, "type": snap.Type, "default-channel": snap.DefaultChannel}
+			if !reflect.DeepEqual(snaps[i], expected) {
+				t.Errorf("%s: expected snap %v, got %v", g.Name, expected, snaps[i])
+			}
+		}
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		matrix   string
+		expected string
+	}{
+		{"no brand", `{"authority-id": "canonical"}`, "authority-id and brand-id are required"},
+		{"unknown series", `{"authority-id": "a", "brand-id": "b", "series": [{"version": 22}]}`, "unsupported series 22"},
+		{"unknown platform", `{"authority-id": "a", "brand-id": "b", "series": [{"version": 16, "platforms": [{"platform": "pi5", "gadget": {"name": "pi"}, "kernel": {"name": "pi-kernel"}}]}]}`, `series 16: pi5: unknown platform "pi5"`},
+		{"no kernel", `{"authority-id": "a", "brand-id": "b", "series": [{"version": 16, "platforms": [{"platform": "pi3", "gadget": {"name": "pi"}}]}]}`, "series 16: pi3: gadget and kernel are required"},
+		{"repeated platform", `{"authority-id": "a", "brand-id": "b", "series": [{"version": 16, "platforms": [{"platform": "pi3", "gadget": {"name": "pi"}, "kernel": {"name": "k"}}, {"platform": "pi3", "gadget": {"name": "pi"}, "kernel": {"name": "k"}}]}]}`, "series 16: pi3 is listed more than once"},
+		{"negative revision", `{"authority-id": "a", "brand-id": "b", "series": [{"version": 16, "platforms": [{"platform": "pi3", "revision": -1, "gadget": {"name": "pi"}, "kernel": {"name": "k"}}]}]}`, "series 16: pi3: revision cannot be negative, got -1"},
+		{"no grade", `{"authority-id": "a", "brand-id": "b", "series": [{"version": 20}]}`, `series 20: grade must be one of dangerous, signed, secured, got ""`},
+		{"no snap id", `{"authority-id": "a", "brand-id": "b", "series": [{"version": 20, "grade": "signed", "risk": "edge", "base": {"name": "core20", "id": "x"}, "snapd": {"name": "snapd", "id": "y"}, "platforms": [{"platform": "pi3", "gadget": {"name": "pi"}, "kernel": {"name": "pi-kernel", "id": "z"}}]}]}`, "series 20: pi3: gadget pi has no id"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var matrix models.Matrix
+			if err := json.Unmarshal([]byte(tc.matrix), &matrix); err != nil {
+				t.Fatal(err)
+			}
+			_, err := matrix.Generate(time.Now())
+			if err == nil || !strings.HasPrefix(err.Error(), tc.expected) {
+				t.Errorf("expected error starting with %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+type fakeCli struct {
+	calls   [][]string
+	output  string
+	warning string
+	err     error
+}
+
+func (c *fakeCli) ExecCommand(cmds ...string) (string, error) {
+	c.calls = append(c.calls, cmds)
+	return c.warning + c.output, c.err
+}
+
+func (c *fakeCli) OutputCommand(cmds ...string) (string, error) {
+	c.calls = append(c.calls, cmds)
+	return c.output, c.err
+}
+
+func (c *fakeCli) StreamCommand(w io.Writer, cmds ...string) error {
+	output, err := c.ExecCommand(cmds...)
+	io.WriteString(w, output)
+	return err
+}
+
+func TestWriteAndSign(t *testing.T) {
+	dir, err := ioutil.TempDir("", "models")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	g := &models.Generated{Name: "pc-amd64-18", Body: []byte(`{"type": "model"}`)}
+
+	path, err := g.Write(dir)
+	if err != nil || path != filepath.Join(dir, "pc-amd64-18-model.json") {
+		t.Fatalf("unexpected path %s, error %v", path, err)
+	}
+
+	cli := &fakeCli{output: valid18, warning: "WARNING: key is not registered\n"}
+	path, err = g.Sign(cli, "mykey", dir)
+	if err != nil {
+		t.Fatalf("expected no error signing, got %v", err)
+	}
+	expected := []string{"sh", "-c", `snap sign -k "$1" < "$2"`, "sh", "mykey", filepath.Join(dir, "pc-amd64-18-model.json")}
+	if len(cli.calls) != 1 || !reflect.DeepEqual(cli.calls[0], expected) {
+		t.Errorf("expected call %v, got %v", expected, cli.calls)
+	}
+	if data, _ := ioutil.ReadFile(path); path != filepath.Join(dir, "pc-amd64-18.model") || string(data) != valid18 {
+		t.Errorf("unexpected signed model in %s: %q", path, data)
+	}
+
+	cli = &fakeCli{err: errors.New("exit status 1: error: cannot find key")}
+	if _, err := g.Sign(cli, "mykey", dir); err == nil || !strings.HasSuffix(err.Error(), "exit status 1: error: cannot find key") {
+		t.Errorf("expected the output of snap sign in the error, got %v", err)
+	}
+}
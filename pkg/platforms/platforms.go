@@ -0,0 +1,162 @@
+// Package platforms is the registry of the boards the images are built for
+// and validated on, adding a board only requires an entry here
+package platforms
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ImageSize20 is the size of the images from series 20 on every platform
+const ImageSize20 = "8G"
+
+// Platform holds what the tools need to know about a board, image-generator
+// reads it as JSON through tpr images platforms
+type Platform struct {
+	Name         string `json:"name"`
+	Architecture string `json:"architecture"`
+	// Series are the versions of Ubuntu Core supported
+	Series []int `json:"series"`
+	// ImageSize is the size of the images before 20, the default of
+	// ubuntu-image when empty
+	ImageSize string `json:"image_size,omitempty"`
+	// Queue is the default testflinger queue of the boards, the same for
+	// every series as the boards are provisioned with the image of each job
+	Queue string `json:"queue"`
+	// Images is true when image-generator builds images for the platform
+	Images bool `json:"images"`
+}
+
+var builtin = map[string]*Platform{
+	"dragonboard": {
+		Name:         "dragonboard",
+		Architecture: "arm64",
+		Series:       []int{16, 18},
+		Queue:        "dragonboard",
+		Images:       true,
+	},
+	"pi2": {
+		Name:         "pi2",
+		Architecture: "armhf",
+		Series:       []int{16, 18},
+		Queue:        "pi2",
+		Images:       true,
+	},
+	"pi3": {
+		Name:         "pi3",
+		Architecture: "armhf",
+		Series:       []int{16, 18, 20},
+		Queue:        "pi3",
+		Images:       true,
+	},
+	"pi4": {
+		Name:         "pi4",
+		Architecture: "arm64",
+		Series:       []int{20},
+		Queue:        "pi4",
+		Images:       true,
+	},
+	"cm3": {
+		Name:         "cm3",
+		Architecture: "armhf",
+		Series:       []int{16, 18},
+		Queue:        "cm3",
+	},
+	"pc-amd64": {
+		Name:         "pc-amd64",
+		Architecture: "amd64",
+		Series:       []int{16, 18, 20},
+		ImageSize:    "3G",
+		Queue:        "pc-amd64",
+		Images:       true,
+	},
+	"pc-i386": {
+		Name:         "pc-i386",
+		Architecture: "i386",
+		Series:       []int{16, 18},
+		ImageSize:    "3G",
+		Queue:        "pc-i386",
+		Images:       true,
+	},
+}
+
+// Get returns the platform registered with the given name
+func Get(name string) (*Platform, error) {
+	p, ok := builtin[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown platform %q, available platforms: %v", name, Names())
+	}
+	return p.copy(), nil
+}
+
+// MustGet returns the platform registered with the given name, it panics
+// when there is none
+func MustGet(name string) *Platform {
+	p, err := Get(name)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// Names returns the sorted list of platform names
+func Names() []string {
+	var names []string
+	for name := range builtin {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WithImages returns the sorted names of the platforms image-generator builds
+// images for
+func WithImages() []string {
+	var names []string
+	for _, name := range Names() {
+		if builtin[name].Images {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (p *Platform) copy() *Platform {
+	c := *p
+	c.Series = append([]int(nil), p.Series...)
+	return &c
+}
+
+// Supports returns true if there are images of the given series for the
+// platform
+func (p *Platform) Supports(series int) bool {
+	for _, s := range p.Series {
+		if s == series {
+			return true
+		}
+	}
+	return false
+}
+
+// systemArch is the suffix of the spread systems of each architecture
+var systemArch = map[string]string{
+	"amd64": "64",
+	"i386":  "32",
+	"armhf": "arm-32",
+	"arm64": "arm-64",
+}
+
+// SystemFor returns the spread system the boards are tested as with the
+// images of the given series, ie external:ubuntu-core-20-arm-32
+func (p *Platform) SystemFor(series int) string {
+	return fmt.Sprintf("external:ubuntu-core-%d-%s", series, systemArch[p.Architecture])
+}
+
+// ImageSizeFor returns the size of the images of the series, empty for the
+// default of ubuntu-image
+func (p *Platform) ImageSizeFor(series int) string {
+	if series >= 20 {
+		return ImageSize20
+	}
+	return p.ImageSize
+}
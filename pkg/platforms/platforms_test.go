@@ -0,0 +1,90 @@
+package platforms_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/fgimenez/validator/pkg/platforms"
+)
+
+func TestGet(t *testing.T) {
+	p, err := platforms.Get("pi4")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if p.Architecture != "arm64" || p.Queue != "pi4" || !p.Images {
+		t.Errorf("unexpected platform %+v", p)
+	}
+
+	p.Series[0] = 16
+	if other := platforms.MustGet("pi4"); other.Supports(16) {
+		t.Errorf("builtin platform was modified: %v", other.Series)
+	}
+
+	if _, err := platforms.Get("pi5"); err == nil || !strings.Contains(err.Error(), "pc-amd64") {
+		t.Errorf("expected error listing the available platforms, got %v", err)
+	}
+}
+
+func TestArchitectures(t *testing.T) {
+	// every platform is tested as a spread system of its architecture
+	for _, name := range platforms.Names() {
+		p := platforms.MustGet(name)
+		if system := p.SystemFor(p.Series[0]); strings.HasSuffix(system, "-") {
+			t.Errorf("no spread system for the architecture %s of %s", p.Architecture, name)
+		}
+	}
+}
+
+func TestNames(t *testing.T) {
+	if names := strings.Join(platforms.Names(), ","); names != "cm3,dragonboard,pc-amd64,pc-i386,pi2,pi3,pi4" {
+		t.Errorf("unexpected names %s", names)
+	}
+	if names := strings.Join(platforms.WithImages(), ","); names != "dragonboard,pc-amd64,pc-i386,pi2,pi3,pi4" {
+		t.Errorf("unexpected platforms with images %s", names)
+	}
+}
+
+func TestSeries(t *testing.T) {
+	for _, tc := range []struct {
+		platform string
+		series   int
+		supports bool
+		size     string
+		system   string
+	}{
+		{"pc-amd64", 16, true, "3G", "external:ubuntu-core-16-64"},
+		{"pc-amd64", 20, true, "8G", "external:ubuntu-core-20-64"},
+		{"pc-i386", 20, false, "8G", "external:ubuntu-core-20-32"},
+		{"pi3", 18, true, "", "external:ubuntu-core-18-arm-32"},
+		{"pi3", 20, true, "8G", "external:ubuntu-core-20-arm-32"},
+		{"pi4", 18, false, "", "external:ubuntu-core-18-arm-64"},
+	} {
+		p := platforms.MustGet(tc.platform)
+		if p.Supports(tc.series) != tc.supports {
+			t.Errorf("expected %s to support %d: %v", tc.platform, tc.series, tc.supports)
+		}
+		if size := p.ImageSizeFor(tc.series); size != tc.size {
+			t.Errorf("expected image size %q for %s %d, got %q", tc.size, tc.platform, tc.series, size)
+		}
+		if system := p.SystemFor(tc.series); system != tc.system {
+			t.Errorf("expected system %s for %s %d, got %s", tc.system, tc.platform, tc.series, system)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	// image-generator reads the platforms in this format
+	data, err := json.Marshal(platforms.MustGet("pc-amd64"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"name":"pc-amd64","architecture":"amd64","series":[16,18,20],"image_size":"3G","queue":"pc-amd64","images":true}`
+	if string(data) != expected {
+		t.Errorf("expected %s, got %s", expected, data)
+	}
+	if data, _ := json.Marshal(platforms.MustGet("pi3")); strings.Contains(string(data), "image_size") {
+		t.Errorf("expected the default image size to be omitted, got %s", data)
+	}
+}
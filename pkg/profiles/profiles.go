@@ -0,0 +1,88 @@
+// Package profiles holds the settings that go together when validating on a
+// given board with the images of a series
+package profiles
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/fgimenez/validator/pkg/platforms"
+	"github.com/fgimenez/validator/pkg/seed"
+)
+
+// Profile holds the settings that go together when validating on a given board
+// with the images of a series
+type Profile struct {
+	// Name is <platform>-<series>
+	Name     string
+	Platform string
+	Series   int
+	Queue    string
+	System   string
+	// Images is where image-generator publishes the images of the profile,
+	// followed by -<channel> for the image of each channel, empty when it
+	// doesn't build images for the platform
+	Images string
+}
+
+// Get returns the profile with the given name, <platform>-<series> or just
+// the platform for the first series it supports
+func Get(name string) (*Profile, error) {
+	platform, series := name, 0
+	if i := strings.LastIndex(name, "-"); i > 0 {
+		if n, err := strconv.Atoi(name[i+1:]); err == nil {
+			platform, series = name[:i], n
+		}
+	}
+	p, err := platforms.Get(platform)
+	if err != nil || series != 0 && !p.Supports(series) {
+		return nil, fmt.Errorf("unknown profile %q, available profiles: %v", name, Names())
+	}
+	if series == 0 {
+		series = p.Series[0]
+	}
+	profile := &Profile{
+		Name:     fmt.Sprintf("%s-%d", p.Name, series),
+		Platform: p.Name,
+		Series:   series,
+		Queue:    p.Queue,
+		System:   p.SystemFor(series),
+	}
+	if p.Images {
+		profile.Images = seed.PublicURL + "/" + profile.Name
+	}
+	return profile, nil
+}
+
+// ImageURL returns the address of the image published for the profile on the
+// given channel, ie .../pi3-18-edge/pi3.img.xz, empty when there are no
+// images of the platform
+func (p *Profile) ImageURL(channel string) string {
+	if p.Images == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s-%s/%s.img.xz", p.Images, channel, p.Platform)
+}
+
+// MustGet returns the profile with the given name, it panics when there is
+// none
+func MustGet(name string) *Profile {
+	p, err := Get(name)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// Names returns the sorted list of available profile names, one per platform
+// and series
+func Names() []string {
+	var names []string
+	for _, name := range platforms.Names() {
+		for _, series := range platforms.MustGet(name).Series {
+			names = append(names, fmt.Sprintf("%s-%d", name, series))
+		}
+	}
+	return names
+}
@@ -0,0 +1,85 @@
+package profiles_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/fgimenez/validator/pkg/profiles"
+	"github.com/fgimenez/validator/pkg/seed"
+)
+
+func TestGet(t *testing.T) {
+	t.Run("known profile", func(t *testing.T) {
+		p, err := profiles.Get("pi3")
+		if err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+		if p.Name != "pi3-16" || p.Series != 16 || p.Queue != "pi3" {
+			t.Errorf("expected the profile of the first series of pi3, got %+v", p)
+		}
+		if p.System != "external:ubuntu-core-16-arm-32" {
+			t.Errorf("expected arm 32 system, got %s", p.System)
+		}
+	})
+	t.Run("profile of a series", func(t *testing.T) {
+		p, err := profiles.Get("pi3-20")
+		if err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+		if p.Name != "pi3-20" || p.Series != 20 || p.Queue != "pi3" || p.System != "external:ubuntu-core-20-arm-32" {
+			t.Errorf("expected the system of series 20, got %+v", p)
+		}
+		if p := profiles.MustGet("pc-amd64-18"); p.System != "external:ubuntu-core-18-64" {
+			t.Errorf("expected the system of series 18 for pc-amd64, got %s", p.System)
+		}
+	})
+	t.Run("published images", func(t *testing.T) {
+		p := profiles.MustGet("pi3-18")
+		if p.Platform != "pi3" || p.Images != seed.PublicURL+"/pi3-18" {
+			t.Errorf("expected the images of pi3-18, got %+v", p)
+		}
+		if url := p.ImageURL("beta"); url != seed.PublicURL+"/pi3-18-beta/pi3.img.xz" {
+			t.Errorf("unexpected image URL %s", url)
+		}
+		p = profiles.MustGet("cm3-16")
+		if p.Images != "" || p.ImageURL("beta") != "" {
+			t.Errorf("expected no images of cm3, got %+v", p)
+		}
+	})
+	t.Run("returned profile is a copy", func(t *testing.T) {
+		p, _ := profiles.Get("dragonboard")
+		p.Queue = "modified"
+		other, _ := profiles.Get("dragonboard")
+		if other.Queue != "dragonboard" {
+			t.Errorf("builtin profile was modified: %s", other.Queue)
+		}
+	})
+	t.Run("unknown profile", func(t *testing.T) {
+		_, err := profiles.Get("unknown")
+		if err == nil {
+			t.Fatal("expected error for unknown profile")
+		}
+		if !strings.Contains(err.Error(), "pc-amd64-16") {
+			t.Errorf("expected error to list available profiles, got %v", err)
+		}
+	})
+	t.Run("unsupported series", func(t *testing.T) {
+		for _, name := range []string{"pi4-18", "pc-i386-20", "pi3-"} {
+			if _, err := profiles.Get(name); err == nil {
+				t.Errorf("expected error for %s", name)
+			}
+		}
+	})
+}
+
+func TestNames(t *testing.T) {
+	expected := []string{
+		"cm3-16", "cm3-18", "dragonboard-16", "dragonboard-18",
+		"pc-amd64-16", "pc-amd64-18", "pc-amd64-20", "pc-i386-16", "pc-i386-18",
+		"pi2-16", "pi2-18", "pi3-16", "pi3-18", "pi3-20", "pi4-20",
+	}
+	names := profiles.Names()
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected names %v, got %v", expected, names)
+	}
+}
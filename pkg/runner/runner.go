@@ -1,10 +1,19 @@
 package runner
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/fgimenez/validator/pkg/scheduler"
+	"github.com/fgimenez/validator/pkg/testflinger"
 	"github.com/fgimenez/validator/pkg/types"
 )
 
@@ -14,26 +23,541 @@ type Runner struct {
 	Splitter    types.Splitter
 	Testflinger types.Testflinger
 	Cli         types.Cli
+	Server      Server
 }
 
-func New(deps *types.RunnerDependencies) *Runner {
+// Dependencies entails all the dependencies needed by a runner instance
+type Dependencies struct {
+	Cli         types.Cli
+	Testflinger types.Testflinger
+	Splitter    types.Splitter
+	Server      Server
+}
+
+// Server comprises the methods required to manage jobs in a testflinger server,
+// Submit gets both the job definition and the file it was written to so that
+// servers can use whichever they need
+type Server interface {
+	Submit(string, *testflinger.Job) (string, error)
+	Status(string) (string, error)
+	Results(string) (*types.Results, error)
+	Output(string) (string, error)
+	Cancel(string) error
+}
+
+func New(deps *Dependencies) *Runner {
 	return &Runner{
 		Splitter:    deps.Splitter,
 		Testflinger: deps.Testflinger,
 		Cli:         deps.Cli,
+		Server:      deps.Server,
+	}
+}
+
+// Plan lists the spread tasks of each system, splits them in buckets and
+// distributes the buckets among the queues of their system, the systems
+// without queues of their own share the common ones. Buckets are sorted by
+// system
+func (r *Runner) Plan(options *types.Options) ([]*types.Bucket, error) {
+	chunks := make([][][]string, len(options.Systems))
+	err := forEachSystem(options.Systems, func(i int, system string) error {
+		list, err := r.Cli.ExecCommand("spread", "-list", system)
+		if err != nil {
+			log.Printf("Error getting list for %s: %v", system, err)
+			return err
+		}
+		chunks[i] = r.Splitter.Split(options, strings.Split(strings.TrimSpace(list), "\n"))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var buckets, shared []*types.Bucket
+	for i, system := range options.Systems {
+		var systemBuckets []*types.Bucket
+		for j, tasks := range chunks[i] {
+			systemBuckets = append(systemBuckets, &types.Bucket{
+				System: system,
+				Index:  j,
+				Tasks:  tasks,
+			})
+		}
+		buckets = append(buckets, systemBuckets...)
+		if queues, ok := options.SystemQueues[system]; ok {
+			assign(queues, systemBuckets)
+		} else {
+			shared = append(shared, systemBuckets...)
+		}
 	}
+	assign(options.Queues, shared)
+	return buckets, nil
 }
 
-func (r *Runner) Run(options *types.Options) ([]string, error) {
-	list, err := r.Cli.ExecCommand("spread", "-list", options.System)
+func assign(queues []types.Queue, buckets []*types.Bucket) {
+	for i, queue := range scheduler.Assign(queues, len(buckets)) {
+		buckets[i].Queue = queue
+	}
+}
+
+// Run generates the testflinger job definitions and returns their paths
+// keyed by system
+func (r *Runner) Run(options *types.Options) (map[string][]string, error) {
+	buckets, err := r.Plan(options)
+	if err != nil {
+		return nil, err
+	}
+	options, err = r.resolve(options)
+	if err != nil {
+		return nil, err
+	}
+
+	generate, cleanup, err := prepareOutput(options, buckets)
+	if err != nil {
+		return nil, err
+	}
+
+	bySystem := groupBySystem(options.Systems, buckets)
+	output := make([][]string, len(options.Systems))
+	err = forEachSystem(options.Systems, func(i int, system string) error {
+		var err error
+		output[i], err = r.Testflinger.GenerateCfg(generate, bySystem[i])
+		return err
+	})
 	if err != nil {
-		log.Printf("Error getting list: %v", err)
+		// the systems which succeeded leave their definitions behind
+		for _, cfgs := range output {
+			for _, cfg := range cfgs {
+				os.Remove(cfg)
+			}
+		}
+		cleanup()
 		return nil, err
 	}
 
-	chunks := r.Splitter.Split(options, strings.Split(list, "\n"))
+	result := make(map[string][]string)
+	for i, system := range options.Systems {
+		result[system] = output[i]
+	}
+	return result, nil
+}
+
+// Submit generates the job definitions and sends them to testflinger, the
+// returned manifest contains the jobs submitted so far even on error
+func (r *Runner) Submit(options *types.Options) (*types.Manifest, error) {
+	manifest := &types.Manifest{
+		Created: time.Now().UTC(),
+		Options: options,
+	}
+
+	buckets, err := r.Plan(options)
+	if err != nil {
+		return manifest, err
+	}
+	options, err = r.resolve(options)
+	if err != nil {
+		return manifest, err
+	}
+	manifest.Options = options
+	manifest.Commit = options.Commit
+	logger.Printf("Testing %s at %s", options.Repo, options.Commit)
+
+	generate, cleanup, err := prepareOutput(options, buckets)
+	if err != nil {
+		return manifest, err
+	}
+
+	bySystem := groupBySystem(options.Systems, buckets)
+	jobs := make([][]*types.Job, len(options.Systems))
+	err = forEachSystem(options.Systems, func(i int, system string) error {
+		cfgs, err := r.Testflinger.GenerateCfg(generate, bySystem[i])
+		if err != nil {
+			return err
+		}
+		for j, cfg := range cfgs {
+			bucket := bySystem[i][j]
+			id, err := r.Server.Submit(cfg, testflinger.NewJob(options, bucket))
+			if err != nil {
+				return err
+			}
+			logger.Printf("Submitted bucket %d of %s to %s as job %s", bucket.Index, system, bucket.Queue, id)
+			jobs[i] = append(jobs[i], &types.Job{
+				ID:     id,
+				System: system,
+				Bucket: bucket.Index,
+				Queue:  bucket.Queue,
+				Cfg:    cfg,
+				Tasks:  bucket.Tasks,
+			})
+		}
+		return nil
+	})
+	for _, systemJobs := range jobs {
+		manifest.Jobs = append(manifest.Jobs, systemJobs...)
+	}
+	if len(manifest.Jobs) == 0 {
+		cleanup()
+	}
+	return manifest, err
+}
+
+// prepareOutput returns a copy of the options writing the job definitions of
+// all the systems to a single directory, a temporary one when no output
+// directory is given, and a function removing that temporary directory. The
+// definitions left in the output directory by previous runs are removed so
+// that it only holds the new ones, and systems whose definitions would have
+// the same file name are rejected
+func prepareOutput(options *types.Options, buckets []*types.Bucket) (*types.Options, func(), error) {
+	names := make(map[string]string)
+	for _, bucket := range buckets {
+		name := testflinger.CfgName(bucket)
+		if system, ok := names[name]; ok && system != bucket.System {
+			return nil, nil, fmt.Errorf("systems %s and %s cannot be tested together, both job definitions would be written to %s", system, bucket.System, name)
+		}
+		names[name] = bucket.System
+	}
+
+	generate := *options
+	if generate.OutputDir == "" {
+		dir, err := ioutil.TempDir("", "tpr-")
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot create output directory: %v", err)
+		}
+		generate.OutputDir = dir
+		return &generate, func() { os.RemoveAll(dir) }, nil
+	}
+
+	stale, err := filepath.Glob(filepath.Join(generate.OutputDir, "*.yaml"))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, path := range stale {
+		if err := os.Remove(path); err != nil {
+			return nil, nil, fmt.Errorf("cannot remove previous job definition: %v", err)
+		}
+	}
+	return &generate, func() {}, nil
+}
+
+// resolve returns a copy of the options with the commit to test pinned, when
+// not given it is looked up in the repository from the ref or release branch
+func (r *Runner) resolve(options *types.Options) (*types.Options, error) {
+	resolved := *options
+	if resolved.Commit != "" {
+		return &resolved, nil
+	}
+
+	ref := options.Ref
+	if ref == "" {
+		ref = options.Release
+	}
+	output, err := r.Cli.ExecCommand("git", "ls-remote", options.Repo, ref)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve %s in %s: %v: %s", ref, options.Repo, err, output)
+	}
+	commit, err := parseLsRemote(output, ref)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve %s in %s: %v", ref, options.Repo, err)
+	}
+	resolved.Commit = commit
+	return &resolved, nil
+}
+
+// parseLsRemote returns the commit the given ref points to in the output of
+// git ls-remote, branches take precedence over tags and tags are peeled
+func parseLsRemote(output, ref string) (string, error) {
+	commits := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			commits[fields[1]] = fields[0]
+		}
+	}
+	for _, candidate := range []string{
+		ref,
+		"refs/heads/" + ref,
+		"refs/tags/" + ref + "^{}",
+		"refs/tags/" + ref,
+		"refs/" + ref,
+	} {
+		if commit, ok := commits[candidate]; ok {
+			return commit, nil
+		}
+	}
+	return "", fmt.Errorf("ref not found")
+}
+
+// ErrStopped is returned by Watch when it is stopped before all the jobs
+// are finished
+var ErrStopped = errors.New("stopped before all jobs finished")
+
+// WatchOptions tells how Watch polls the jobs
+type WatchOptions struct {
+	// Interval is the time between polls
+	Interval time.Duration
+	// Stall is the time after which a running job without new output is
+	// considered stalled and cancelled, zero disables the detection
+	Stall time.Duration
+	// Reschedule is the number of times the bucket of a stalled job is
+	// submitted again
+	Reschedule int
+	// Output is called with the output of the jobs read to detect stalls,
+	// the server only returns new output so it is lost otherwise
+	Output func(job *types.Job, output string)
+	// Stop interrupts the polling when closed
+	Stop <-chan struct{}
+}
+
+// Watch polls the state of the manifest jobs until all of them are finished
+// or the watch is stopped, update is called each time a job changes its state.
+// Stalled jobs are cancelled and optionally submitted again, replacing the
+// job in the manifest
+func (r *Runner) Watch(manifest *types.Manifest, opts *WatchOptions, update func(*types.Job)) error {
+	progress := map[*types.Job]time.Time{}
+	for {
+		pending := 0
+		for _, job := range manifest.Jobs {
+			if testflinger.Finished(job.State) {
+				continue
+			}
+			state, err := r.Server.Status(job.ID)
+			if err != nil {
+				return err
+			}
+			if state != job.State {
+				// a new state is progress by itself
+				job.State = state
+				progress[job] = time.Now()
+				update(job)
+			} else if opts.Stall > 0 {
+				if err := r.checkStall(manifest, job, opts, progress, update); err != nil {
+					return err
+				}
+			}
+			if !testflinger.Finished(job.State) {
+				pending++
+			}
+		}
+		if pending == 0 {
+			return nil
+		}
+		select {
+		case <-opts.Stop:
+			return ErrStopped
+		case <-time.After(opts.Interval):
+		}
+	}
+}
+
+// checkStall polls the output of the given job to tell if it made progress,
+// jobs waiting for a device are never considered stalled
+func (r *Runner) checkStall(manifest *types.Manifest, job *types.Job, opts *WatchOptions, progress map[*types.Job]time.Time, update func(*types.Job)) error {
+	if _, ok := progress[job]; !ok || job.State == testflinger.StateWaiting {
+		progress[job] = time.Now()
+		return nil
+	}
+	output, err := r.Server.Output(job.ID)
+	if err != nil {
+		return err
+	}
+	if output != "" {
+		if opts.Output != nil {
+			opts.Output(job, output)
+		}
+		progress[job] = time.Now()
+		return nil
+	}
+	if time.Since(progress[job]) <= opts.Stall {
+		return nil
+	}
+
+	logger.Printf("Job %s made no progress in %v, cancelling it", job.ID, opts.Stall)
+	if err := r.Server.Cancel(job.ID); err != nil {
+		return err
+	}
+	job.State = testflinger.StateCancelled
+	job.TimedOut = true
+	update(job)
+	if job.Attempt >= opts.Reschedule {
+		return nil
+	}
+
+	bucket := &types.Bucket{System: job.System, Index: job.Bucket, Queue: job.Queue, Tasks: job.Tasks}
+	// the new definition replaces the previous one instead of going to a
+	// new temporary directory
+	generate := *manifest.Options
+	if generate.OutputDir == "" && job.Cfg != "" {
+		generate.OutputDir = filepath.Dir(job.Cfg)
+	}
+	cfgs, err := r.Testflinger.GenerateCfg(&generate, []*types.Bucket{bucket})
+	if err != nil {
+		return err
+	}
+	cfg := cfgs[0]
+	id, err := r.Server.Submit(cfg, testflinger.NewJob(manifest.Options, bucket))
+	if err != nil {
+		return err
+	}
+	logger.Printf("Rescheduled bucket %d of %s to %s as job %s", job.Bucket, job.System, job.Queue, id)
+	job.Previous = append(job.Previous, job.ID)
+	job.ID, job.Cfg, job.State, job.TimedOut = id, cfg, "", false
+	job.Attempt++
+	delete(progress, job)
+	update(job)
+	return nil
+}
+
+// Cancel stops the jobs of the manifest which are not finished yet, update is
+// called for each job whose state changes. Jobs are checked before cancelling
+// them as the recorded state may be outdated, errors don't prevent the rest
+// of the jobs from being cancelled and the first one is returned
+func (r *Runner) Cancel(manifest *types.Manifest, update func(*types.Job)) error {
+	var first error
+	for _, job := range manifest.Jobs {
+		if testflinger.Finished(job.State) {
+			continue
+		}
+		state, err := r.Server.Status(job.ID)
+		if err == nil && !testflinger.Finished(state) {
+			err = r.Server.Cancel(job.ID)
+			state = testflinger.StateCancelled
+		}
+		if err != nil {
+			logger.Printf("Cannot cancel job %s: %v", job.ID, err)
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		if state != job.State {
+			job.State = state
+			update(job)
+		}
+	}
+	return first
+}
+
+// Report retrieves the results of all the jobs in the manifest, in the same order
+func (r *Runner) Report(manifest *types.Manifest) ([]*types.Results, error) {
+	var results []*types.Results
+	for _, job := range manifest.Jobs {
+		result, err := r.Server.Results(job.ID)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// connectRe matches the lines of the job output telling how to access a
+// reserved device, ie "You can now connect to ubuntu@10.0.0.1"
+var connectRe = regexp.MustCompile(`\bconnect to\s+(\S+@\S+)`)
+
+// ReserveOptions tells how long to wait for a device to be reserved
+type ReserveOptions struct {
+	// Interval is the time between polls
+	Interval time.Duration
+	// Timeout is the time after which the job is cancelled if its device
+	// isn't reserved yet, zero waits until the job finishes
+	Timeout time.Duration
+	// Stop cancels the job and interrupts the polling when closed
+	Stop <-chan struct{}
+}
+
+// Reserve submits the given reservation job, written to cfg, and waits until
+// its device is reserved, update is called each time the job changes its
+// state. It returns the job id and the addresses to connect to found in the
+// job output. The job is cancelled when the timeout is reached or the wait is
+// stopped, so that the device isn't kept
+func (r *Runner) Reserve(cfg string, job *testflinger.Job, opts *ReserveOptions, update func(id, state string)) (string, []string, error) {
+	id, err := r.Server.Submit(cfg, job)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var timeout <-chan time.Time
+	if opts.Timeout > 0 {
+		timer := time.NewTimer(opts.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var state, output string
+	for {
+		current, err := r.Server.Status(id)
+		if err != nil {
+			return id, nil, err
+		}
+		if current != state {
+			state = current
+			update(id, state)
+		}
+		if testflinger.Finished(state) {
+			return id, nil, fmt.Errorf("job %s finished before reserving its device", id)
+		}
+		if state == testflinger.StateReserve {
+			chunk, err := r.Server.Output(id)
+			if err != nil {
+				return id, nil, err
+			}
+			output += chunk
+			var addresses []string
+			for _, match := range connectRe.FindAllStringSubmatch(output, -1) {
+				addresses = append(addresses, match[1])
+			}
+			if len(addresses) > 0 {
+				return id, addresses, nil
+			}
+		}
+		select {
+		case <-opts.Stop:
+			return id, nil, r.cancelReservation(id, fmt.Errorf("stopped waiting for job %s to reserve its device", id))
+		case <-timeout:
+			return id, nil, r.cancelReservation(id, fmt.Errorf("job %s didn't reserve its device in %v", id, opts.Timeout))
+		case <-time.After(opts.Interval):
+		}
+	}
+}
+
+// cancelReservation cancels the job of a reservation given up with err
+func (r *Runner) cancelReservation(id string, err error) error {
+	if cerr := r.Server.Cancel(id); cerr != nil {
+		return fmt.Errorf("%v, cannot cancel it: %v", err, cerr)
+	}
+	return err
+}
 
-	output := r.Testflinger.GenerateCfg(options, chunks)
+// forEachSystem calls f concurrently for each of the given systems and returns
+// the first error found in the systems order
+func forEachSystem(systems []string, f func(i int, system string) error) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(systems))
+	for i, system := range systems {
+		wg.Add(1)
+		go func(i int, system string) {
+			defer wg.Done()
+			errs[i] = f(i, system)
+		}(i, system)
+	}
+	wg.Wait()
 
-	return output, nil
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// groupBySystem returns the buckets of each of the systems, in the same order
+func groupBySystem(systems []string, buckets []*types.Bucket) [][]*types.Bucket {
+	result := make([][]*types.Bucket, len(systems))
+	for i, system := range systems {
+		for _, bucket := range buckets {
+			if bucket.System == system {
+				result[i] = append(result[i], bucket)
+			}
+		}
+	}
+	return result
 }
@@ -2,32 +2,69 @@ package runner_test
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/fgimenez/validator/pkg/runner"
+	"github.com/fgimenez/validator/pkg/testflinger"
 	"github.com/fgimenez/validator/pkg/types"
 )
 
+// the runner calls its dependencies concurrently for each system
+var mu sync.Mutex
+
 type fakeCli struct{}
 
 var cliReturn string
 var cliCalls int
+var cliArgs []string
 var cliError bool
+var lsRemoteReturn = "0123456789abcdef0123456789abcdef01234567\trefs/heads/master\n"
+var gitArgs []string
 
+// ExecCommand returns cliReturn for spread calls and lsRemoteReturn for git ones
 func (fc *fakeCli) ExecCommand(cmd ...string) (string, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if cmd[0] == "git" {
+		gitArgs = cmd
+		return lsRemoteReturn, nil
+	}
 	cliCalls++
+	cliArgs = append(cliArgs, strings.Join(cmd, " "))
 	if cliError {
 		return "", errors.New("cli error")
 	}
 	return cliReturn, nil
 }
 
+func (fc *fakeCli) OutputCommand(cmd ...string) (string, error) {
+	return fc.ExecCommand(cmd...)
+}
+
+func (fc *fakeCli) StreamCommand(w io.Writer, cmd ...string) error {
+	output, err := fc.ExecCommand(cmd...)
+	io.WriteString(w, output)
+	return err
+}
+
 type fakeSplitter struct{}
 
 var splitReturn [][]string
 var splitCalls int
 
 func (fs *fakeSplitter) Split(options *types.Options, input []string) [][]string {
+	mu.Lock()
+	defer mu.Unlock()
 	splitCalls++
 	return splitReturn
 }
@@ -36,21 +73,101 @@ type fakeTestflinger struct{}
 
 var generateCfgReturn []string
 var generateCfgCalls int
+var generateCfgErrorSystem string
+var generateCfgDirs []string
 
-func (ts *fakeTestflinger) GenerateCfg(options *types.Options, input [][]string) []string {
+func (ts *fakeTestflinger) GenerateCfg(options *types.Options, input []*types.Bucket) ([]string, error) {
+	mu.Lock()
+	defer mu.Unlock()
 	generateCfgCalls++
-	return generateCfgReturn
+	generateCfgDirs = append(generateCfgDirs, options.OutputDir)
+	if len(input) != 0 && input[0].System == generateCfgErrorSystem {
+		return nil, errors.New("generate error")
+	}
+	return generateCfgReturn, nil
+}
+
+type fakeServer struct{}
+
+var submitCalls int
+var submitQueues []string
+var submitError bool
+var statusReturn map[string][]string
+var resultsReturn map[string]*types.Results
+var outputReturn map[string][]string
+var cancelCalls []string
+var cancelError string
+
+func (fs *fakeServer) Submit(cfg string, job *testflinger.Job) (string, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	submitCalls++
+	submitQueues = append(submitQueues, job.Queue)
+	if submitError && submitCalls > 1 {
+		return "", errors.New("submit error")
+	}
+	return "job-" + cfg, nil
+}
+
+func (fs *fakeServer) Status(id string) (string, error) {
+	states := statusReturn[id]
+	if len(states) == 0 {
+		return "", errors.New("unknown job " + id)
+	}
+	state := states[0]
+	if len(states) > 1 {
+		statusReturn[id] = states[1:]
+	}
+	return state, nil
+}
+
+func (fs *fakeServer) Results(id string) (*types.Results, error) {
+	results, ok := resultsReturn[id]
+	if !ok {
+		return nil, errors.New("unknown job " + id)
+	}
+	return results, nil
+}
+
+func (fs *fakeServer) Output(id string) (string, error) {
+	outputs := outputReturn[id]
+	if len(outputs) == 0 {
+		return "", nil
+	}
+	outputReturn[id] = outputs[1:]
+	return outputs[0], nil
+}
+
+func (fs *fakeServer) Cancel(id string) error {
+	cancelCalls = append(cancelCalls, id)
+	if id == cancelError {
+		return errors.New("cancel error")
+	}
+	return nil
+}
+
+// tempDir returns a new directory removed at the end of the test
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
 }
 
 func TestRunner(t *testing.T) {
-	s := runner.New(&types.RunnerDependencies{
+	// the job definitions go to a temporary directory without -output
+	t.Setenv("TMPDIR", tempDir(t))
+	s := runner.New(&runner.Dependencies{
 		Cli:         &fakeCli{},
 		Splitter:    &fakeSplitter{},
 		Testflinger: &fakeTestflinger{},
 	})
 	options := &types.Options{
-		System:    "mysystem",
+		Systems:   []string{"mysystem"},
 		Executors: 4,
+		Release:   "master",
 	}
 
 	cliReturn = "line1\nline2\nline3\nline4"
@@ -80,12 +197,110 @@ func TestRunner(t *testing.T) {
 			}
 			for i := 0; i < len(generateCfgReturn); i++ {
 				expected := generateCfgReturn[i]
-				if output[i] != expected {
-					t.Errorf("expected output %s, got %s", expected, output[i])
+				if output["mysystem"][i] != expected {
+					t.Errorf("expected output %s, got %s", expected, output["mysystem"][i])
 				}
 			}
 		})
 	})
+	t.Run("multiple systems", func(t *testing.T) {
+		cliCalls, splitCalls, generateCfgCalls = 0, 0, 0
+		cliArgs = nil
+		options := &types.Options{
+			Systems:   []string{"mysystem1", "mysystem2", "mysystem3"},
+			Executors: 4,
+			Release:   "master",
+		}
+		output, err := s.Run(options)
+		if err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+		if cliCalls != 3 || splitCalls != 3 || generateCfgCalls != 3 {
+			t.Errorf("expected 3 calls per dependency, got %d, %d and %d", cliCalls, splitCalls, generateCfgCalls)
+		}
+		sort.Strings(cliArgs)
+		for i, system := range options.Systems {
+			if cliArgs[i] != "spread -list "+system {
+				t.Errorf("expected spread -list %s, got %s", system, cliArgs[i])
+			}
+			if len(output[system]) != len(generateCfgReturn) {
+				t.Errorf("expected output for %s, got %v", system, output)
+			}
+		}
+	})
+	t.Run("unhappy-path generate error removes the output of other systems", func(t *testing.T) {
+		cfg, err := ioutil.TempFile("", "cfg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Close()
+		defer os.Remove(cfg.Name())
+		generateCfgReturn, generateCfgErrorSystem = []string{cfg.Name()}, "mysystem2"
+		defer func() { generateCfgReturn, generateCfgErrorSystem = []string{"/tmp/output1", "/tmp/output2"}, "" }()
+		options := &types.Options{
+			Systems:   []string{"mysystem1", "mysystem2"},
+			Executors: 4,
+			Release:   "master",
+		}
+		if output, err := s.Run(options); err == nil || output != nil {
+			t.Fatalf("expected error and nil output, got %v, %v", err, output)
+		}
+		if _, err := os.Stat(cfg.Name()); !os.IsNotExist(err) {
+			t.Errorf("expected output of mysystem1 to be removed, got %v", err)
+		}
+	})
+	t.Run("unhappy-path generate error removes the temporary directory", func(t *testing.T) {
+		generateCfgDirs, generateCfgErrorSystem = nil, "mysystem2"
+		defer func() { generateCfgErrorSystem = "" }()
+		options := &types.Options{
+			Systems:   []string{"mysystem1", "mysystem2"},
+			Executors: 4,
+			Release:   "master",
+		}
+		if _, err := s.Run(options); err == nil {
+			t.Fatal("expected generate error")
+		}
+		if len(generateCfgDirs) != 2 || generateCfgDirs[0] != generateCfgDirs[1] || generateCfgDirs[0] == "" {
+			t.Fatalf("expected the systems to share a directory, got %v", generateCfgDirs)
+		}
+		if _, err := os.Stat(generateCfgDirs[0]); !os.IsNotExist(err) {
+			t.Errorf("expected the temporary directory to be removed, got %v", err)
+		}
+	})
+	t.Run("previous definitions are removed from the output directory", func(t *testing.T) {
+		dir := tempDir(t)
+		ioutil.WriteFile(filepath.Join(dir, "othersystem-0.yaml"), nil, 0644)
+		ioutil.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0644)
+		generateCfgDirs = nil
+		options := &types.Options{
+			Systems:   []string{"mysystem"},
+			Executors: 4,
+			Release:   "master",
+			OutputDir: dir,
+		}
+		if _, err := s.Run(options); err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+		if len(generateCfgDirs) != 1 || generateCfgDirs[0] != dir {
+			t.Errorf("expected the definitions to be written to %s, got %v", dir, generateCfgDirs)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "othersystem-0.yaml")); !os.IsNotExist(err) {
+			t.Errorf("expected the previous definition to be removed, got %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+			t.Errorf("expected other files to be kept, got %v", err)
+		}
+	})
+	t.Run("unhappy-path systems with the same definition names", func(t *testing.T) {
+		options := &types.Options{
+			Systems:   []string{"my:system", "my/system"},
+			Executors: 4,
+			Release:   "master",
+		}
+		if _, err := s.Run(options); err == nil || !strings.Contains(err.Error(), "my:system and my/system cannot be tested together") {
+			t.Errorf("expected name collision error, got %v", err)
+		}
+	})
 	t.Run("unhappy-path cli error", func(t *testing.T) {
 		cliError = true
 		defer func() { cliError = false }()
@@ -98,3 +313,416 @@ func TestRunner(t *testing.T) {
 		}
 	})
 }
+
+func TestPlan(t *testing.T) {
+	s := runner.New(&runner.Dependencies{
+		Cli:      &fakeCli{},
+		Splitter: &fakeSplitter{},
+	})
+	options := &types.Options{
+		Systems:   []string{"mysystem1", "mysystem2"},
+		Executors: 3,
+		Queues:    []types.Queue{{Name: "myqueue1", Weight: 2}, {Name: "myqueue2", Weight: 1}},
+	}
+
+	cliReturn = "line1\nline2\nline3"
+	splitReturn = [][]string{{"line1"}, {"line2"}, {"line3"}}
+
+	buckets, err := s.Plan(options)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if len(buckets) != 6 {
+		t.Fatalf("expected 6 buckets, got %d", len(buckets))
+	}
+	expectedQueues := []string{"myqueue1", "myqueue2", "myqueue1", "myqueue1", "myqueue2", "myqueue1"}
+	for i, bucket := range buckets {
+		expectedSystem := options.Systems[i/3]
+		if bucket.System != expectedSystem || bucket.Index != i%3 {
+			t.Errorf("expected bucket %d of %s, got bucket %d of %s", i%3, expectedSystem, bucket.Index, bucket.System)
+		}
+		if bucket.Queue != expectedQueues[i] {
+			t.Errorf("expected bucket %d in %s, got %s", i, expectedQueues[i], bucket.Queue)
+		}
+		if bucket.Tasks[0] != splitReturn[i%3][0] {
+			t.Errorf("expected tasks %v, got %v", splitReturn[i%3], bucket.Tasks)
+		}
+	}
+
+	options.Systems = []string{"mysystem1", "mysystem2", "mysystem3"}
+	options.SystemQueues = map[string][]types.Queue{"mysystem2": {{Name: "myqueue3", Weight: 1}}}
+	buckets, err = s.Plan(options)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	var queues []string
+	for _, bucket := range buckets {
+		queues = append(queues, bucket.Queue)
+	}
+	expected := "myqueue1 myqueue2 myqueue1 myqueue3 myqueue3 myqueue3 myqueue1 myqueue2 myqueue1"
+	if strings.Join(queues, " ") != expected {
+		t.Errorf("expected the buckets in %s, got %v", expected, queues)
+	}
+}
+
+func TestSubmit(t *testing.T) {
+	t.Setenv("TMPDIR", tempDir(t))
+	s := runner.New(&runner.Dependencies{
+		Cli:         &fakeCli{},
+		Splitter:    &fakeSplitter{},
+		Testflinger: &fakeTestflinger{},
+		Server:      &fakeServer{},
+	})
+	options := &types.Options{
+		Systems:   []string{"mysystem"},
+		Executors: 2,
+		Repo:      "myrepo",
+		Release:   "master",
+		Queues:    []types.Queue{{Name: "myqueue1", Weight: 1}, {Name: "myqueue2", Weight: 1}},
+	}
+
+	cliReturn = "line1\nline2"
+	splitReturn = [][]string{{"line1"}, {"line2"}}
+	generateCfgReturn = []string{"cfg1", "cfg2"}
+
+	t.Run("happy-path", func(t *testing.T) {
+		submitCalls, submitQueues = 0, nil
+		manifest, err := s.Submit(options)
+		if err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+		if manifest.Options.Systems[0] != "mysystem" || manifest.Options.Repo != "myrepo" {
+			t.Errorf("expected options to be recorded, got %v", manifest.Options)
+		}
+		if manifest.Commit != "0123456789abcdef0123456789abcdef01234567" || manifest.Options.Commit != manifest.Commit {
+			t.Errorf("expected resolved commit to be recorded, got %q and %q", manifest.Commit, manifest.Options.Commit)
+		}
+		if strings.Join(gitArgs, " ") != "git ls-remote myrepo master" {
+			t.Errorf("unexpected git call %v", gitArgs)
+		}
+		if options.Commit != "" {
+			t.Errorf("given options were modified: %v", options)
+		}
+		if len(manifest.Jobs) != 2 {
+			t.Fatalf("expected 2 jobs, got %d", len(manifest.Jobs))
+		}
+		for i, job := range manifest.Jobs {
+			if job.ID != "job-"+generateCfgReturn[i] {
+				t.Errorf("expected job id job-%s, got %s", generateCfgReturn[i], job.ID)
+			}
+			if job.System != "mysystem" || job.Bucket != i || job.Tasks[0] != splitReturn[i][0] {
+				t.Errorf("unexpected bucket %d with tasks %v", job.Bucket, job.Tasks)
+			}
+			if job.Queue != options.Queues[i].Name {
+				t.Errorf("expected bucket %d in queue %s, got %s", i, options.Queues[i].Name, job.Queue)
+			}
+		}
+		sort.Strings(submitQueues)
+		if strings.Join(submitQueues, " ") != "myqueue1 myqueue2" {
+			t.Errorf("expected the job definitions of the buckets to be submitted, got queues %v", submitQueues)
+		}
+	})
+	t.Run("unhappy-path submit error", func(t *testing.T) {
+		submitCalls = 0
+		submitError = true
+		defer func() { submitError = false }()
+		manifest, err := s.Submit(options)
+		if err == nil || err.Error() != "submit error" {
+			t.Errorf("expected submit error, got %v", err)
+		}
+		if len(manifest.Jobs) != 1 {
+			t.Errorf("expected the submitted job to be kept, got %v", manifest.Jobs)
+		}
+	})
+}
+
+func TestWatch(t *testing.T) {
+	s := runner.New(&runner.Dependencies{Server: &fakeServer{}})
+	manifest := &types.Manifest{
+		Jobs: []*types.Job{{ID: "job1"}, {ID: "job2"}},
+	}
+	statusReturn = map[string][]string{
+		"job1": {"waiting", "test", "complete"},
+		"job2": {"cancelled"},
+	}
+
+	var updates []string
+	err := s.Watch(manifest, &runner.WatchOptions{}, func(job *types.Job) {
+		updates = append(updates, job.ID+" "+job.State)
+	})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	expected := []string{"job1 waiting", "job2 cancelled", "job1 test", "job1 complete"}
+	if len(updates) != len(expected) {
+		t.Fatalf("expected updates %v, got %v", expected, updates)
+	}
+	for i := range expected {
+		if updates[i] != expected[i] {
+			t.Errorf("expected update %q, got %q", expected[i], updates[i])
+		}
+	}
+
+	t.Run("unhappy-path status error", func(t *testing.T) {
+		manifest := &types.Manifest{Jobs: []*types.Job{{ID: "unknown"}}}
+		if err := s.Watch(manifest, &runner.WatchOptions{}, func(*types.Job) {}); err == nil {
+			t.Error("expected error for unknown job")
+		}
+	})
+}
+
+func TestReserve(t *testing.T) {
+	s := runner.New(&runner.Dependencies{Server: &fakeServer{}})
+	submitCalls, submitError, cancelCalls, cancelError = 0, false, nil, ""
+	statusReturn = map[string][]string{
+		"job-reserve.yaml":  {"waiting", "provision", "reserve"},
+		"job-finished.yaml": {"test", "complete"},
+	}
+	outputReturn = map[string][]string{
+		"job-reserve.yaml": {"", "*** TESTFLINGER SYSTEM RESERVED ***\n", "You can now connect to ubuntu@10.0.0.1\n"},
+	}
+
+	var updates []string
+	id, addresses, err := s.Reserve("reserve.yaml", &testflinger.Job{Queue: "myqueue"}, &runner.ReserveOptions{}, func(id, state string) {
+		updates = append(updates, state)
+	})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if id != "job-reserve.yaml" {
+		t.Errorf("expected job id job-reserve.yaml, got %q", id)
+	}
+	if !reflect.DeepEqual(addresses, []string{"ubuntu@10.0.0.1"}) {
+		t.Errorf("expected the address to connect to, got %q", addresses)
+	}
+	if strings.Join(updates, " ") != "waiting provision reserve" {
+		t.Errorf("expected each state to be reported once, got %v", updates)
+	}
+	if len(cancelCalls) != 0 {
+		t.Errorf("expected the reservation to be kept, got cancelled %v", cancelCalls)
+	}
+
+	t.Run("unhappy-path job finished", func(t *testing.T) {
+		_, _, err := s.Reserve("finished.yaml", &testflinger.Job{Queue: "myqueue"}, &runner.ReserveOptions{}, func(string, string) {})
+		if err == nil || !strings.Contains(err.Error(), "finished before reserving") {
+			t.Errorf("expected finished error, got %v", err)
+		}
+	})
+	t.Run("unhappy-path timeout", func(t *testing.T) {
+		cancelCalls = nil
+		statusReturn = map[string][]string{"job-waiting.yaml": {"waiting"}}
+		opts := &runner.ReserveOptions{Interval: time.Millisecond, Timeout: 10 * time.Millisecond}
+		_, _, err := s.Reserve("waiting.yaml", &testflinger.Job{Queue: "myqueue"}, opts, func(string, string) {})
+		if err == nil || err.Error() != "job job-waiting.yaml didn't reserve its device in 10ms" {
+			t.Errorf("expected timeout error, got %v", err)
+		}
+		if !reflect.DeepEqual(cancelCalls, []string{"job-waiting.yaml"}) {
+			t.Errorf("expected the job to be cancelled, got %v", cancelCalls)
+		}
+	})
+	t.Run("unhappy-path stopped", func(t *testing.T) {
+		cancelCalls, cancelError = nil, "job-waiting.yaml"
+		defer func() { cancelError = "" }()
+		statusReturn = map[string][]string{"job-waiting.yaml": {"waiting"}}
+		stop := make(chan struct{})
+		close(stop)
+		opts := &runner.ReserveOptions{Interval: time.Hour, Stop: stop}
+		_, _, err := s.Reserve("waiting.yaml", &testflinger.Job{Queue: "myqueue"}, opts, func(string, string) {})
+		if err == nil || err.Error() != "stopped waiting for job job-waiting.yaml to reserve its device, cannot cancel it: cancel error" {
+			t.Errorf("expected stopped error, got %v", err)
+		}
+		if !reflect.DeepEqual(cancelCalls, []string{"job-waiting.yaml"}) {
+			t.Errorf("expected the job to be cancelled, got %v", cancelCalls)
+		}
+	})
+}
+
+func TestWatchStop(t *testing.T) {
+	s := runner.New(&runner.Dependencies{Server: &fakeServer{}})
+	manifest := &types.Manifest{Jobs: []*types.Job{{ID: "job1"}}}
+	statusReturn = map[string][]string{"job1": {"test"}}
+	stop := make(chan struct{})
+	close(stop)
+	if err := s.Watch(manifest, &runner.WatchOptions{Interval: time.Hour, Stop: stop}, func(*types.Job) {}); err != runner.ErrStopped {
+		t.Errorf("expected stopped error, got %v", err)
+	}
+	if manifest.Jobs[0].State != "test" {
+		t.Errorf("expected job state to be updated before stopping, got %q", manifest.Jobs[0].State)
+	}
+}
+
+func TestWatchStall(t *testing.T) {
+	s := runner.New(&runner.Dependencies{Server: &fakeServer{}, Testflinger: &fakeTestflinger{}})
+	generateCfgReturn = []string{"cfg2"}
+
+	t.Run("stalled jobs are rescheduled", func(t *testing.T) {
+		manifest := &types.Manifest{
+			Options: &types.Options{Systems: []string{"mysystem"}},
+			Jobs:    []*types.Job{{ID: "job1", System: "mysystem", Queue: "myqueue", Tasks: []string{"task1"}}},
+		}
+		statusReturn = map[string][]string{"job1": {"test"}, "job-cfg2": {"test", "complete"}}
+		outputReturn = map[string][]string{"job1": {"some output\n"}}
+		submitCalls, submitQueues, submitError, cancelCalls, cancelError = 0, nil, false, nil, ""
+
+		var updates, outputs []string
+		opts := &runner.WatchOptions{
+			Stall:      time.Nanosecond,
+			Reschedule: 1,
+			Output: func(job *types.Job, output string) {
+				outputs = append(outputs, job.ID+" "+output)
+			},
+		}
+		err := s.Watch(manifest, opts, func(job *types.Job) {
+			updates = append(updates, fmt.Sprintf("%s %s %v", job.ID, job.State, job.TimedOut))
+		})
+		if err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+		expected := "job1 test false, job1 cancelled true, job-cfg2  false, job-cfg2 test false, job-cfg2 complete false"
+		if strings.Join(updates, ", ") != expected {
+			t.Errorf("expected updates %s, got %v", expected, updates)
+		}
+		if len(outputs) != 1 || outputs[0] != "job1 some output\n" {
+			t.Errorf("expected the output read to be passed on, got %q", outputs)
+		}
+		job := manifest.Jobs[0]
+		if strings.Join(cancelCalls, " ") != "job1" || job.Attempt != 1 || len(job.Previous) != 1 || job.Previous[0] != "job1" || job.Cfg != "cfg2" {
+			t.Errorf("expected job1 to be cancelled and replaced, got %v and %+v", cancelCalls, job)
+		}
+		if len(submitQueues) != 1 || submitQueues[0] != "myqueue" {
+			t.Errorf("expected the bucket to be resubmitted to myqueue, got %v", submitQueues)
+		}
+	})
+	t.Run("stalled jobs are cancelled", func(t *testing.T) {
+		manifest := &types.Manifest{Jobs: []*types.Job{{ID: "job1"}}}
+		statusReturn = map[string][]string{"job1": {"provision"}}
+		outputReturn = map[string][]string{"job1": {"some output\n"}}
+		submitCalls, cancelCalls = 0, nil
+		if err := s.Watch(manifest, &runner.WatchOptions{Stall: time.Nanosecond}, func(*types.Job) {}); err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+		if job := manifest.Jobs[0]; job.State != "cancelled" || !job.TimedOut || submitCalls != 0 {
+			t.Errorf("expected job to time out without being rescheduled, got %+v after %d submissions", job, submitCalls)
+		}
+	})
+	t.Run("waiting jobs don't stall", func(t *testing.T) {
+		manifest := &types.Manifest{Jobs: []*types.Job{{ID: "job1"}}}
+		statusReturn = map[string][]string{"job1": {"waiting", "waiting", "waiting", "complete"}}
+		outputReturn = map[string][]string{}
+		cancelCalls = nil
+		if err := s.Watch(manifest, &runner.WatchOptions{Stall: time.Nanosecond}, func(*types.Job) {}); err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+		if manifest.Jobs[0].TimedOut || len(cancelCalls) != 0 {
+			t.Errorf("expected waiting job not to time out, got %+v", manifest.Jobs[0])
+		}
+	})
+}
+
+func TestCancel(t *testing.T) {
+	s := runner.New(&runner.Dependencies{Server: &fakeServer{}})
+	manifest := &types.Manifest{
+		Jobs: []*types.Job{{ID: "job1", State: "test"}, {ID: "job2"}, {ID: "job3", State: "complete"}, {ID: "job4"}},
+	}
+	statusReturn = map[string][]string{
+		"job1": {"test"},
+		"job2": {"complete"},
+		"job4": {"waiting"},
+	}
+	cancelCalls, cancelError = nil, ""
+
+	var updates []string
+	err := s.Cancel(manifest, func(job *types.Job) {
+		updates = append(updates, job.ID+" "+job.State)
+	})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if strings.Join(cancelCalls, " ") != "job1 job4" {
+		t.Errorf("expected only unfinished jobs to be cancelled, got %v", cancelCalls)
+	}
+	if strings.Join(updates, ", ") != "job1 cancelled, job2 complete, job4 cancelled" {
+		t.Errorf("unexpected updates %v", updates)
+	}
+
+	t.Run("unhappy-path errors don't stop cancelling", func(t *testing.T) {
+		manifest := &types.Manifest{Jobs: []*types.Job{{ID: "job1"}, {ID: "job2"}}}
+		statusReturn = map[string][]string{"job1": {"test"}, "job2": {"test"}}
+		cancelCalls, cancelError = nil, "job1"
+		if err := s.Cancel(manifest, func(*types.Job) {}); err == nil {
+			t.Error("expected cancel error")
+		}
+		if len(cancelCalls) != 2 || manifest.Jobs[0].State != "" || manifest.Jobs[1].State != "cancelled" {
+			t.Errorf("unexpected calls %v and jobs %+v %+v", cancelCalls, manifest.Jobs[0], manifest.Jobs[1])
+		}
+	})
+}
+
+func TestReport(t *testing.T) {
+	s := runner.New(&runner.Dependencies{Server: &fakeServer{}})
+	manifest := &types.Manifest{
+		Jobs: []*types.Job{{ID: "job1"}, {ID: "job2"}},
+	}
+	resultsReturn = map[string]*types.Results{
+		"job1": {JobState: "complete"},
+		"job2": {JobState: "complete", TestStatus: 1},
+	}
+
+	results, err := s.Report(manifest)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if !results[0].Passed() {
+		t.Errorf("expected job1 to pass")
+	}
+	if results[1].Passed() {
+		t.Errorf("expected job2 to fail")
+	}
+}
+
+func TestSubmitResolvesCommit(t *testing.T) {
+	t.Setenv("TMPDIR", tempDir(t))
+	s := runner.New(&runner.Dependencies{
+		Cli:         &fakeCli{},
+		Splitter:    &fakeSplitter{},
+		Testflinger: &fakeTestflinger{},
+		Server:      &fakeServer{},
+	})
+	cliReturn = "line1"
+	splitReturn = [][]string{{"line1"}}
+	generateCfgReturn = []string{"cfg1"}
+	defer func(back string) { lsRemoteReturn = back }(lsRemoteReturn)
+	lsRemoteReturn = "1111111111111111111111111111111111111111\trefs/heads/release-2.45\n" +
+		"2222222222222222222222222222222222222222\trefs/tags/2.45\n" +
+		"3333333333333333333333333333333333333333\trefs/tags/2.45^{}\n" +
+		"4444444444444444444444444444444444444444\trefs/pull/1234/head\n"
+
+	for _, tc := range []struct {
+		name     string
+		options  *types.Options
+		expected string
+	}{
+		{"branch", &types.Options{Release: "release-2.45"}, "1111111111111111111111111111111111111111"},
+		{"peeled tag", &types.Options{Release: "2.45"}, "3333333333333333333333333333333333333333"},
+		{"pull request ref", &types.Options{Release: "master", Ref: "pull/1234/head"}, "4444444444444444444444444444444444444444"},
+		{"pinned commit", &types.Options{Release: "master", Commit: "abcdef1"}, "abcdef1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.Systems = []string{"mysystem"}
+			tc.options.Queues = []types.Queue{{Name: "myqueue", Weight: 1}}
+			manifest, err := s.Submit(tc.options)
+			if err != nil {
+				t.Fatalf("expected nil error, got %v", err)
+			}
+			if manifest.Commit != tc.expected {
+				t.Errorf("expected commit %s, got %s", tc.expected, manifest.Commit)
+			}
+		})
+	}
+	t.Run("unknown ref", func(t *testing.T) {
+		options := &types.Options{Systems: []string{"mysystem"}, Release: "unknown"}
+		if _, err := s.Submit(options); err == nil || !strings.Contains(err.Error(), "cannot resolve unknown") {
+			t.Errorf("expected resolution error, got %v", err)
+		}
+	})
+}
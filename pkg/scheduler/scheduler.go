@@ -0,0 +1,40 @@
+package scheduler
+
+import "github.com/fgimenez/validator/pkg/types"
+
+// Assign returns the queue for each of n buckets, distributing them among the
+// given queues in proportion to their weights. It uses smooth weighted round
+// robin, so queues with the same weight are used in turns and a queue with
+// weight 2 gets twice the buckets of one with weight 1, interleaved
+func Assign(queues []types.Queue, n int) []string {
+	if len(queues) == 0 {
+		return nil
+	}
+
+	total := 0
+	for _, q := range queues {
+		total += weight(q)
+	}
+
+	current := make([]int, len(queues))
+	result := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		best := 0
+		for j, q := range queues {
+			current[j] += weight(q)
+			if current[j] > current[best] {
+				best = j
+			}
+		}
+		current[best] -= total
+		result = append(result, queues[best].Name)
+	}
+	return result
+}
+
+func weight(q types.Queue) int {
+	if q.Weight < 1 {
+		return 1
+	}
+	return q.Weight
+}
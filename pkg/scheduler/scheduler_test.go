@@ -0,0 +1,54 @@
+package scheduler_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/fgimenez/validator/pkg/scheduler"
+	"github.com/fgimenez/validator/pkg/types"
+)
+
+func TestAssign(t *testing.T) {
+	t.Run("no queues", func(t *testing.T) {
+		if result := scheduler.Assign(nil, 3); len(result) != 0 {
+			t.Errorf("expected empty result, got %v", result)
+		}
+	})
+	t.Run("single queue", func(t *testing.T) {
+		result := scheduler.Assign([]types.Queue{{Name: "q1", Weight: 1}}, 3)
+		if strings.Join(result, " ") != "q1 q1 q1" {
+			t.Errorf("expected all buckets in q1, got %v", result)
+		}
+	})
+	t.Run("same weight is round robin", func(t *testing.T) {
+		queues := []types.Queue{{Name: "q1", Weight: 1}, {Name: "q2", Weight: 1}}
+		result := scheduler.Assign(queues, 5)
+		if strings.Join(result, " ") != "q1 q2 q1 q2 q1" {
+			t.Errorf("expected round robin, got %v", result)
+		}
+	})
+	t.Run("missing weight counts as 1", func(t *testing.T) {
+		queues := []types.Queue{{Name: "q1"}, {Name: "q2"}}
+		result := scheduler.Assign(queues, 4)
+		if strings.Join(result, " ") != "q1 q2 q1 q2" {
+			t.Errorf("expected round robin, got %v", result)
+		}
+	})
+	t.Run("weighted queues", func(t *testing.T) {
+		queues := []types.Queue{{Name: "q1", Weight: 2}, {Name: "q2", Weight: 1}}
+		result := scheduler.Assign(queues, 6)
+		if strings.Join(result, " ") != "q1 q2 q1 q1 q2 q1" {
+			t.Errorf("expected interleaved weighted distribution, got %v", result)
+		}
+	})
+	t.Run("weights are honoured", func(t *testing.T) {
+		queues := []types.Queue{{Name: "q1", Weight: 5}, {Name: "q2", Weight: 3}, {Name: "q3", Weight: 2}}
+		count := map[string]int{}
+		for _, q := range scheduler.Assign(queues, 100) {
+			count[q]++
+		}
+		if count["q1"] != 50 || count["q2"] != 30 || count["q3"] != 20 {
+			t.Errorf("expected 50/30/20 distribution, got %v", count)
+		}
+	})
+}
@@ -0,0 +1,158 @@
+// Package seed reads the seed.manifest files ubuntu-image leaves next to the
+// images, listing the revision of each snap seeded in them
+package seed
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileName is the name of the manifest in the output dir of ubuntu-image
+const FileName = "seed.manifest"
+
+// PublicURL is where image-generator publishes the images, each in a
+// directory named after the image
+const PublicURL = "https://storage.googleapis.com/snapd-spread-tests/images"
+
+// HTTPClient fetches the manifests given by URL, the proxy is taken from the
+// environment
+var HTTPClient = &http.Client{Timeout: time.Minute}
+
+// Manifest holds the revision of each snap in an image, by name
+type Manifest map[string]int
+
+// Names returns the sorted names of the snaps in the manifest
+func (m Manifest) Names() []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// URL returns the location of the manifest of a published image
+func URL(image string) string {
+	return PublicURL + "/" + image + "/" + FileName
+}
+
+// Load reads the manifest at the given location, an HTTP URL or a path, the
+// warnings about the lines skipped are prefixed by the location
+func Load(location string) (Manifest, []string, error) {
+	var m Manifest
+	var warnings []string
+	var err error
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		m, warnings, err = fetch(location)
+	} else {
+		m, warnings, err = open(location)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, w := range warnings {
+		warnings[i] = location + ":" + w
+	}
+	return m, warnings, nil
+}
+
+func open(path string) (Manifest, []string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+func fetch(url string) (Manifest, []string, error) {
+	resp, err := HTTPClient.Get(url)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("cannot get %s: %s", url, resp.Status)
+	}
+	m, warnings, err := Parse(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot get %s: %v", url, err)
+	}
+	return m, warnings, nil
+}
+
+// Parse decodes the lines of a manifest, "<snap> <revision>", empty lines
+// are ignored. As image-generator does, invalid lines are skipped instead of
+// discarding the whole manifest, a warning with the number of each of them is
+// returned. A snap listed more than once gets its last revision
+func Parse(r io.Reader) (Manifest, []string, error) {
+	m := Manifest{}
+	var warnings []string
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			warnings = append(warnings, fmt.Sprintf("%d: expected <snap> <revision>, got %q", n, scanner.Text()))
+			continue
+		}
+		revision, err := strconv.Atoi(fields[1])
+		if err != nil || revision <= 0 {
+			warnings = append(warnings, fmt.Sprintf("%d: invalid revision %q of snap %s", n, fields[1], fields[0]))
+			continue
+		}
+		if previous, ok := m[fields[0]]; ok {
+			warnings = append(warnings, fmt.Sprintf("%d: snap %s is listed more than once, replacing revision %d", n, fields[0], previous))
+		}
+		m[fields[0]] = revision
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return m, warnings, nil
+}
+
+// Change is a difference between two manifests, Old is 0 for added snaps and
+// New is 0 for removed ones
+type Change struct {
+	Name string
+	Old  int
+	New  int
+}
+
+func (c Change) String() string {
+	switch {
+	case c.Old == 0:
+		return fmt.Sprintf("added %s %d", c.Name, c.New)
+	case c.New == 0:
+		return fmt.Sprintf("removed %s %d", c.Name, c.Old)
+	}
+	return fmt.Sprintf("changed %s %d -> %d", c.Name, c.Old, c.New)
+}
+
+// Diff returns the snaps added, removed or with another revision in current,
+// sorted by name
+func Diff(old, current Manifest) []Change {
+	var changes []Change
+	for _, name := range old.Names() {
+		if current[name] != old[name] {
+			changes = append(changes, Change{Name: name, Old: old[name], New: current[name]})
+		}
+	}
+	for _, name := range current.Names() {
+		if _, ok := old[name]; !ok {
+			changes = append(changes, Change{Name: name, New: current[name]})
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	return changes
+}
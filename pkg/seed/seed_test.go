@@ -0,0 +1,128 @@
+package seed_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fgimenez/validator/pkg/seed"
+)
+
+const manifest = `core18 1705
+pc 36
+
+pc-kernel 449
+snapd 7264
+`
+
+func TestParse(t *testing.T) {
+	m, warnings, err := seed.Parse(strings.NewReader(manifest))
+	if err != nil || len(warnings) != 0 {
+		t.Fatalf("expected no error nor warnings, got %v, %v", err, warnings)
+	}
+	expected := seed.Manifest{"core18": 1705, "pc": 36, "pc-kernel": 449, "snapd": 7264}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("expected %v, got %v", expected, m)
+	}
+	if names := m.Names(); !reflect.DeepEqual(names, []string{"core18", "pc", "pc-kernel", "snapd"}) {
+		t.Errorf("unexpected names %v", names)
+	}
+}
+
+func TestParseInvalidLines(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		content  string
+		expected seed.Manifest
+		warning  string
+	}{
+		{"missing revision", "core18 1705\nsnapd\n", seed.Manifest{"core18": 1705}, `2: expected <snap> <revision>, got "snapd"`},
+		{"invalid revision", "snapd x1\ncore18 1705\n", seed.Manifest{"core18": 1705}, `1: invalid revision "x1" of snap snapd`},
+		{"zero revision", "snapd 0\n", seed.Manifest{}, `1: invalid revision "0" of snap snapd`},
+		{"repeated snap", "snapd 1\nsnapd 2\n", seed.Manifest{"snapd": 2}, "2: snap snapd is listed more than once, replacing revision 1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m, warnings, err := seed.Parse(strings.NewReader(tc.content))
+			if err != nil {
+				t.Fatalf("expected invalid lines to be skipped, got %v", err)
+			}
+			if !reflect.DeepEqual(m, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, m)
+			}
+			if len(warnings) != 1 || warnings[0] != tc.warning {
+				t.Errorf("expected warning %q, got %q", tc.warning, warnings)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, seed.FileName)
+	ioutil.WriteFile(path, []byte(manifest), 0644)
+	invalid := filepath.Join(dir, "invalid.manifest")
+	ioutil.WriteFile(invalid, []byte("snapd\n"), 0644)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/pi3-18-beta/"+seed.FileName {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(manifest))
+	}))
+	defer server.Close()
+
+	for _, location := range []string{path, server.URL + "/pi3-18-beta/" + seed.FileName} {
+		if m, _, err := seed.Load(location); err != nil || m["snapd"] != 7264 {
+			t.Errorf("expected the manifest from %s, got %v, %v", location, m, err)
+		}
+	}
+	if _, _, err := seed.Load(server.URL + "/missing/" + seed.FileName); err == nil || !strings.HasSuffix(err.Error(), "404 Not Found") {
+		t.Errorf("expected not found error, got %v", err)
+	}
+	if _, warnings, err := seed.Load(invalid); err != nil || len(warnings) != 1 || !strings.HasPrefix(warnings[0], invalid+":1: ") {
+		t.Errorf("expected warning with the path and line, got %q, %v", warnings, err)
+	}
+	if _, _, err := seed.Load(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old := seed.Manifest{"core18": 1705, "pc": 36, "pc-kernel": 449, "snapd": 7264}
+	new := seed.Manifest{"core18": 1754, "pc": 36, "pc-kernel": 449, "test-snapd-tools": 7}
+	changes := seed.Diff(old, new)
+	expected := []seed.Change{
+		{Name: "core18", Old: 1705, New: 1754},
+		{Name: "snapd", Old: 7264},
+		{Name: "test-snapd-tools", New: 7},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("expected %v, got %v", expected, changes)
+	}
+	var lines []string
+	for _, c := range changes {
+		lines = append(lines, c.String())
+	}
+	if s := strings.Join(lines, "\n"); s != "changed core18 1705 -> 1754\nremoved snapd 7264\nadded test-snapd-tools 7" {
+		t.Errorf("unexpected changes %q", s)
+	}
+	if changes := seed.Diff(old, old); len(changes) != 0 {
+		t.Errorf("expected no changes, got %v", changes)
+	}
+}
+
+func TestURL(t *testing.T) {
+	if url := seed.URL("pi3-18-beta"); url != "https://storage.googleapis.com/snapd-spread-tests/images/pi3-18-beta/seed.manifest" {
+		t.Errorf("unexpected url %s", url)
+	}
+}
@@ -0,0 +1,356 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// GCSEndpoint is the XML API of Google Cloud Storage
+const GCSEndpoint = "https://storage.googleapis.com"
+
+// DefaultPartSize is the size of the parts of the objects uploaded in parts,
+// each part is streamed from the file, so the size only bounds what is sent
+// again when a part fails
+const DefaultPartSize = 64 << 20
+
+// Bucket stores the objects in a bucket through the path style API of S3,
+// served by S3 compatible stores and by the XML API of Google Cloud Storage.
+// The requests are authorized with an OAuth token or signed by Signer
+type Bucket struct {
+	// Endpoint is the address of the API, ie GCSEndpoint, an S3 endpoint
+	// such as https://s3.us-east-1.amazonaws.com or an emulator
+	Endpoint string
+	Name     string
+	// Prefix is prepended to the keys, so that the objects are kept in a
+	// directory of the bucket
+	Prefix string
+	// Token is sent as a bearer token, an OAuth access token, the requests
+	// are anonymous when empty and there is no Signer
+	Token string
+	// Signer signs the requests instead of sending Token, ie a SigV4 for S3
+	Signer Signer
+	// PublicURL is where the objects of the bucket are downloaded from,
+	// Endpoint/Name when empty
+	PublicURL string
+	// PartSize is the size of the parts of the files uploaded in parts, the
+	// files bigger than it, DefaultPartSize when zero
+	PartSize int64
+	HTTP     *http.Client
+}
+
+// NewBucket returns a backend storing the objects under prefix in the named
+// bucket of the endpoint, the proxy is taken from the environment
+func NewBucket(endpoint, name, prefix string) *Bucket {
+	return &Bucket{
+		Endpoint: strings.TrimSuffix(endpoint, "/"),
+		Name:     name,
+		Prefix:   strings.Trim(prefix, "/"),
+		// no timeout, images take long to transfer
+		HTTP: &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment}},
+	}
+}
+
+// SetProxy makes the backend reach the endpoint through the proxy at the
+// given URL, ie http://squid.internal:3128
+func (b *Bucket) SetProxy(proxy string) error {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return fmt.Errorf("invalid proxy %q: %v", proxy, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid proxy %q: expected <scheme>://<host>[:<port>]", proxy)
+	}
+	b.HTTP.Transport = &http.Transport{Proxy: http.ProxyURL(u)}
+	return nil
+}
+
+// StatusError is returned when the endpoint answers with an unexpected status
+type StatusError struct {
+	Method string
+	URL    string
+	Code   int
+	Body   string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s: %s", e.Method, e.URL, e.Code, http.StatusText(e.Code), strings.TrimSpace(e.Body))
+}
+
+// name returns the name of the object of the key in the bucket
+func (b *Bucket) name(key string) string {
+	if b.Prefix == "" {
+		return key
+	}
+	return b.Prefix + "/" + key
+}
+
+func (b *Bucket) objectURL(key string) string {
+	u := url.URL{Path: "/" + b.Name + "/" + b.name(key)}
+	return b.Endpoint + u.EscapedPath()
+}
+
+func (b *Bucket) partSize() int64 {
+	if b.PartSize == 0 {
+		return DefaultPartSize
+	}
+	return b.PartSize
+}
+
+func (b *Bucket) do(method, u string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	// streamed files and parts need their length, the API doesn't accept
+	// chunked uploads, they are sent from the reader without being buffered
+	var size int64 = -1
+	switch r := body.(type) {
+	case *os.File:
+		info, err := r.Stat()
+		if err != nil {
+			return nil, err
+		}
+		size = info.Size()
+	case *io.SectionReader:
+		size = r.Size()
+	}
+	if size >= 0 {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	switch {
+	case b.Signer != nil:
+		if err := b.Signer.Sign(req); err != nil {
+			return nil, err
+		}
+	case b.Token != "":
+		req.Header.Set("Authorization", "Bearer "+b.Token)
+	}
+	resp, err := b.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return nil, &StatusError{Method: method, URL: u, Code: resp.StatusCode, Body: string(data)}
+	}
+	return resp, nil
+}
+
+func notFound(err error, key string) error {
+	if e, ok := err.(*StatusError); ok && e.Code == http.StatusNotFound {
+		return &NotFoundError{Key: key}
+	}
+	return err
+}
+
+// Put uploads the object, files bigger than the part size are uploaded in
+// parts
+func (b *Bucket) Put(key string, r io.Reader) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if f, ok := r.(*os.File); ok {
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if info.Size() > b.partSize() {
+			return b.putParts(key, f, info.Size())
+		}
+	}
+	resp, err := b.do("PUT", b.objectURL(key), r)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+type initiateUpload struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completeUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []part   `xml:"Part"`
+}
+
+type part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// uploadError is the error the completion of an upload can answer with
+// despite its 200 status
+type uploadError struct {
+	XMLName xml.Name
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// putParts uploads the file with a multipart upload, aborted on failure so
+// that the parts uploaded aren't kept
+func (b *Bucket) putParts(key string, f *os.File, size int64) error {
+	u := b.objectURL(key)
+	resp, err := b.do("POST", u+"?uploads", nil)
+	if err != nil {
+		return err
+	}
+	var upload initiateUpload
+	err = xml.NewDecoder(resp.Body).Decode(&upload)
+	resp.Body.Close()
+	if err != nil || upload.UploadID == "" {
+		return fmt.Errorf("cannot start the upload of %s: invalid answer: %v", key, err)
+	}
+	if err := b.uploadParts(u, upload.UploadID, f, size); err != nil {
+		if resp, err := b.do("DELETE", u+"?"+url.Values{"uploadId": {upload.UploadID}}.Encode(), nil); err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+func (b *Bucket) uploadParts(u, id string, f *os.File, size int64) error {
+	partSize := b.partSize()
+	complete := completeUpload{}
+	for offset := int64(0); offset < size; offset += partSize {
+		n := len(complete.Parts) + 1
+		query := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {id}}
+		length := partSize
+		if size-offset < length {
+			length = size - offset
+		}
+		resp, err := b.do("PUT", u+"?"+query.Encode(), io.NewSectionReader(f, offset, length))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		complete.Parts = append(complete.Parts, part{PartNumber: n, ETag: resp.Header.Get("ETag")})
+	}
+	data, err := xml.Marshal(&complete)
+	if err != nil {
+		return err
+	}
+	query := url.Values{"uploadId": {id}}
+	resp, err := b.do("POST", u+"?"+query.Encode(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var e uploadError
+	if xml.Unmarshal(body, &e) == nil && e.XMLName.Local == "Error" {
+		return &StatusError{Method: "POST", URL: u, Code: resp.StatusCode, Body: string(body)}
+	}
+	return nil
+}
+
+// Get downloads the object to w
+func (b *Bucket) Get(key string, w io.Writer) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	resp, err := b.do("GET", b.objectURL(key), nil)
+	if err != nil {
+		return notFound(err, key)
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// listing is the answer of ListObjectsV2
+type listing struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+		ETag string `xml:"ETag"`
+	} `xml:"Contents"`
+}
+
+// List returns the objects with keys starting with prefix, following the
+// continuation of truncated listings
+func (b *Bucket) List(prefix string) ([]*Object, error) {
+	var objects []*Object
+	query := url.Values{"list-type": {"2"}, "prefix": {b.name(prefix)}}
+	for {
+		resp, err := b.do("GET", b.Endpoint+"/"+b.Name+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		var l listing
+		err = xml.NewDecoder(resp.Body).Decode(&l)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode the objects of bucket %s: %v", b.Name, err)
+		}
+		for _, c := range l.Contents {
+			objects = append(objects, &Object{
+				Key:  strings.TrimPrefix(c.Key, b.name("")),
+				Size: c.Size,
+				MD5:  etagMD5(c.ETag),
+			})
+		}
+		if !l.IsTruncated || l.NextContinuationToken == "" {
+			return objects, nil
+		}
+		query.Set("continuation-token", l.NextContinuationToken)
+	}
+}
+
+// etagMD5 returns the digest in the ETag of an object, which for objects
+// uploaded in parts is the digest of the digests of the parts followed by the
+// number of parts
+func etagMD5(etag string) string {
+	etag = strings.Trim(etag, `"`)
+	digest := etag
+	if i := strings.Index(etag, "-"); i >= 0 {
+		if n, err := strconv.Atoi(etag[i+1:]); err != nil || n < 1 {
+			return ""
+		}
+		digest = etag[:i]
+	}
+	if _, err := hex.DecodeString(digest); err != nil || len(digest) != 32 {
+		return ""
+	}
+	return etag
+}
+
+// Delete removes the object
+func (b *Bucket) Delete(key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	resp, err := b.do("DELETE", b.objectURL(key), nil)
+	if err != nil {
+		return notFound(err, key)
+	}
+	return resp.Body.Close()
+}
+
+// URL returns the public address of the object
+func (b *Bucket) URL(key string) string {
+	if b.PublicURL == "" {
+		return b.objectURL(key)
+	}
+	u := url.URL{Path: "/" + b.name(key)}
+	return strings.TrimSuffix(b.PublicURL, "/") + u.EscapedPath()
+}
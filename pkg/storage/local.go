@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Local stores the objects as files of a directory
+type Local struct {
+	Dir string
+	// BaseURL is where the directory is served, file URLs are returned when
+	// empty
+	BaseURL string
+}
+
+// NewLocal returns a backend storing the objects in dir, which is created on
+// the first Put
+func NewLocal(dir string) *Local {
+	return &Local{Dir: dir}
+}
+
+func (l *Local) path(key string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(l.Dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes the object to a temporary file renamed once complete, so that
+// readers never see a partial object
+func (l *Local) Put(key string, r io.Reader) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// Get writes the content of the object to w
+func (l *Local) Get(key string, w io.Writer) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return &NotFoundError{Key: key}
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// List returns the files with keys starting with prefix, the directory not
+// existing yet is the same as it being empty
+func (l *Local) List(prefix string) ([]*Object, error) {
+	var objects []*Object
+	err := filepath.Walk(l.Dir, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && p == l.Dir {
+			return filepath.SkipDir
+		}
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(l.Dir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		sum, err := fileMD5(p)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, &Object{Key: key, Size: info.Size(), MD5: sum})
+		return nil
+	})
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, err
+}
+
+// Delete removes the file of the object and the directories left empty
+func (l *Local) Delete(key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); os.IsNotExist(err) {
+		return &NotFoundError{Key: key}
+	} else if err != nil {
+		return err
+	}
+	for dir := filepath.Dir(p); dir != filepath.Clean(l.Dir); dir = filepath.Dir(dir) {
+		// fails once a directory isn't empty
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// URL returns BaseURL/key, or the file URL of the object without BaseURL
+func (l *Local) URL(key string) string {
+	if l.BaseURL != "" {
+		return strings.TrimSuffix(l.BaseURL, "/") + "/" + key
+	}
+	dir, err := filepath.Abs(l.Dir)
+	if err != nil {
+		dir = l.Dir
+	}
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(filepath.Join(dir, filepath.FromSlash(key)))}
+	return u.String()
+}
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Signer authorizes the requests to a bucket
+type Signer interface {
+	Sign(req *http.Request) error
+}
+
+// sigV4Time is the format of the X-Amz-Date header
+const sigV4Time = "20060102T150405Z"
+
+// unsignedPayload is sent as the digest of the bodies, which are streamed
+// instead of being read twice
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// SigV4 signs the requests with the AWS signature version 4, as S3 and the
+// other S3 compatible stores require, ie Google Cloud Storage with HMAC keys
+type SigV4 struct {
+	AccessKey string
+	SecretKey string
+	// Region is the region of the bucket, ie us-east-1, auto for Google Cloud
+	// Storage
+	Region string
+	// Service is the name of the service in the credential scope, s3 when
+	// empty
+	Service string
+}
+
+func (s *SigV4) service() string {
+	if s.Service == "" {
+		return "s3"
+	}
+	return s.Service
+}
+
+// Sign adds the Authorization header to the request, the time of the
+// signature is taken from its X-Amz-Date header when set. The body isn't
+// part of the signature, S3 is told so in the X-Amz-Content-Sha256 header
+func (s *SigV4) Sign(req *http.Request) error {
+	if s.AccessKey == "" || s.SecretKey == "" || s.Region == "" {
+		return fmt.Errorf("cannot sign %s %s: access key, secret key and region are required", req.Method, req.URL)
+	}
+	date := req.Header.Get("X-Amz-Date")
+	if date == "" {
+		date = time.Now().UTC().Format(sigV4Time)
+		req.Header.Set("X-Amz-Date", date)
+	} else if _, err := time.Parse(sigV4Time, date); err != nil {
+		return fmt.Errorf("cannot sign %s %s: invalid X-Amz-Date %q", req.Method, req.URL, date)
+	}
+	payload := unsignedPayload
+	if req.ContentLength == 0 {
+		payload = hexDigest(nil)
+	}
+	if s.service() == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payload)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	// the path is sent encoded as it is signed
+	req.URL.RawPath = uriEncode(path, false)
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.RawPath,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payload,
+	}, "\n")
+
+	scope := strings.Join([]string{date[:8], s.Region, s.service(), "aws4_request"}, "/")
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", date, scope, hexDigest([]byte(canonical))}, "\n")
+	key := []byte("AWS4" + s.SecretKey)
+	for _, part := range []string{date[:8], s.Region, s.service(), "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.AccessKey, scope, signedHeaders, signature))
+	return nil
+}
+
+func hexDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery returns the parameters sorted by name and value, with the
+// names and values encoded
+func canonicalQuery(query url.Values) string {
+	var params [][2]string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, [2]string{uriEncode(name, true), uriEncode(value, true)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+	encoded := make([]string, len(params))
+	for i, p := range params {
+		encoded[i] = p[0] + "=" + p[1]
+	}
+	return strings.Join(encoded, "&")
+}
+
+// uriEncode percent encodes every byte but the unreserved characters of RFC
+// 3986, slashes are kept unless encodeSlash is true
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,259 @@
+// Package storage keeps the artifacts of the tools, ie the images published by
+// image-generator, in a local directory or in a bucket
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DefaultImages is where image-generator publishes the images, served from
+// seed.PublicURL
+const DefaultImages = "gs://snapd-spread-tests/images"
+
+// Object is a stored artifact
+type Object struct {
+	// Key is the slash separated name of the object
+	Key  string
+	Size int64
+	// MD5 is the hex digest of the content, or for objects uploaded in parts
+	// the digest of the digests of the parts followed by -<parts>, empty when
+	// the backend doesn't know it
+	MD5 string
+}
+
+// Backend stores objects by key
+type Backend interface {
+	// Put stores the content read from r as the object with the given key,
+	// replacing it if it exists
+	Put(key string, r io.Reader) error
+	// Get writes the content of the object to w
+	Get(key string, w io.Writer) error
+	// List returns the objects with keys starting with prefix, sorted by key
+	List(prefix string) ([]*Object, error)
+	Delete(key string) error
+	// URL returns the address the object can be downloaded from
+	URL(key string) string
+}
+
+// NotFoundError is returned for objects which don't exist
+type NotFoundError struct {
+	Key string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("object %s not found", e.Key)
+}
+
+// IsNotFound returns true when the error is caused by a missing object
+func IsNotFound(err error) bool {
+	_, ok := err.(*NotFoundError)
+	return ok
+}
+
+// checkKey rejects keys which are not clean relative slash separated paths,
+// so that they can't point outside a local directory
+func checkKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") || path.Clean(key) != key || key == ".." || strings.HasPrefix(key, "../") {
+		return fmt.Errorf("invalid key %q", key)
+	}
+	return nil
+}
+
+// Open returns the backend of a location, which is either a bucket of Google
+// Cloud Storage given as gs://<bucket>[/<prefix>], a bucket of S3 or of another
+// S3 compatible endpoint given as http(s)://<endpoint>/<bucket>[/<prefix>],
+// ie https://s3.us-east-1.amazonaws.com/<bucket>, or a local directory given
+// as a path or file URL
+func Open(location string) (Backend, error) {
+	if !strings.Contains(location, "://") {
+		return NewLocal(location), nil
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid location %q: %v", location, err)
+	}
+	switch u.Scheme {
+	case "file":
+		return NewLocal(u.Path), nil
+	case "gs":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid location %q: expected gs://<bucket>[/<prefix>]", location)
+		}
+		return NewBucket(GCSEndpoint, u.Host, strings.Trim(u.Path, "/")), nil
+	case "http", "https":
+		parts := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+		if u.Host == "" || parts[0] == "" {
+			return nil, fmt.Errorf("invalid location %q: expected %s://<endpoint>/<bucket>[/<prefix>]", location, u.Scheme)
+		}
+		prefix := ""
+		if len(parts) == 2 {
+			prefix = parts[1]
+		}
+		return NewBucket(u.Scheme+"://"+u.Host, parts[0], prefix), nil
+	}
+	return nil, fmt.Errorf("invalid location %q: unsupported scheme %s", location, u.Scheme)
+}
+
+// SyncResult lists the keys of the objects changed by Sync
+type SyncResult struct {
+	Uploaded  []string
+	Deleted   []string
+	Unchanged []string
+}
+
+// Sync makes the objects under prefix mirror the files of dir as gsutil rsync
+// -r does, files with the same size and digest as their object aren't
+// uploaded again, with del the objects without a file are deleted as with -d
+func Sync(b Backend, dir, prefix string, del bool) (*SyncResult, error) {
+	if prefix != "" {
+		if err := checkKey(prefix); err != nil {
+			return nil, err
+		}
+		prefix += "/"
+	}
+	files := map[string]string{}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		files[prefix+filepath.ToSlash(rel)] = p
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	objects, err := b.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var partSize int64
+	if bucket, ok := b.(*Bucket); ok {
+		partSize = bucket.partSize()
+	}
+	stored := map[string]*Object{}
+	for _, o := range objects {
+		stored[o.Key] = o
+	}
+
+	var keys []string
+	for key := range files {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := &SyncResult{}
+	for _, key := range keys {
+		same, err := unchanged(files[key], stored[key], partSize)
+		if err != nil {
+			return result, err
+		}
+		if same {
+			result.Unchanged = append(result.Unchanged, key)
+			continue
+		}
+		if err := putFile(b, key, files[key]); err != nil {
+			return result, err
+		}
+		result.Uploaded = append(result.Uploaded, key)
+	}
+	if !del {
+		return result, nil
+	}
+	for _, o := range objects {
+		if _, ok := files[o.Key]; ok {
+			continue
+		}
+		if err := b.Delete(o.Key); err != nil && !IsNotFound(err) {
+			return result, err
+		}
+		result.Deleted = append(result.Deleted, o.Key)
+	}
+	return result, nil
+}
+
+// unchanged returns true when the file has the size and digest of the object,
+// objects uploaded in parts are compared with the digest of the file read in
+// parts of partSize
+func unchanged(file string, o *Object, partSize int64) (bool, error) {
+	if o == nil || o.MD5 == "" {
+		return false, nil
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return false, err
+	}
+	if info.Size() != o.Size {
+		return false, nil
+	}
+	if strings.Contains(o.MD5, "-") {
+		if partSize == 0 {
+			return false, nil
+		}
+		sum, err := partsMD5(file, partSize)
+		return sum == o.MD5, err
+	}
+	sum, err := fileMD5(file)
+	return sum == o.MD5, err
+}
+
+func putFile(b Backend, key, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return b.Put(key, f)
+}
+
+func fileMD5(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// partsMD5 returns the digest of the digests of the parts of the file followed
+// by the number of parts, as the ETag of an object uploaded in parts
+func partsMD5(file string, partSize int64) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	digests := md5.New()
+	parts := 0
+	for {
+		h := md5.New()
+		n, err := io.Copy(h, io.LimitReader(f, partSize))
+		if err != nil {
+			return "", err
+		}
+		if n == 0 && parts > 0 {
+			break
+		}
+		digests.Write(h.Sum(nil))
+		parts++
+		if n < partSize {
+			break
+		}
+	}
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(digests.Sum(nil)), parts), nil
+}
@@ -0,0 +1,337 @@
+package storage_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fgimenez/validator/pkg/seed"
+	"github.com/fgimenez/validator/pkg/storage"
+	"github.com/fgimenez/validator/pkg/storage/storagetest"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func setupBucket(t *testing.T) (*storagetest.Server, *storage.Bucket) {
+	fake := storagetest.New()
+	fake.Token = "secret"
+	fake.PageSize = 2
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	b := storage.NewBucket(server.URL, "spread", "images")
+	b.Token = "secret"
+	return fake, b
+}
+
+func keys(objects []*storage.Object) string {
+	var keys []string
+	for _, o := range objects {
+		keys = append(keys, o.Key)
+	}
+	return strings.Join(keys, ",")
+}
+
+// testBackend checks the behaviour common to all the backends
+func testBackend(t *testing.T, b storage.Backend) {
+	for _, key := range []string{"pi3-18-beta/pi3.img.xz", "pi3-18-beta/seed.manifest", "pi3-18-edge/seed.manifest", "pi3-180/seed.manifest"} {
+		if err := b.Put(key, strings.NewReader("content of "+key)); err != nil {
+			t.Fatalf("cannot put %s: %v", key, err)
+		}
+	}
+	if err := b.Put("pi3-18-beta/seed.manifest", strings.NewReader("snapd 1\n")); err != nil {
+		t.Fatalf("cannot replace object: %v", err)
+	}
+
+	var content bytes.Buffer
+	if err := b.Get("pi3-18-beta/seed.manifest", &content); err != nil || content.String() != "snapd 1\n" {
+		t.Errorf("expected replaced content, got %q, %v", content.String(), err)
+	}
+	if err := b.Get("pi3-18-beta/missing", &content); !storage.IsNotFound(err) {
+		t.Errorf("expected not found error, got %v", err)
+	}
+
+	objects, err := b.List("")
+	if err != nil {
+		t.Fatalf("cannot list: %v", err)
+	}
+	if k := keys(objects); k != "pi3-18-beta/pi3.img.xz,pi3-18-beta/seed.manifest,pi3-18-edge/seed.manifest,pi3-180/seed.manifest" {
+		t.Errorf("unexpected objects %s", k)
+	}
+	expected := &storage.Object{Key: "pi3-18-beta/seed.manifest", Size: 8, MD5: "94edc90498b2589986bfa4d516bd7e9b"}
+	if !reflect.DeepEqual(objects[1], expected) {
+		t.Errorf("expected %+v, got %+v", expected, objects[1])
+	}
+	objects, err = b.List("pi3-18-beta/")
+	if k := keys(objects); err != nil || k != "pi3-18-beta/pi3.img.xz,pi3-18-beta/seed.manifest" {
+		t.Errorf("unexpected objects with prefix %s, %v", k, err)
+	}
+
+	if err := b.Delete("pi3-18-edge/seed.manifest"); err != nil {
+		t.Errorf("cannot delete: %v", err)
+	}
+	if err := b.Delete("pi3-18-edge/seed.manifest"); !storage.IsNotFound(err) {
+		t.Errorf("expected not found error deleting twice, got %v", err)
+	}
+	if objects, _ := b.List("pi3-18-edge"); len(objects) != 0 {
+		t.Errorf("expected deleted object not to be listed, got %s", keys(objects))
+	}
+
+	for _, key := range []string{"", "/etc/passwd", "../escape", "a/../../b", "a//b", "a/./b"} {
+		if err := b.Put(key, strings.NewReader("")); err == nil || !strings.HasPrefix(err.Error(), "invalid key") {
+			t.Errorf("expected invalid key error for %q, got %v", key, err)
+		}
+	}
+}
+
+func TestLocal(t *testing.T) {
+	dir := tempDir(t)
+	l := storage.NewLocal(filepath.Join(dir, "images"))
+	if objects, err := l.List(""); err != nil || len(objects) != 0 {
+		t.Errorf("expected no objects before the first put, got %v, %v", objects, err)
+	}
+	testBackend(t, l)
+
+	if _, err := os.Stat(filepath.Join(dir, "images", "pi3-18-edge")); !os.IsNotExist(err) {
+		t.Errorf("expected empty directory to be removed, got %v", err)
+	}
+	if url := l.URL("pi3-18-beta/seed.manifest"); url != "file://"+filepath.Join(dir, "images", "pi3-18-beta", "seed.manifest") {
+		t.Errorf("unexpected URL %s", url)
+	}
+	l.BaseURL = "http://localhost:8000/"
+	if url := l.URL("pi3-18-beta/seed.manifest"); url != "http://localhost:8000/pi3-18-beta/seed.manifest" {
+		t.Errorf("unexpected URL %s", url)
+	}
+}
+
+func TestBucket(t *testing.T) {
+	fake, b := setupBucket(t)
+	testBackend(t, b)
+
+	if data, ok := fake.Object("spread", "images/pi3-18-beta/seed.manifest"); !ok || string(data) != "snapd 1\n" {
+		t.Errorf("expected object stored under the prefix, got %q", data)
+	}
+	if url := b.URL("pi3-18-beta/seed.manifest"); url != b.Endpoint+"/spread/images/pi3-18-beta/seed.manifest" {
+		t.Errorf("unexpected URL %s", url)
+	}
+
+	b.Token = "wrong"
+	err := b.Put("pi3-18-beta/seed.manifest", strings.NewReader(""))
+	if e, ok := err.(*storage.StatusError); !ok || e.Code != 401 || !strings.Contains(e.Error(), "AccessDenied") {
+		t.Errorf("expected unauthorized error, got %v", err)
+	}
+	if err := b.SetProxy("squid.internal"); err == nil {
+		t.Errorf("expected invalid proxy error")
+	}
+}
+
+func TestSigV4(t *testing.T) {
+	// get-vanilla of the test suite of the AWS signature version 4
+	signer := &storage.SigV4{AccessKey: "AKIDEXAMPLE", SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", Region: "us-east-1", Service: "service"}
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	req.Header.Set("X-Amz-Date", "20150830T123600Z")
+	if err := signer.Sign(req); err != nil {
+		t.Fatal(err)
+	}
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if auth := req.Header.Get("Authorization"); auth != expected {
+		t.Errorf("expected %s, got %s", expected, auth)
+	}
+
+	// S3 is told the bodies aren't signed
+	signer.Service = ""
+	req, _ = http.NewRequest("PUT", "https://s3.amazonaws.com/spread/a+b.img", strings.NewReader("image"))
+	if err := signer.Sign(req); err != nil {
+		t.Fatal(err)
+	}
+	if sha := req.Header.Get("X-Amz-Content-Sha256"); sha != "UNSIGNED-PAYLOAD" || req.Header.Get("X-Amz-Date") == "" {
+		t.Errorf("expected an unsigned payload signed now, got %q", sha)
+	}
+	if auth := req.Header.Get("Authorization"); !strings.Contains(auth, "/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date,") {
+		t.Errorf("unexpected authorization %s", auth)
+	}
+	if u := req.URL.String(); u != "https://s3.amazonaws.com/spread/a%2Bb.img" {
+		t.Errorf("expected the path to be sent as signed, got %s", u)
+	}
+
+	signer.SecretKey = ""
+	if err := signer.Sign(req); err == nil {
+		t.Errorf("expected an error without secret key")
+	}
+}
+
+func TestBucketSigV4(t *testing.T) {
+	fake, b := setupBucket(t)
+	keys := storage.SigV4{AccessKey: "access", SecretKey: "secret", Region: "auto"}
+	fake.SigV4 = &keys
+	signer := keys
+	b.Signer = &signer
+	testBackend(t, b)
+
+	if err := b.Put("pi3-18-beta/a+b=c.img.xz", strings.NewReader("image")); err != nil {
+		t.Fatalf("cannot put a key with reserved characters: %v", err)
+	}
+	if data, ok := fake.Object("spread", "images/pi3-18-beta/a+b=c.img.xz"); !ok || string(data) != "image" {
+		t.Errorf("expected the object to be stored, got %q", data)
+	}
+
+	signer.SecretKey = "wrong"
+	if _, err := b.List(""); err == nil {
+		t.Errorf("expected unauthorized error")
+	} else if e, ok := err.(*storage.StatusError); !ok || e.Code != 401 {
+		t.Errorf("expected unauthorized error, got %v", err)
+	}
+}
+
+func TestBucketParts(t *testing.T) {
+	fake, b := setupBucket(t)
+	fake.MaxObjectSize = 4
+	b.PartSize = 4
+	dir := tempDir(t)
+	file := filepath.Join(dir, "pi3.img.xz")
+	ioutil.WriteFile(file, []byte("compressed"), 0644)
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := b.Put("pi3-18-beta/pi3.img.xz", f); err != nil {
+		t.Fatalf("cannot put in parts: %v", err)
+	}
+	if data, _ := fake.Object("spread", "images/pi3-18-beta/pi3.img.xz"); string(data) != "compressed" {
+		t.Errorf("expected the parts to be joined, got %q", data)
+	}
+	if n := fake.Uploads(); n != 0 {
+		t.Errorf("expected the upload to be completed, got %d in progress", n)
+	}
+	if err := b.Put("pi3-18-beta/small", strings.NewReader("image")); err == nil {
+		t.Errorf("expected readers which aren't files to be put at once")
+	}
+
+	objects, err := b.List("pi3-18-beta/")
+	if err != nil || len(objects) != 1 || !strings.HasSuffix(objects[0].MD5, "-3") {
+		t.Fatalf("expected the digest of the 3 parts, got %+v, %v", objects, err)
+	}
+	result, err := storage.Sync(b, dir, "pi3-18-beta", false)
+	if err != nil || len(result.Unchanged) != 1 {
+		t.Errorf("expected the file uploaded in parts to be unchanged, got %+v, %v", result, err)
+	}
+	ioutil.WriteFile(file, []byte("compresses"), 0644)
+	result, err = storage.Sync(b, dir, "pi3-18-beta", false)
+	if err != nil || len(result.Uploaded) != 1 {
+		t.Errorf("expected the changed file to be uploaded, got %+v, %v", result, err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	b, err := storage.Open(storage.DefaultImages)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if url := b.URL("pi3-18-beta/" + seed.FileName); url != seed.URL("pi3-18-beta") {
+		t.Errorf("expected the published images at %s, got %s", seed.URL("pi3-18-beta"), url)
+	}
+
+	for _, tc := range []struct {
+		location string
+		expected storage.Backend
+	}{
+		{"images/output", storage.NewLocal("images/output")},
+		{"file:///srv/images", storage.NewLocal("/srv/images")},
+		{"http://localhost:4443/spread", storage.NewBucket("http://localhost:4443", "spread", "")},
+		{"https://storage.googleapis.com/spread/run/artifacts/", storage.NewBucket(storage.GCSEndpoint, "spread", "run/artifacts")},
+	} {
+		b, err := storage.Open(tc.location)
+		if err != nil {
+			t.Errorf("expected no error opening %s, got %v", tc.location, err)
+			continue
+		}
+		if b, ok := b.(*storage.Bucket); ok {
+			b.HTTP = nil
+			tc.expected.(*storage.Bucket).HTTP = nil
+		}
+		if !reflect.DeepEqual(b, tc.expected) {
+			t.Errorf("expected %+v for %s, got %+v", tc.expected, tc.location, b)
+		}
+	}
+
+	for _, location := range []string{"gs:///images", "https://storage.googleapis.com", "ftp://host/bucket"} {
+		if _, err := storage.Open(location); err == nil || !strings.HasPrefix(err.Error(), "invalid location") {
+			t.Errorf("expected invalid location error for %s, got %v", location, err)
+		}
+	}
+}
+
+func TestSync(t *testing.T) {
+	dir := tempDir(t)
+	write := func(name, content string) {
+		p := filepath.Join(dir, "output", filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("seed.manifest", "snapd 1\n")
+	write("pi3.img.xz", "image")
+	write("logs/build.log", "")
+
+	_, bucket := setupBucket(t)
+	for name, b := range map[string]storage.Backend{"local": storage.NewLocal(filepath.Join(dir, "published")), "bucket": bucket} {
+		t.Run(name, func(t *testing.T) {
+			b.Put("pi3-18-beta/old.img.xz", strings.NewReader("old"))
+			b.Put("pi3-18-beta/seed.manifest", strings.NewReader("snapd 1\n"))
+			b.Put("pi3-18-beta-other/seed.manifest", strings.NewReader(""))
+
+			result, err := storage.Sync(b, filepath.Join(dir, "output"), "pi3-18-beta", false)
+			if err != nil {
+				t.Fatalf("cannot sync: %v", err)
+			}
+			expected := &storage.SyncResult{
+				Uploaded:  []string{"pi3-18-beta/logs/build.log", "pi3-18-beta/pi3.img.xz"},
+				Unchanged: []string{"pi3-18-beta/seed.manifest"},
+			}
+			if !reflect.DeepEqual(result, expected) {
+				t.Errorf("expected %+v, got %+v", expected, result)
+			}
+
+			write("pi3.img.xz", "new image")
+			result, err = storage.Sync(b, filepath.Join(dir, "output"), "pi3-18-beta", true)
+			if err != nil {
+				t.Fatalf("cannot sync: %v", err)
+			}
+			expected = &storage.SyncResult{
+				Uploaded:  []string{"pi3-18-beta/pi3.img.xz"},
+				Deleted:   []string{"pi3-18-beta/old.img.xz"},
+				Unchanged: []string{"pi3-18-beta/logs/build.log", "pi3-18-beta/seed.manifest"},
+			}
+			if !reflect.DeepEqual(result, expected) {
+				t.Errorf("expected %+v, got %+v", expected, result)
+			}
+			var content bytes.Buffer
+			if err := b.Get("pi3-18-beta/pi3.img.xz", &content); err != nil || content.String() != "new image" {
+				t.Errorf("expected the new image, got %q, %v", content.String(), err)
+			}
+			if objects, _ := b.List("pi3-18-beta-other/"); len(objects) != 1 {
+				t.Errorf("expected objects out of the prefix to be kept, got %s", keys(objects))
+			}
+			write("pi3.img.xz", "image")
+		})
+	}
+
+	if _, err := storage.Sync(storage.NewLocal(dir), filepath.Join(dir, "missing"), "pi3-18-beta", true); !os.IsNotExist(err) {
+		t.Errorf("expected missing directory error, got %v", err)
+	}
+}
@@ -0,0 +1,280 @@
+// Package storagetest implements a fake bucket store serving the part of the
+// S3 API used by storage.Bucket, to be run with httptest
+package storagetest
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fgimenez/validator/pkg/storage"
+)
+
+// Server is a fake store holding the objects of any bucket in memory
+type Server struct {
+	// Token is the bearer token required by the requests, none when empty
+	Token string
+	// SigV4 holds the keys the requests have to be signed with instead of
+	// sending Token
+	SigV4 *storage.SigV4
+	// PageSize is the number of objects of each listing, 1000 when zero
+	PageSize int
+	// MaxObjectSize is the largest object accepted by a single PUT, bigger
+	// objects have to be uploaded in parts, no limit when zero
+	MaxObjectSize int
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	etags   map[string]string
+	// uploads are the parts of the multipart uploads in progress by id
+	uploads map[string]*upload
+	nextID  int
+}
+
+type upload struct {
+	path  string
+	parts map[int][]byte
+}
+
+// New returns a fake store without objects
+func New() *Server {
+	return &Server{objects: map[string][]byte{}, etags: map[string]string{}, uploads: map[string]*upload{}}
+}
+
+// authorized checks the token or the signature of the request, signing it
+// again at the time it was signed
+func (s *Server) authorized(r *http.Request) bool {
+	if s.SigV4 == nil {
+		return s.Token == "" || r.Header.Get("Authorization") == "Bearer "+s.Token
+	}
+	u := *r.URL
+	u.Scheme, u.Host = "http", r.Host
+	req, err := http.NewRequest(r.Method, u.String(), nil)
+	if err != nil {
+		return false
+	}
+	req.ContentLength = r.ContentLength
+	req.Header.Set("X-Amz-Date", r.Header.Get("X-Amz-Date"))
+	if err := s.SigV4.Sign(req); err != nil {
+		return false
+	}
+	return r.Header.Get("Authorization") == req.Header.Get("Authorization")
+}
+
+// Uploads returns the number of multipart uploads in progress
+func (s *Server) Uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploads)
+}
+
+// Object returns the content of the object stored with the given name in the
+// bucket
+func (s *Server) Object(bucket, name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[bucket+"/"+name]
+	return data, ok
+}
+
+type contents struct {
+	Key  string `xml:"Key"`
+	Size int    `xml:"Size"`
+	ETag string `xml:"ETag"`
+}
+
+type listing struct {
+	XMLName               xml.Name   `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string     `xml:"Name"`
+	Prefix                string     `xml:"Prefix"`
+	KeyCount              int        `xml:"KeyCount"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken,omitempty"`
+	Contents              []contents `xml:"Contents"`
+}
+
+// ServeHTTP implements the PUT, GET and DELETE of objects given as
+// /<bucket>/<name>, their multipart uploads and the listing of a bucket with
+// ListObjectsV2
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	query := r.URL.Query()
+	switch {
+	case r.Method == "GET" && path != "" && !strings.Contains(path, "/"):
+		s.list(w, r, path)
+	case strings.Contains(path, "/") && (query.Get("uploadId") != "" || r.Method == "POST"):
+		s.multipart(w, r, path)
+	case r.Method == "PUT" && strings.Contains(path, "/"):
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if s.MaxObjectSize > 0 && len(data) > s.MaxObjectSize {
+			http.Error(w, "<Error><Code>EntityTooLarge</Code></Error>", http.StatusBadRequest)
+			return
+		}
+		s.objects[path] = data
+		s.etags[path] = etag(data)
+		w.Header().Set("ETag", etag(data))
+	case r.Method == "GET" && strings.Contains(path, "/"):
+		data, ok := s.objects[path]
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case r.Method == "DELETE" && strings.Contains(path, "/"):
+		if _, ok := s.objects[path]; !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		delete(s.objects, path)
+		delete(s.etags, path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "<Error><Code>NotImplemented</Code></Error>", http.StatusNotImplemented)
+	}
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request, bucket string) {
+	query := r.URL.Query()
+	if query.Get("list-type") != "2" {
+		http.Error(w, "<Error><Code>NotImplemented</Code></Error>", http.StatusNotImplemented)
+		return
+	}
+	prefix := query.Get("prefix")
+	var names []string
+	for key := range s.objects {
+		if name := strings.TrimPrefix(key, bucket+"/"); name != key && strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	// the continuation token is the index of the first object of the page
+	start := 0
+	if token := query.Get("continuation-token"); token != "" {
+		var err error
+		if start, err = strconv.Atoi(token); err != nil || start > len(names) {
+			http.Error(w, "<Error><Code>InvalidArgument</Code></Error>", http.StatusBadRequest)
+			return
+		}
+	}
+	size := s.PageSize
+	if size == 0 {
+		size = 1000
+	}
+	l := listing{Name: bucket, Prefix: prefix}
+	for _, name := range names[start:] {
+		if len(l.Contents) == size {
+			l.IsTruncated = true
+			l.NextContinuationToken = strconv.Itoa(start + size)
+			break
+		}
+		data := s.objects[bucket+"/"+name]
+		l.Contents = append(l.Contents, contents{Key: name, Size: len(data), ETag: s.etags[bucket+"/"+name]})
+	}
+	l.KeyCount = len(l.Contents)
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(&l)
+}
+
+type initiateResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+type completeUpload struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+// multipart implements starting an upload with POST ?uploads, the PUT of its
+// parts with ?partNumber=<n>&uploadId=<id>, its completion with a POST and
+// its abortion with a DELETE with ?uploadId=<id>
+func (s *Server) multipart(w http.ResponseWriter, r *http.Request, path string) {
+	query := r.URL.Query()
+	if _, ok := query["uploads"]; ok && r.Method == "POST" {
+		s.nextID++
+		id := strconv.Itoa(s.nextID)
+		s.uploads[id] = &upload{path: path, parts: map[int][]byte{}}
+		parts := strings.SplitN(path, "/", 2)
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write([]byte(xml.Header))
+		xml.NewEncoder(w).Encode(&initiateResult{Bucket: parts[0], Key: parts[1], UploadID: id})
+		return
+	}
+	u, ok := s.uploads[query.Get("uploadId")]
+	if !ok || u.path != path {
+		http.Error(w, "<Error><Code>NoSuchUpload</Code></Error>", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case "PUT":
+		n, err := strconv.Atoi(query.Get("partNumber"))
+		if err != nil || n < 1 || n > 10000 {
+			http.Error(w, "<Error><Code>InvalidArgument</Code></Error>", http.StatusBadRequest)
+			return
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		u.parts[n] = data
+		w.Header().Set("ETag", etag(data))
+	case "POST":
+		var complete completeUpload
+		if err := xml.NewDecoder(r.Body).Decode(&complete); err != nil || len(complete.Parts) == 0 {
+			http.Error(w, "<Error><Code>MalformedXML</Code></Error>", http.StatusBadRequest)
+			return
+		}
+		var data []byte
+		digests := md5.New()
+		for i, p := range complete.Parts {
+			part, ok := u.parts[p.PartNumber]
+			if !ok || p.PartNumber != i+1 || p.ETag != etag(part) {
+				// answered with 200 as S3 and GCS do once the completion started
+				w.Write([]byte(xml.Header + "<Error><Code>InvalidPart</Code></Error>"))
+				return
+			}
+			data = append(data, part...)
+			sum := md5.Sum(part)
+			digests.Write(sum[:])
+		}
+		delete(s.uploads, query.Get("uploadId"))
+		s.objects[path] = data
+		s.etags[path] = `"` + hex.EncodeToString(digests.Sum(nil)) + "-" + strconv.Itoa(len(complete.Parts)) + `"`
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write([]byte(xml.Header + "<CompleteMultipartUploadResult><ETag>" + s.etags[path] + "</ETag></CompleteMultipartUploadResult>"))
+	case "DELETE":
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "<Error><Code>NotImplemented</Code></Error>", http.StatusNotImplemented)
+	}
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
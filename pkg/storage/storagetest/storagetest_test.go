@@ -0,0 +1,44 @@
+package storagetest_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fgimenez/validator/pkg/storage/storagetest"
+)
+
+func TestTokenRequired(t *testing.T) {
+	fake := storagetest.New()
+	fake.Token = "secret"
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	req, _ := http.NewRequest("PUT", server.URL+"/spread/seed.manifest", strings.NewReader("snapd 1\n"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the token to be required, got %s", resp.Status)
+	}
+	if _, ok := fake.Object("spread", "seed.manifest"); ok {
+		t.Errorf("expected the object not to be stored")
+	}
+}
+
+func TestListV1NotImplemented(t *testing.T) {
+	server := httptest.NewServer(storagetest.New())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/spread?prefix=images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("expected only ListObjectsV2 to be implemented, got %s", resp.Status)
+	}
+}
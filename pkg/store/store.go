@@ -0,0 +1,249 @@
+// Package store is a client of the snap store, used to find the revisions
+// released to the channels the images are built from
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults used by New
+const (
+	DefaultURL      = "https://api.snapcraft.io"
+	DefaultTimeout  = 30 * time.Second
+	DefaultCacheTTL = 5 * time.Minute
+)
+
+// Series is the series of the devices the store is asked about
+const Series = "16"
+
+// Client queries the store, the answers are cached for CacheTTL
+type Client struct {
+	// URL is the address of the store, ie https://api.snapcraft.io
+	URL  string
+	HTTP *http.Client
+	// CacheTTL is how long answers are reused, nothing is cached when zero
+	CacheTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*entry
+}
+
+type entry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// New returns a client of the store at the given URL with the default
+// timeout and cache, the proxy is taken from the environment
+func New(url string) *Client {
+	return &Client{
+		URL:      strings.TrimSuffix(url, "/"),
+		HTTP:     &http.Client{Timeout: DefaultTimeout, Transport: &http.Transport{Proxy: http.ProxyFromEnvironment}},
+		CacheTTL: DefaultCacheTTL,
+	}
+}
+
+// SetProxy makes the client reach the store through the proxy at the given
+// URL, ie http://squid.internal:3128
+func (c *Client) SetProxy(proxy string) error {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return fmt.Errorf("invalid proxy %q: %v", proxy, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid proxy %q: expected <scheme>://<host>[:<port>]", proxy)
+	}
+	c.HTTP.Transport = &http.Transport{Proxy: http.ProxyURL(u)}
+	return nil
+}
+
+// StatusError is returned when the store answers with an unexpected status
+type StatusError struct {
+	URL  string
+	Code int
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("GET %s: %d %s: %s", e.URL, e.Code, http.StatusText(e.Code), strings.TrimSpace(e.Body))
+}
+
+// IsNotFound returns true when the error is caused by a snap, or a channel of
+// it, unknown to the store
+func IsNotFound(err error) bool {
+	e, ok := err.(*StatusError)
+	return ok && e.Code == http.StatusNotFound
+}
+
+// Release is a revision released to a channel for an architecture
+type Release struct {
+	Architecture string
+	// Channel is the full name of the channel, <track>/<risk>[/<branch>]
+	Channel  string
+	Revision int
+	Version  string
+}
+
+// ChannelMap holds the releases of a snap for all the architectures
+type ChannelMap []*Release
+
+// Find returns the release of the channel for the given architecture, the
+// channel can omit the latest track
+func (m ChannelMap) Find(channel, arch string) *Release {
+	channel = FullChannel(channel)
+	for _, r := range m {
+		if r.Channel == channel && r.Architecture == arch {
+			return r
+		}
+	}
+	return nil
+}
+
+// FullChannel returns the channel with the track, edge is latest/edge and
+// edge/fix-1 latest/edge/fix-1
+func FullChannel(channel string) string {
+	switch parts := strings.Split(channel, "/"); {
+	case len(parts) == 1:
+		return "latest/" + channel
+	case len(parts) == 2 && isRisk(parts[0]):
+		return "latest/" + channel
+	}
+	return channel
+}
+
+func isRisk(s string) bool {
+	switch s {
+	case "stable", "candidate", "beta", "edge":
+		return true
+	}
+	return false
+}
+
+type details struct {
+	Revision int `json:"revision"`
+}
+
+type info struct {
+	ChannelMap []struct {
+		Channel struct {
+			Architecture string `json:"architecture"`
+			Track        string `json:"track"`
+			Risk         string `json:"risk"`
+			Branch       string `json:"branch"`
+		} `json:"channel"`
+		Revision int    `json:"revision"`
+		Version  string `json:"version"`
+	} `json:"channel-map"`
+}
+
+// Revision returns the revision of the snap released to the channel for the
+// given architecture
+func (c *Client) Revision(name, channel, arch string) (int, error) {
+	key := strings.Join([]string{"revision", name, channel, arch}, " ")
+	if v, ok := c.cached(key); ok {
+		return v.(int), nil
+	}
+	endpoint := fmt.Sprintf("/api/v1/snaps/details/%s?channel=%s", url.PathEscape(name), url.QueryEscape(channel))
+	data, err := c.get(endpoint, map[string]string{
+		"X-Ubuntu-Series":       Series,
+		"X-Ubuntu-Architecture": arch,
+	})
+	if err != nil {
+		return 0, err
+	}
+	var d details
+	if err := json.Unmarshal(data, &d); err != nil {
+		return 0, fmt.Errorf("cannot decode details of %s: %v", name, err)
+	}
+	if d.Revision <= 0 {
+		return 0, fmt.Errorf("invalid revision %d of %s in %s for %s", d.Revision, name, channel, arch)
+	}
+	c.store(key, d.Revision)
+	return d.Revision, nil
+}
+
+// ChannelMap returns the releases of the snap in all its channels and
+// architectures
+func (c *Client) ChannelMap(name string) (ChannelMap, error) {
+	key := "channel-map " + name
+	if v, ok := c.cached(key); ok {
+		return v.(ChannelMap), nil
+	}
+	endpoint := fmt.Sprintf("/v2/snaps/info/%s?fields=revision,version", url.PathEscape(name))
+	data, err := c.get(endpoint, map[string]string{"Snap-Device-Series": Series})
+	if err != nil {
+		return nil, err
+	}
+	var i info
+	if err := json.Unmarshal(data, &i); err != nil {
+		return nil, fmt.Errorf("cannot decode info of %s: %v", name, err)
+	}
+	var m ChannelMap
+	for _, item := range i.ChannelMap {
+		channel := item.Channel.Track + "/" + item.Channel.Risk
+		if item.Channel.Branch != "" {
+			channel += "/" + item.Channel.Branch
+		}
+		m = append(m, &Release{
+			Architecture: item.Channel.Architecture,
+			Channel:      channel,
+			Revision:     item.Revision,
+			Version:      item.Version,
+		})
+	}
+	c.store(key, m)
+	return m, nil
+}
+
+func (c *Client) cached(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.cache[key]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false
+	}
+	return e.value, true
+}
+
+func (c *Client) store(key string, value interface{}) {
+	if c.CacheTTL <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cache == nil {
+		c.cache = map[string]*entry{}
+	}
+	c.cache[key] = &entry{value: value, expires: time.Now().Add(c.CacheTTL)}
+}
+
+func (c *Client) get(endpoint string, headers map[string]string) ([]byte, error) {
+	u := c.URL + endpoint
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{URL: u, Code: resp.StatusCode, Body: string(data)}
+	}
+	return data, nil
+}
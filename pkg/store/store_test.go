@@ -0,0 +1,141 @@
+package store_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/fgimenez/validator/pkg/store"
+	"github.com/fgimenez/validator/pkg/store/storetest"
+)
+
+func setup(t *testing.T) (*storetest.Store, *store.Client) {
+	fake := storetest.New()
+	fake.Release("core18", "edge", "amd64", 1754)
+	fake.Release("core18", "edge", "armhf", 1755)
+	fake.Release("core18", "stable", "amd64", 1705)
+	fake.Release("pc-kernel", "18/beta", "amd64", 449)
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, store.New(server.URL)
+}
+
+func TestRevision(t *testing.T) {
+	fake, client := setup(t)
+	for _, tc := range []struct {
+		name, channel, arch string
+		expected            int
+	}{
+		{"core18", "edge", "amd64", 1754},
+		{"core18", "latest/edge", "armhf", 1755},
+		{"core18", "stable", "amd64", 1705},
+		{"pc-kernel", "18/beta", "amd64", 449},
+	} {
+		revision, err := client.Revision(tc.name, tc.channel, tc.arch)
+		if err != nil || revision != tc.expected {
+			t.Errorf("expected revision %d of %s in %s for %s, got %d, %v", tc.expected, tc.name, tc.channel, tc.arch, revision, err)
+		}
+	}
+
+	_, err := client.Revision("core18", "beta", "amd64")
+	if !store.IsNotFound(err) {
+		t.Errorf("expected not found error, got %v", err)
+	}
+	if store.IsNotFound(nil) {
+		t.Errorf("expected nil not to be a not found error")
+	}
+	if requests := fake.Requests(); requests != 5 {
+		t.Errorf("expected 5 requests, got %d", requests)
+	}
+}
+
+func TestCache(t *testing.T) {
+	fake, client := setup(t)
+	for i := 0; i < 3; i++ {
+		client.Revision("core18", "edge", "amd64")
+		client.ChannelMap("core18")
+	}
+	if requests := fake.Requests(); requests != 2 {
+		t.Errorf("expected 2 requests with the cache, got %d", requests)
+	}
+
+	// a new release isn't seen until the answer expires
+	fake.Release("core18", "edge", "amd64", 1800)
+	if revision, _ := client.Revision("core18", "edge", "amd64"); revision != 1754 {
+		t.Errorf("expected the cached revision, got %d", revision)
+	}
+	client = store.New(client.URL)
+	client.CacheTTL = 0
+	for i := 0; i < 2; i++ {
+		if revision, _ := client.Revision("core18", "edge", "amd64"); revision != 1800 {
+			t.Errorf("expected the new revision, got %d", revision)
+		}
+	}
+	if requests := fake.Requests(); requests != 4 {
+		t.Errorf("expected 4 requests without the cache, got %d", requests)
+	}
+}
+
+func TestChannelMap(t *testing.T) {
+	_, client := setup(t)
+	m, err := client.ChannelMap("core18")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected := store.ChannelMap{
+		{Architecture: "amd64", Channel: "latest/edge", Revision: 1754, Version: "1.0"},
+		{Architecture: "armhf", Channel: "latest/edge", Revision: 1755, Version: "1.0"},
+		{Architecture: "amd64", Channel: "latest/stable", Revision: 1705, Version: "1.0"},
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("expected %v, got %v", expected, m)
+	}
+	if r := m.Find("edge", "armhf"); r == nil || r.Revision != 1755 {
+		t.Errorf("expected the armhf release in edge, got %+v", r)
+	}
+	if r := m.Find("beta", "armhf"); r != nil {
+		t.Errorf("expected no release in beta, got %+v", r)
+	}
+
+	if _, err := client.ChannelMap("unknown"); !store.IsNotFound(err) {
+		t.Errorf("expected not found error, got %v", err)
+	}
+}
+
+func TestFullChannel(t *testing.T) {
+	for channel, expected := range map[string]string{
+		"edge":          "latest/edge",
+		"edge/fix-1":    "latest/edge/fix-1",
+		"18/edge":       "18/edge",
+		"latest/stable": "latest/stable",
+		"18/edge/fix-1": "18/edge/fix-1",
+	} {
+		if full := store.FullChannel(channel); full != expected {
+			t.Errorf("expected %s for %s, got %s", expected, channel, full)
+		}
+	}
+}
+
+func TestProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		w.Write([]byte(`{"revision": 7}`))
+	}))
+	defer proxy.Close()
+
+	client := store.New("http://store.invalid")
+	if err := client.SetProxy(proxy.URL); err != nil {
+		t.Fatal(err)
+	}
+	if revision, err := client.Revision("snapd", "edge", "amd64"); err != nil || revision != 7 {
+		t.Errorf("expected the revision through the proxy, got %d, %v", revision, err)
+	}
+	if proxied != "http://store.invalid/api/v1/snaps/details/snapd?channel=edge" {
+		t.Errorf("unexpected proxied request %s", proxied)
+	}
+	if err := client.SetProxy("squid.internal"); err == nil {
+		t.Errorf("expected error for a proxy without scheme")
+	}
+}
@@ -0,0 +1,136 @@
+// Package storetest implements a fake snap store serving the endpoints used
+// by the store package, to be run with httptest
+package storetest
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fgimenez/validator/pkg/store"
+)
+
+// Store is a fake store, snaps are only known once released
+type Store struct {
+	mu       sync.Mutex
+	releases map[string][]*store.Release
+	requests int
+}
+
+// New returns a fake store without snaps
+func New() *Store {
+	return &Store{releases: map[string][]*store.Release{}}
+}
+
+// Release makes the revision of the snap available in the channel for the
+// given architecture, replacing the previous one
+func (s *Store) Release(name, channel, arch string, revision int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	channel = store.FullChannel(channel)
+	for _, r := range s.releases[name] {
+		if r.Channel == channel && r.Architecture == arch {
+			r.Revision = revision
+			return
+		}
+	}
+	s.releases[name] = append(s.releases[name], &store.Release{
+		Architecture: arch,
+		Channel:      channel,
+		Revision:     revision,
+		Version:      "1.0",
+	})
+}
+
+// Requests returns the number of requests handled so far
+func (s *Store) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// ServeHTTP implements the details and info endpoints of the store
+func (s *Store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+
+	switch {
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/api/v1/snaps/details/"):
+		s.details(w, r, strings.TrimPrefix(r.URL.Path, "/api/v1/snaps/details/"))
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/v2/snaps/info/"):
+		s.info(w, r, strings.TrimPrefix(r.URL.Path, "/v2/snaps/info/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Store) details(w http.ResponseWriter, r *http.Request, name string) {
+	arch := r.Header.Get("X-Ubuntu-Architecture")
+	if r.Header.Get("X-Ubuntu-Series") != store.Series || arch == "" {
+		http.Error(w, "X-Ubuntu-Series and X-Ubuntu-Architecture are required", http.StatusBadRequest)
+		return
+	}
+	channel := r.URL.Query().Get("channel")
+	if channel == "" {
+		channel = "stable"
+	}
+	channel = store.FullChannel(channel)
+	for _, release := range s.releases[name] {
+		if release.Channel == channel && release.Architecture == arch {
+			writeJSON(w, map[string]interface{}{
+				"name":     name,
+				"revision": release.Revision,
+				"version":  release.Version,
+				"channel":  channel,
+			})
+			return
+		}
+	}
+	http.Error(w, `{"error_list": [{"code": "resource-not-found"}]}`, http.StatusNotFound)
+}
+
+func (s *Store) info(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Header.Get("Snap-Device-Series") != store.Series {
+		http.Error(w, "Snap-Device-Series is required", http.StatusBadRequest)
+		return
+	}
+	releases, ok := s.releases[name]
+	if !ok {
+		http.Error(w, `{"error-list": [{"code": "resource-not-found"}]}`, http.StatusNotFound)
+		return
+	}
+	releases = append([]*store.Release(nil), releases...)
+	sort.SliceStable(releases, func(i, j int) bool {
+		if releases[i].Channel != releases[j].Channel {
+			return releases[i].Channel < releases[j].Channel
+		}
+		return releases[i].Architecture < releases[j].Architecture
+	})
+	var channelMap []interface{}
+	for _, release := range releases {
+		parts := strings.SplitN(release.Channel, "/", 3)
+		channel := map[string]string{
+			"architecture": release.Architecture,
+			"name":         release.Channel,
+			"track":        parts[0],
+			"risk":         parts[1],
+		}
+		if len(parts) == 3 {
+			channel["branch"] = parts[2]
+		}
+		channelMap = append(channelMap, map[string]interface{}{
+			"channel":  channel,
+			"revision": release.Revision,
+			"version":  release.Version,
+		})
+	}
+	writeJSON(w, map[string]interface{}{"name": name, "channel-map": channelMap})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
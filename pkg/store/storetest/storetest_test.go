@@ -0,0 +1,55 @@
+package storetest_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fgimenez/validator/pkg/store/storetest"
+)
+
+func TestHeadersRequired(t *testing.T) {
+	fake := storetest.New()
+	fake.Release("snapd", "edge", "amd64", 1)
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	for _, path := range []string{"/api/v1/snaps/details/snapd?channel=edge", "/v2/snaps/info/snapd"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected %s to require the series headers, got %s", path, resp.Status)
+		}
+	}
+}
+
+func TestReleaseReplaces(t *testing.T) {
+	fake := storetest.New()
+	fake.Release("snapd", "edge", "amd64", 1)
+	fake.Release("snapd", "latest/edge", "amd64", 2)
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/v2/snaps/info/snapd", nil)
+	req.Header.Set("Snap-Device-Series", "16")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var info struct {
+		ChannelMap []struct {
+			Revision int `json:"revision"`
+		} `json:"channel-map"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if len(info.ChannelMap) != 1 || info.ChannelMap[0].Revision != 2 {
+		t.Errorf("expected the release to be replaced, got %+v", info.ChannelMap)
+	}
+}
@@ -0,0 +1,97 @@
+package testflinger
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/fgimenez/validator/pkg/types"
+)
+
+// Command is the name of the testflinger command line client
+const Command = "testflinger-cli"
+
+// Job states after which a job doesn't change anymore
+const (
+	StateComplete  = "complete"
+	StateCancelled = "cancelled"
+)
+
+// Job states of a job waiting for a device and of a job keeping its device
+// reserved
+const (
+	StateWaiting = "waiting"
+	StateReserve = "reserve"
+)
+
+// Client manages jobs in a testflinger server through the command line client
+type Client struct {
+	Cli types.Cli
+}
+
+// Finished returns true if the given job state is a final one
+func Finished(state string) bool {
+	return state == StateComplete || state == StateCancelled
+}
+
+// Submit sends the given job definition file and returns the job id, the job
+// is already written to cfg so only the file is needed by the command
+func (c *Client) Submit(cfg string, job *Job) (string, error) {
+	output, err := c.Cli.ExecCommand(Command, "submit", "--quiet", cfg)
+	if err != nil {
+		return "", fmt.Errorf("cannot submit %s: %v: %s", cfg, err, output)
+	}
+	id := lastLine(output)
+	if id == "" {
+		return "", fmt.Errorf("cannot submit %s: no job id returned", cfg)
+	}
+	return id, nil
+}
+
+// Status returns the current state of the given job
+func (c *Client) Status(id string) (string, error) {
+	output, err := c.Cli.ExecCommand(Command, "status", id)
+	if err != nil {
+		return "", fmt.Errorf("cannot get status of job %s: %v: %s", id, err, output)
+	}
+	return lastLine(output), nil
+}
+
+// Results returns the outcome of the given job
+func (c *Client) Results(id string) (*types.Results, error) {
+	// warnings in the standard error would break decoding
+	output, err := c.Cli.OutputCommand(Command, "results", id)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get results of job %s: %v", id, err)
+	}
+	var results types.Results
+	if err := json.Unmarshal([]byte(output), &results); err != nil {
+		return nil, fmt.Errorf("cannot decode results of job %s: %v", id, err)
+	}
+	return &results, nil
+}
+
+// Output returns the output produced by the given job since the last call
+func (c *Client) Output(id string) (string, error) {
+	output, err := c.Cli.ExecCommand(Command, "poll", "--oneshot", id)
+	if err != nil {
+		return "", fmt.Errorf("cannot get output of job %s: %v: %s", id, err, output)
+	}
+	return output, nil
+}
+
+// Cancel stops the given job
+func (c *Client) Cancel(id string) error {
+	output, err := c.Cli.ExecCommand(Command, "cancel", id)
+	if err != nil {
+		return fmt.Errorf("cannot cancel job %s: %v: %s", id, err, output)
+	}
+	return nil
+}
+
+// lastLine returns the last non empty line of the given output, the command
+// line client may print warnings before the relevant information
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
@@ -0,0 +1,123 @@
+package testflinger_test
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/fgimenez/validator/pkg/testflinger"
+)
+
+// fakeCli returns the output of the commands, preceded by the warning written
+// to the standard error when it is combined
+type fakeCli struct {
+	output  string
+	warning string
+	err     error
+	calls   [][]string
+}
+
+func (fc *fakeCli) ExecCommand(cmds ...string) (string, error) {
+	fc.calls = append(fc.calls, cmds)
+	return fc.warning + fc.output, fc.err
+}
+
+func (fc *fakeCli) OutputCommand(cmds ...string) (string, error) {
+	fc.calls = append(fc.calls, cmds)
+	return fc.output, fc.err
+}
+
+func (fc *fakeCli) StreamCommand(w io.Writer, cmds ...string) error {
+	output, err := fc.ExecCommand(cmds...)
+	io.WriteString(w, output)
+	return err
+}
+
+func TestClient(t *testing.T) {
+	t.Run("submit returns the job id", func(t *testing.T) {
+		cli := &fakeCli{output: "some warning\nmyjobid\n"}
+		subject := &testflinger.Client{Cli: cli}
+		id, err := subject.Submit("mycfg", &testflinger.Job{Queue: "myqueue"})
+		if err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+		if id != "myjobid" {
+			t.Errorf("expected job id myjobid, got %q", id)
+		}
+		expected := "testflinger-cli submit --quiet mycfg"
+		if strings.Join(cli.calls[0], " ") != expected {
+			t.Errorf("expected call %q, got %v", expected, cli.calls[0])
+		}
+	})
+	t.Run("submit error", func(t *testing.T) {
+		subject := &testflinger.Client{Cli: &fakeCli{output: "bad queue", err: errors.New("exit status 1")}}
+		if _, err := subject.Submit("mycfg", &testflinger.Job{Queue: "myqueue"}); err == nil || !strings.Contains(err.Error(), "bad queue") {
+			t.Errorf("expected error including the output, got %v", err)
+		}
+	})
+	t.Run("submit without job id", func(t *testing.T) {
+		subject := &testflinger.Client{Cli: &fakeCli{output: "\n"}}
+		if _, err := subject.Submit("mycfg", &testflinger.Job{Queue: "myqueue"}); err == nil {
+			t.Error("expected error for empty output")
+		}
+	})
+	t.Run("status returns the job state", func(t *testing.T) {
+		subject := &testflinger.Client{Cli: &fakeCli{output: "provision\n"}}
+		state, err := subject.Status("myjobid")
+		if err != nil || state != "provision" {
+			t.Errorf("expected provision state, got %q, %v", state, err)
+		}
+	})
+	t.Run("results are decoded", func(t *testing.T) {
+		subject := &testflinger.Client{Cli: &fakeCli{output: `{"job_state": "complete", "provision_status": 0, "test_status": 1, "test_output": "fail"}`}}
+		results, err := subject.Results("myjobid")
+		if err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+		if results.JobState != "complete" || results.TestStatus != 1 || results.TestOutput != "fail" {
+			t.Errorf("unexpected results %+v", results)
+		}
+	})
+	t.Run("results ignore warnings", func(t *testing.T) {
+		cli := &fakeCli{output: `{"job_state": "complete"}`, warning: "warning: insecure connection\n"}
+		subject := &testflinger.Client{Cli: cli}
+		results, err := subject.Results("myjobid")
+		if err != nil || results.JobState != "complete" {
+			t.Errorf("expected the results without the warning, got %+v, %v", results, err)
+		}
+		if strings.Join(cli.calls[0], " ") != "testflinger-cli results myjobid" {
+			t.Errorf("unexpected call %v", cli.calls[0])
+		}
+	})
+	t.Run("undecodable results", func(t *testing.T) {
+		subject := &testflinger.Client{Cli: &fakeCli{output: "not json"}}
+		if _, err := subject.Results("myjobid"); err == nil {
+			t.Error("expected decoding error")
+		}
+	})
+	t.Run("cancel", func(t *testing.T) {
+		cli := &fakeCli{}
+		subject := &testflinger.Client{Cli: cli}
+		if err := subject.Cancel("myjobid"); err != nil {
+			t.Errorf("expected nil error, got %v", err)
+		}
+		if strings.Join(cli.calls[0], " ") != "testflinger-cli cancel myjobid" {
+			t.Errorf("unexpected call %v", cli.calls[0])
+		}
+	})
+}
+
+func TestFinished(t *testing.T) {
+	for state, expected := range map[string]bool{
+		"":          false,
+		"waiting":   false,
+		"test":      false,
+		"complete":  true,
+		"cancelled": true,
+	} {
+		if testflinger.Finished(state) != expected {
+			t.Errorf("expected Finished(%q) to be %v", state, expected)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package testflinger
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Job is the definition of a testflinger job
+type Job struct {
+	Queue string
+	// GlobalTimeout is the number of seconds after which testflinger stops
+	// the job, the lab default applies when zero
+	GlobalTimeout int
+	ProvisionData []Field
+	Attachments   []Attachment
+	TestCmds      []string
+	ReserveData   *ReserveData
+}
+
+// ReserveData tells testflinger to keep the device reserved once the test
+// commands are run, allowing access with the given keys, ie lp:user
+type ReserveData struct {
+	SSHKeys []string
+	Timeout int
+}
+
+// Field is a key and value pair of a job section, fields are kept in a slice
+// so that the generated definitions are stable
+type Field struct {
+	Key   string
+	Value string
+}
+
+// Attachment is a local file sent along with the job, the agent makes it
+// available to the test commands under AttachmentsDir
+type Attachment struct {
+	Local string
+	Agent string
+}
+
+// AttachmentsDir is where the agent places the attachments of the test phase
+const AttachmentsDir = "attachments/test"
+
+// Marshal returns the YAML representation of the job
+func (j *Job) Marshal() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "job_queue: %s\n", scalar(j.Queue))
+	if j.GlobalTimeout != 0 {
+		fmt.Fprintf(&b, "global_timeout: %d\n", j.GlobalTimeout)
+	}
+	if len(j.ProvisionData) != 0 {
+		fmt.Fprintf(&b, "provision_data:\n")
+		for _, field := range j.ProvisionData {
+			fmt.Fprintf(&b, "    %s: %s\n", field.Key, scalar(field.Value))
+		}
+	}
+	fmt.Fprintf(&b, "test_data:\n")
+	if len(j.Attachments) != 0 {
+		fmt.Fprintf(&b, "    attachments:\n")
+		for _, attachment := range j.Attachments {
+			fmt.Fprintf(&b, "        - local: %s\n", scalar(attachment.Local))
+			fmt.Fprintf(&b, "          agent: %s\n", scalar(attachment.Agent))
+		}
+	}
+	fmt.Fprintf(&b, "    test_cmds:\n")
+	for _, cmd := range j.TestCmds {
+		fmt.Fprintf(&b, "        - %s\n", scalar(cmd))
+	}
+	if j.ReserveData != nil {
+		fmt.Fprintf(&b, "reserve_data:\n")
+		fmt.Fprintf(&b, "    ssh_keys:\n")
+		for _, key := range j.ReserveData.SSHKeys {
+			fmt.Fprintf(&b, "        - %s\n", scalar(key))
+		}
+		fmt.Fprintf(&b, "    timeout: %d\n", j.ReserveData.Timeout)
+	}
+	return b.Bytes()
+}
+
+// scalar returns the given value as a YAML scalar, quoted only when it could
+// be read as something else than a plain string
+func scalar(value string) string {
+	if value == "" ||
+		strings.ContainsAny(value[:1], "-?:,[]{}#&*!|>'\"%@` ") ||
+		strings.HasSuffix(value, " ") ||
+		strings.HasSuffix(value, ":") ||
+		strings.Contains(value, ": ") ||
+		strings.Contains(value, " #") ||
+		strings.ContainsAny(value, "\n\t\\") {
+		return strconv.Quote(value)
+	}
+	switch strings.ToLower(value) {
+	case "true", "false", "yes", "no", "on", "off", "null", "~":
+		return strconv.Quote(value)
+	}
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return strconv.Quote(value)
+	}
+	return value
+}
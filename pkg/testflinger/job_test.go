@@ -0,0 +1,76 @@
+package testflinger_test
+
+import (
+	"testing"
+
+	"github.com/fgimenez/validator/pkg/testflinger"
+)
+
+func TestMarshal(t *testing.T) {
+	job := &testflinger.Job{
+		Queue:         "myqueue",
+		ProvisionData: []testflinger.Field{{Key: "channel", Value: "20/edge"}},
+		Attachments:   []testflinger.Attachment{{Local: "/tmp/my snap.snap", Agent: "my snap.snap"}},
+		TestCmds:      []string{"echo hello", "echo key: value", "- starts with dash"},
+	}
+	expected := `job_queue: myqueue
+provision_data:
+    channel: 20/edge
+test_data:
+    attachments:
+        - local: /tmp/my snap.snap
+          agent: my snap.snap
+    test_cmds:
+        - echo hello
+        - "echo key: value"
+        - "- starts with dash"
+`
+	if content := string(job.Marshal()); content != expected {
+		t.Errorf("unexpected job definition, actual %s, expected %s", content, expected)
+	}
+
+	t.Run("values which are not plain strings are quoted", func(t *testing.T) {
+		for value, expected := range map[string]string{
+			"":               `""`,
+			"true":           `"true"`,
+			"No":             `"No"`,
+			"1234":           `"1234"`,
+			"1e3":            `"1e3"`,
+			"{device_ip}":    `"{device_ip}"`,
+			"a # comment":    `"a # comment"`,
+			"ends with:":     `"ends with:"`,
+			"two\nlines":     `"two\nlines"`,
+			"ip {device_ip}": "ip {device_ip}",
+		} {
+			job := &testflinger.Job{Queue: value}
+			content := string(job.Marshal())
+			if content[:len("job_queue: ")+len(expected)+1] != "job_queue: "+expected+"\n" {
+				t.Errorf("expected %q to be marshaled as %s, got %s", value, expected, content)
+			}
+		}
+	})
+}
+
+func TestMarshalReserveData(t *testing.T) {
+	job := &testflinger.Job{
+		Queue:         "myqueue",
+		ProvisionData: []testflinger.Field{{Key: "channel", Value: "edge"}},
+		TestCmds:      []string{"echo hello"},
+		ReserveData:   &testflinger.ReserveData{SSHKeys: []string{"lp:me", "gh:me"}, Timeout: 3600},
+	}
+	expected := `job_queue: myqueue
+provision_data:
+    channel: edge
+test_data:
+    test_cmds:
+        - echo hello
+reserve_data:
+    ssh_keys:
+        - lp:me
+        - gh:me
+    timeout: 3600
+`
+	if content := string(job.Marshal()); content != expected {
+		t.Errorf("unexpected job definition, actual %s, expected %s", content, expected)
+	}
+}
@@ -3,62 +3,237 @@ package testflinger
 import (
 	"fmt"
 	"io/ioutil"
-	"log"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/fgimenez/validator/pkg/types"
 )
 
 const (
-	FromTargetFmt = `job_queue: %s
-provision_data:
-    channel: %s
-test_data:
-    test_cmds:
-        - sudo apt update && sudo apt install -y git curl
-        - git clone https://github.com/snapcore/snapd
-        - curl -s -O https://niemeyer.s3.amazonaws.com/spread-amd64.tar.gz && tar xzvf spread-amd64.tar.gz
-        - snapd/tests/lib/external/prepare-ssh.sh {device_ip} 22 ubuntu
-        - cd snapd && export SPREAD_EXTERNAL_ADDRESS={device_ip}:22 && git checkout %s && ../spread -v %s
-`
-	FromStableFmt = `job_queue: %s
-provision_data:
-    channel: stable
-test_data:
-    test_cmds:
-        - sudo apt update && sudo apt install -y git curl
-        - git clone https://github.com/snapcore/snapd
-        - curl -s -O https://niemeyer.s3.amazonaws.com/spread-amd64.tar.gz && tar xzvf spread-amd64.tar.gz
-        - snapd/tests/lib/external/prepare-ssh.sh {device_ip} 22 ubuntu
-        - ssh -q -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no ubuntu@{device_ip} sudo snap refresh --%s core
-        - cd snapd && export SPREAD_EXTERNAL_ADDRESS={device_ip}:22 && git checkout %s && ../spread -v %s
-`
+	// sshCmd runs the command that follows it in the device under test
+	sshCmd = "ssh -q -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no ubuntu@{device_ip}"
+	scpCmd = "scp -q -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no"
+
+	// waitChangesFmt waits up to 10 minutes for the changes in the device
+	// to finish, the device may reboot meanwhile so failed connections are retried
+	waitChangesFmt = "for i in $(seq 60); do sleep 10; if %s snap changes > changes.out; then grep -Eq ' (Do|Doing|Undo|Undoing|Wait) ' changes.out || break; fi; [ $i -lt 60 ] || exit 1; done"
 )
 
 type Testflinger struct{}
 
-func (t *Testflinger) GenerateCfg(options *types.Options, input [][]string) []string {
-	var result []string
-
-	var tpl string
-	if options.From == "stable" {
-		tpl = FromStableFmt
-	} else {
-		tpl = FromTargetFmt
+// GenerateCfg writes the job definitions of the given buckets to the output
+// directory of the options, or to a new temporary one when not set, and
+// returns their paths. On error the files written are removed
+func (t *Testflinger) GenerateCfg(options *types.Options, input []*types.Bucket) (result []string, err error) {
+	if len(input) == 0 {
+		return nil, nil
 	}
 
-	for _, item := range input {
-		mergedLines := strings.Join(item, " ")
-		content := []byte(fmt.Sprintf(tpl, options.Queue, options.Channel, options.Release, mergedLines))
+	dir := options.OutputDir
+	if dir == "" {
+		if dir, err = ioutil.TempDir("", "tpr-"); err != nil {
+			return nil, fmt.Errorf("cannot create output directory: %v", err)
+		}
+		defer func() {
+			if err != nil {
+				os.RemoveAll(dir)
+			}
+		}()
+	} else if err = os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create output directory: %v", err)
+	}
 
-		tmpfile, _ := ioutil.TempFile("", "")
-		if _, err := tmpfile.Write(content); err != nil {
-			log.Fatal(err)
+	defer func() {
+		if err != nil {
+			for _, path := range result {
+				os.Remove(path)
+			}
+			result = nil
 		}
-		if err := tmpfile.Close(); err != nil {
-			log.Fatal(err)
+	}()
+	for _, bucket := range input {
+		path := filepath.Join(dir, CfgName(bucket))
+		if err = ioutil.WriteFile(path, NewJob(options, bucket).Marshal(), 0644); err != nil {
+			return result, fmt.Errorf("cannot write job definition: %v", err)
 		}
-		result = append(result, tmpfile.Name())
+		result = append(result, path)
+	}
+	return result, nil
+}
+
+// CfgName returns the name of the file with the job definition of the given
+// bucket, <system>-<bucket>.yaml with the characters of the system which are
+// not safe in file names replaced
+func CfgName(bucket *types.Bucket) string {
+	system := unsafeRe.ReplaceAllString(bucket.System, "_")
+	return fmt.Sprintf("%s-%d.yaml", system, bucket.Index)
+}
+
+var unsafeRe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// WriteTemp writes the definition of the given job to a temporary file and
+// returns its path
+func WriteTemp(job *Job) (string, error) {
+	tmpfile, err := ioutil.TempFile("", "")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmpfile.Write(job.Marshal()); err != nil {
+		tmpfile.Close()
+		os.Remove(tmpfile.Name())
+		return "", err
+	}
+	if err := tmpfile.Close(); err != nil {
+		os.Remove(tmpfile.Name())
+		return "", err
+	}
+	return tmpfile.Name(), nil
+}
+
+// Reservation describes how to reserve a device to debug a bucket, the spread
+// tasks are only run if Run is set, with the given extra spread arguments
+type Reservation struct {
+	SSHKeys    []string
+	Timeout    int
+	Run        bool
+	SpreadArgs []string
+}
+
+// NewJob returns the definition of the job running the given bucket
+func NewJob(options *types.Options, bucket *types.Bucket) *Job {
+	return newJob(options, bucket, true, nil)
+}
+
+// NewReserveJob returns the definition of a job preparing the device in the
+// same way as NewJob and keeping it reserved afterwards
+func NewReserveJob(options *types.Options, bucket *types.Bucket, reservation *Reservation) *Job {
+	job := newJob(options, bucket, reservation.Run, reservation.SpreadArgs)
+	// the reservation has its own timeout, the one of the run would cut it
+	job.GlobalTimeout = 0
+	job.ReserveData = &ReserveData{
+		SSHKeys: reservation.SSHKeys,
+		Timeout: reservation.Timeout,
+	}
+	return job
+}
+
+func newJob(options *types.Options, bucket *types.Bucket, run bool, spreadArgs []string) *Job {
+	job := &Job{Queue: bucket.Queue, GlobalTimeout: int(options.Timeout / time.Second)}
+
+	switch options.From {
+	case "stable":
+		job.ProvisionData = []Field{{"channel", "stable"}}
+	case "image":
+		job.ProvisionData = []Field{{"url", options.Image}, {"sha256", options.ImageHash}}
+	default:
+		job.ProvisionData = []Field{{"channel", options.Channel}}
+	}
+
+	job.TestCmds = []string{
+		"sudo apt update && sudo apt install -y git curl",
+		fmt.Sprintf("git clone %s snapd", options.Repo),
+	}
+	addSpread(job, options.Spread)
+	job.TestCmds = append(job.TestCmds, "snapd/tests/lib/external/prepare-ssh.sh {device_ip} 22 ubuntu")
+	for _, refresh := range Refreshes(options) {
+		addRefresh(job, refresh)
+	}
+	if !run {
+		job.TestCmds = append(job.TestCmds, fmt.Sprintf("cd snapd && %s", checkout(options)))
+		return job
+	}
+	args := append([]string{"-v"}, spreadArgs...)
+	job.TestCmds = append(job.TestCmds,
+		fmt.Sprintf("cd snapd && export SPREAD_EXTERNAL_ADDRESS={device_ip}:22 && %s && ../spread %s %s", checkout(options), strings.Join(args, " "), strings.Join(bucket.Tasks, " ")))
+
+	return job
+}
+
+// checkout returns the command checking out the code to test, the pinned
+// commit if known, otherwise the fetched ref or the release branch
+func checkout(options *types.Options) string {
+	target := options.Release
+	if options.Ref != "" {
+		target = "FETCH_HEAD"
+	}
+	if options.Commit != "" {
+		target = options.Commit
+	}
+	if options.Ref != "" {
+		return fmt.Sprintf("git fetch origin %s && git checkout %s", options.Ref, target)
+	}
+	return "git checkout " + target
+}
+
+// addSpread appends to the job the commands getting the spread binary in the
+// working directory, the tarball is verified against the expected checksum
+func addSpread(job *Job, spread types.Spread) {
+	switch {
+	case spread.Path != "":
+		tarball := AttachmentsDir + "/spread.tar.gz"
+		job.Attachments = append(job.Attachments, Attachment{Local: spread.Path, Agent: "spread.tar.gz"})
+		job.TestCmds = append(job.TestCmds,
+			fmt.Sprintf("echo '%s  %s' | sha256sum -c - && tar xzvf %s", spread.Hash, tarball, tarball))
+	default:
+		job.TestCmds = append(job.TestCmds,
+			fmt.Sprintf("curl -s -L -o spread.tar.gz %s && echo '%s  spread.tar.gz' | sha256sum -c - && tar xzvf spread.tar.gz", spread.URL, spread.Hash))
+	}
+}
+
+// Refreshes returns the snaps to refresh after provisioning, when provisioning
+// from stable without explicit refreshes core is refreshed to the target channel
+func Refreshes(options *types.Options) []types.Refresh {
+	if len(options.Refresh) == 0 && options.From == "stable" {
+		return []types.Refresh{{Name: "core", Channel: options.Channel}}
+	}
+	return options.Refresh
+}
+
+// addRefresh appends to the job the commands refreshing the given snap, waiting
+// for the change to complete and checking the result once the device is back
+func addRefresh(job *Job, refresh types.Refresh) {
+	var check string
+	switch {
+	case refresh.File != "":
+		snap, assertion := filepath.Base(refresh.File), filepath.Base(refresh.Assertion)
+		job.Attachments = append(job.Attachments,
+			Attachment{Local: refresh.File, Agent: snap},
+			Attachment{Local: refresh.Assertion, Agent: assertion})
+		job.TestCmds = append(job.TestCmds,
+			fmt.Sprintf("%s %s/%s %s/%s ubuntu@{device_ip}:", scpCmd, AttachmentsDir, snap, AttachmentsDir, assertion),
+			fmt.Sprintf("%s 'sudo snap ack %s && sudo snap install %s' || true", sshCmd, assertion, snap))
+		// the snap may be installed already, only the asserted revision
+		// tells that the file was installed, an unreadable assertion leaves
+		// it empty so that the check fails
+		revision, _ := AssertedRevision(refresh.Assertion)
+		check = fmt.Sprintf("%s snap list %s | awk 'NR == 2 {print $3}' | grep -qx '%s'", sshCmd, refresh.Name, revision)
+	case refresh.Revision != "":
+		job.TestCmds = append(job.TestCmds,
+			fmt.Sprintf("%s sudo snap refresh --revision=%s %s || true", sshCmd, refresh.Revision, refresh.Name))
+		check = fmt.Sprintf("%s snap list %s | awk 'NR == 2 {print $3}' | grep -qx %s", sshCmd, refresh.Name, refresh.Revision)
+	default:
+		job.TestCmds = append(job.TestCmds,
+			fmt.Sprintf("%s sudo snap refresh --channel=%s %s || true", sshCmd, refresh.Channel, refresh.Name))
+		check = fmt.Sprintf("%s snap list %s | awk 'NR == 2 {print $4}' | grep -Eqx '(latest/)?%s'", sshCmd, refresh.Name, refresh.Channel)
+	}
+	job.TestCmds = append(job.TestCmds, fmt.Sprintf(waitChangesFmt, sshCmd), check)
+}
+
+var snapRevisionRe = regexp.MustCompile(`(?m)^snap-revision: ([0-9]+)$`)
+
+// AssertedRevision returns the revision of the snap-revision assertion in the
+// given file, the one a snap acknowledged with it is installed as
+func AssertedRevision(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	m := snapRevisionRe.FindSubmatch(data)
+	if m == nil {
+		return "", fmt.Errorf("%s has no snap-revision assertion", path)
 	}
-	return result
+	return string(m[1]), nil
 }
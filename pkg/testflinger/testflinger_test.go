@@ -4,22 +4,133 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/fgimenez/validator/pkg/testflinger"
 	"github.com/fgimenez/validator/pkg/types"
 )
 
+var spread = types.Spread{URL: "https://example.com/spread-amd64.tar.gz", Hash: "myspreadhash"}
+
+const (
+	queue = "myqueue"
+
+	fromTargetFmt = `job_queue: %s
+provision_data:
+    channel: %s
+test_data:
+    test_cmds:
+        - sudo apt update && sudo apt install -y git curl
+        - git clone https://github.com/snapcore/snapd snapd
+        - curl -s -L -o spread.tar.gz https://example.com/spread-amd64.tar.gz && echo 'myspreadhash  spread.tar.gz' | sha256sum -c - && tar xzvf spread.tar.gz
+        - snapd/tests/lib/external/prepare-ssh.sh {device_ip} 22 ubuntu
+        - cd snapd && export SPREAD_EXTERNAL_ADDRESS={device_ip}:22 && git checkout %s && ../spread -v %s
+`
+	fromImageFmt = `job_queue: %s
+provision_data:
+    url: %s
+    sha256: %s
+test_data:
+    test_cmds:
+        - sudo apt update && sudo apt install -y git curl
+        - git clone https://github.com/snapcore/snapd snapd
+        - curl -s -L -o spread.tar.gz https://example.com/spread-amd64.tar.gz && echo 'myspreadhash  spread.tar.gz' | sha256sum -c - && tar xzvf spread.tar.gz
+        - snapd/tests/lib/external/prepare-ssh.sh {device_ip} 22 ubuntu
+        - cd snapd && export SPREAD_EXTERNAL_ADDRESS={device_ip}:22 && git checkout %s && ../spread -v %s
+`
+	fromStableFmt = `job_queue: %s
+provision_data:
+    channel: stable
+test_data:
+    test_cmds:
+        - sudo apt update && sudo apt install -y git curl
+        - git clone https://github.com/snapcore/snapd snapd
+        - curl -s -L -o spread.tar.gz https://example.com/spread-amd64.tar.gz && echo 'myspreadhash  spread.tar.gz' | sha256sum -c - && tar xzvf spread.tar.gz
+        - snapd/tests/lib/external/prepare-ssh.sh {device_ip} 22 ubuntu
+        - ssh -q -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no ubuntu@{device_ip} sudo snap refresh --channel=%s core || true
+        - for i in $(seq 60); do sleep 10; if ssh -q -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no ubuntu@{device_ip} snap changes > changes.out; then grep -Eq ' (Do|Doing|Undo|Undoing|Wait) ' changes.out || break; fi; [ $i -lt 60 ] || exit 1; done
+        - ssh -q -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no ubuntu@{device_ip} snap list core | awk 'NR == 2 {print $4}' | grep -Eqx '(latest/)?%s'
+        - cd snapd && export SPREAD_EXTERNAL_ADDRESS={device_ip}:22 && git checkout %s && ../spread -v %s
+`
+)
+
+// buckets builds the buckets for the given groups of tasks, all of them in queue
+func buckets(input [][]string) []*types.Bucket {
+	var result []*types.Bucket
+	for i, tasks := range input {
+		result = append(result, &types.Bucket{Index: i, Queue: queue, Tasks: tasks})
+	}
+	return result
+}
+
+// generate calls GenerateCfg failing the test on error, the output directory
+// is removed once the test finishes
+func generate(t *testing.T, subject *testflinger.Testflinger, options *types.Options, input []*types.Bucket) []string {
+	result, err := subject.GenerateCfg(options, input)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if len(result) != 0 {
+		t.Cleanup(func() { os.RemoveAll(filepath.Dir(result[0])) })
+	}
+	return result
+}
+
+func TestGenerateCfgOutputDir(t *testing.T) {
+	subject := &testflinger.Testflinger{}
+	dir, err := ioutil.TempDir("", "output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("stable names", func(t *testing.T) {
+		options := &types.Options{Release: "myrelease", OutputDir: filepath.Join(dir, "jobs")}
+		input := []*types.Bucket{
+			{System: "external:ubuntu-core-16-64:tests/main/", Index: 0, Queue: queue},
+			{System: "external:ubuntu-core-16-64:tests/main/", Index: 1, Queue: queue},
+		}
+		result := generate(t, subject, options, input)
+		for i, name := range []string{"external_ubuntu-core-16-64_tests_main_-0.yaml", "external_ubuntu-core-16-64_tests_main_-1.yaml"} {
+			if expected := filepath.Join(options.OutputDir, name); result[i] != expected {
+				t.Errorf("expected %s, got %s", expected, result[i])
+			}
+			if _, err := os.Stat(result[i]); err != nil {
+				t.Errorf("expected %s to be written, got %v", result[i], err)
+			}
+		}
+	})
+	t.Run("partial output is removed on error", func(t *testing.T) {
+		options := &types.Options{Release: "myrelease", OutputDir: filepath.Join(dir, "partial")}
+		// the second bucket name is taken by a directory
+		if err := os.MkdirAll(filepath.Join(options.OutputDir, "mysystem-1.yaml"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		input := []*types.Bucket{{System: "mysystem", Index: 0}, {System: "mysystem", Index: 1}}
+		result, err := subject.GenerateCfg(options, input)
+		if err == nil || result != nil {
+			t.Fatalf("expected error and no result, got %v, %v", err, result)
+		}
+		if _, err := os.Stat(filepath.Join(options.OutputDir, "mysystem-0.yaml")); !os.IsNotExist(err) {
+			t.Errorf("expected partial output to be removed, got %v", err)
+		}
+	})
+}
+
 func TestGenerateCfg(t *testing.T) {
 	subject := &testflinger.Testflinger{}
 	options := &types.Options{
 		Channel: "mychannel",
 		Release: "myrelease",
+		Repo:    "https://github.com/snapcore/snapd",
+		Spread:  spread,
 	}
 	t.Run("empty input", func(t *testing.T) {
 		input := [][]string{}
-		result := subject.GenerateCfg(options, input)
+		result := generate(t, subject, options, buckets(input))
 		if len(result) != 0 {
 			t.Errorf("expected empty result, got %v", result)
 		}
@@ -27,7 +138,7 @@ func TestGenerateCfg(t *testing.T) {
 
 	t.Run("config file for sigle line, single group input", func(t *testing.T) {
 		input := [][]string{{"line0"}}
-		result := subject.GenerateCfg(options, input)
+		result := generate(t, subject, options, buckets(input))
 		defer os.Remove(result[0])
 		t.Run("is created", func(t *testing.T) {
 			if _, err := os.Stat(result[0]); os.IsNotExist(err) {
@@ -36,7 +147,7 @@ func TestGenerateCfg(t *testing.T) {
 		})
 		t.Run("has the right content", func(t *testing.T) {
 			content, _ := ioutil.ReadFile(result[0])
-			expected := fmt.Sprintf(testflinger.FromTargetFmt, options.Channel, options.Release, "line0")
+			expected := fmt.Sprintf(fromTargetFmt, queue, options.Channel, options.Release, "line0")
 			if string(content) != expected {
 				t.Errorf("%s file content wrong, actual %s, expected %s", result[0], content, expected)
 			}
@@ -44,7 +155,7 @@ func TestGenerateCfg(t *testing.T) {
 	})
 	t.Run("config file for single line, multigroup input", func(t *testing.T) {
 		input := [][]string{{"line0"}, {"line2"}, {"line3"}, {"line4"}}
-		result := subject.GenerateCfg(options, input)
+		result := generate(t, subject, options, buckets(input))
 		for i, item := range input {
 			defer os.Remove(result[i])
 			file := fmt.Sprintf("file%d", i)
@@ -55,7 +166,7 @@ func TestGenerateCfg(t *testing.T) {
 			})
 			t.Run(file+" has the right content", func(t *testing.T) {
 				content, _ := ioutil.ReadFile(result[i])
-				expected := fmt.Sprintf(testflinger.FromTargetFmt, options.Channel, options.Release, input[i][0])
+				expected := fmt.Sprintf(fromTargetFmt, queue, options.Channel, options.Release, input[i][0])
 				if string(content) != expected {
 					t.Errorf("%s file content wrong, actual %s, expected %s", item, content, expected)
 				}
@@ -69,7 +180,7 @@ func TestGenerateCfg(t *testing.T) {
 			{"line0", "line1", "line2", "line3", "line4"},
 			{"line0", "line1", "line2", "line3", "line4", "line5", "line6", "line7", "line8"}}
 		t.Run("file creation and general content", func(t *testing.T) {
-			result := subject.GenerateCfg(options, input)
+			result := generate(t, subject, options, buckets(input))
 			for i, item := range input {
 				defer os.Remove(result[i])
 				file := fmt.Sprintf("file%d", i)
@@ -81,7 +192,7 @@ func TestGenerateCfg(t *testing.T) {
 				t.Run(file+" has the right content", func(t *testing.T) {
 					content, _ := ioutil.ReadFile(result[i])
 					mergedLines := strings.Join(input[i], " ")
-					expected := fmt.Sprintf(testflinger.FromTargetFmt, options.Channel, options.Release, mergedLines)
+					expected := fmt.Sprintf(fromTargetFmt, queue, options.Channel, options.Release, mergedLines)
 					if string(content) != expected {
 						t.Errorf("%s file content wrong, actual %s, expected %s", item, content, expected)
 					}
@@ -92,7 +203,7 @@ func TestGenerateCfg(t *testing.T) {
 			options := &types.Options{
 				Release: "myrelease",
 			}
-			result := subject.GenerateCfg(options, input)
+			result := generate(t, subject, options, buckets(input))
 			for i, item := range input {
 				defer os.Remove(result[i])
 				file := fmt.Sprintf("file%d", i)
@@ -106,4 +217,209 @@ func TestGenerateCfg(t *testing.T) {
 			}
 		})
 	})
+	t.Run("job queue is taken from the bucket", func(t *testing.T) {
+		input := []*types.Bucket{
+			{Index: 0, Queue: "myqueue1", Tasks: []string{"line0"}},
+			{Index: 1, Queue: "myqueue2", Tasks: []string{"line1"}},
+		}
+		result := generate(t, subject, options, input)
+		for i, bucket := range input {
+			defer os.Remove(result[i])
+			content, _ := ioutil.ReadFile(result[i])
+			expected := "job_queue: " + bucket.Queue + "\n"
+			if !strings.HasPrefix(string(content), expected) {
+				t.Errorf("%s file content wrong, actual %s, expected to start with %s", result[i], content, expected)
+			}
+		}
+	})
+	t.Run("provision from image", func(t *testing.T) {
+		options := &types.Options{
+			From:      "image",
+			Image:     "https://example.com/pi3.img.xz",
+			ImageHash: "myhash",
+			Release:   "myrelease",
+			Repo:      "https://github.com/snapcore/snapd",
+			Spread:    spread,
+		}
+		result := generate(t, subject, options, buckets([][]string{{"line0"}}))
+		defer os.Remove(result[0])
+		content, _ := ioutil.ReadFile(result[0])
+		expected := fmt.Sprintf(fromImageFmt, queue, options.Image, options.ImageHash, options.Release, "line0")
+		if string(content) != expected {
+			t.Errorf("%s file content wrong, actual %s, expected %s", result[0], content, expected)
+		}
+		if !strings.Contains(string(content), "    url: https://example.com/pi3.img.xz\n    sha256: myhash\n") {
+			t.Errorf("%s file doesn't include the image in provision_data: %s", result[0], content)
+		}
+	})
+	t.Run("provision from stable refreshes core by default", func(t *testing.T) {
+		options := &types.Options{
+			From:    "stable",
+			Channel: "beta",
+			Release: "myrelease",
+			Repo:    "https://github.com/snapcore/snapd",
+			Spread:  spread,
+		}
+		result := generate(t, subject, options, buckets([][]string{{"line0"}}))
+		defer os.Remove(result[0])
+		content, _ := ioutil.ReadFile(result[0])
+		expected := fmt.Sprintf(fromStableFmt, queue, "beta", "beta", options.Release, "line0")
+		if string(content) != expected {
+			t.Errorf("%s file content wrong, actual %s, expected %s", result[0], content, expected)
+		}
+	})
+}
+
+func TestNewJobRefreshes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "refresh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	assertion := filepath.Join(dir, "pi-kernel_12.assert")
+	ioutil.WriteFile(assertion, []byte("type: snap-revision\nsnap-id: pYVQrBcKmBa0mZ4CCN7ExT6jH8rY1hza\nsnap-revision: 12\n"), 0644)
+
+	bucket := &types.Bucket{Queue: queue, Tasks: []string{"line0"}}
+	options := &types.Options{
+		From:    "stable",
+		Channel: "edge",
+		Release: "myrelease",
+		Refresh: []types.Refresh{
+			{Name: "snapd", Channel: "20/beta"},
+			{Name: "core18", Revision: "1234"},
+			{Name: "pi-kernel", File: "/tmp/pi-kernel_12.snap", Assertion: assertion},
+		},
+	}
+	job := testflinger.NewJob(options, bucket)
+	cmds := strings.Join(job.TestCmds, "\n")
+
+	t.Run("explicit refreshes replace the default core one", func(t *testing.T) {
+		if strings.Contains(cmds, " core ") {
+			t.Errorf("unexpected core refresh in %s", cmds)
+		}
+	})
+	t.Run("refresh from channel", func(t *testing.T) {
+		if !strings.Contains(cmds, "sudo snap refresh --channel=20/beta snapd") {
+			t.Errorf("missing snapd refresh in %s", cmds)
+		}
+		if !strings.Contains(cmds, "snap list snapd | awk 'NR == 2 {print $4}' | grep -Eqx '(latest/)?20/beta'") {
+			t.Errorf("missing snapd check in %s", cmds)
+		}
+	})
+	t.Run("refresh to revision", func(t *testing.T) {
+		if !strings.Contains(cmds, "sudo snap refresh --revision=1234 core18") {
+			t.Errorf("missing core18 refresh in %s", cmds)
+		}
+		if !strings.Contains(cmds, "snap list core18 | awk 'NR == 2 {print $3}' | grep -qx 1234") {
+			t.Errorf("missing core18 check in %s", cmds)
+		}
+	})
+	t.Run("sideload from file", func(t *testing.T) {
+		expected := []testflinger.Attachment{
+			{Local: "/tmp/pi-kernel_12.snap", Agent: "pi-kernel_12.snap"},
+			{Local: assertion, Agent: "pi-kernel_12.assert"},
+		}
+		if len(job.Attachments) != 2 || job.Attachments[0] != expected[0] || job.Attachments[1] != expected[1] {
+			t.Errorf("expected attachments %v, got %v", expected, job.Attachments)
+		}
+		if !strings.Contains(cmds, "attachments/test/pi-kernel_12.snap attachments/test/pi-kernel_12.assert ubuntu@{device_ip}:") {
+			t.Errorf("missing copy of the snap file in %s", cmds)
+		}
+		if !strings.Contains(cmds, "'sudo snap ack pi-kernel_12.assert && sudo snap install pi-kernel_12.snap'") {
+			t.Errorf("missing install of the snap file in %s", cmds)
+		}
+		if !strings.Contains(cmds, "snap list pi-kernel | awk 'NR == 2 {print $3}' | grep -qx '12'") {
+			t.Errorf("missing check of the asserted revision in %s", cmds)
+		}
+	})
+	t.Run("each refresh waits for the changes", func(t *testing.T) {
+		if n := strings.Count(cmds, "snap changes > changes.out"); n != 3 {
+			t.Errorf("expected 3 waits for changes, got %d", n)
+		}
+	})
+	t.Run("spread runs last", func(t *testing.T) {
+		last := job.TestCmds[len(job.TestCmds)-1]
+		if !strings.HasPrefix(last, "cd snapd && ") || !strings.HasSuffix(last, "../spread -v line0") {
+			t.Errorf("expected spread to run last, got %s", last)
+		}
+	})
+}
+
+func TestNewJobCheckout(t *testing.T) {
+	bucket := &types.Bucket{Queue: queue, Tasks: []string{"line0"}}
+	for _, tc := range []struct {
+		name     string
+		options  *types.Options
+		expected string
+	}{
+		{"release branch", &types.Options{Release: "myrelease"}, "git checkout myrelease && "},
+		{"pinned commit", &types.Options{Release: "myrelease", Commit: "abcdef1"}, "git checkout abcdef1 && "},
+		{"ref", &types.Options{Release: "myrelease", Ref: "pull/1/head"}, "git fetch origin pull/1/head && git checkout FETCH_HEAD && "},
+		{"ref and pinned commit", &types.Options{Release: "myrelease", Ref: "pull/1/head", Commit: "abcdef1"}, "git fetch origin pull/1/head && git checkout abcdef1 && "},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.Repo = "https://github.com/me/snapd.git"
+			job := testflinger.NewJob(tc.options, bucket)
+			cmds := strings.Join(job.TestCmds, "\n")
+			if !strings.Contains(cmds, "git clone https://github.com/me/snapd.git snapd\n") {
+				t.Errorf("expected repository to be cloned in %s", cmds)
+			}
+			if !strings.Contains(cmds, "export SPREAD_EXTERNAL_ADDRESS={device_ip}:22 && "+tc.expected+"../spread") {
+				t.Errorf("expected %q in %s", tc.expected, cmds)
+			}
+		})
+	}
+}
+
+func TestNewJobSpread(t *testing.T) {
+	bucket := &types.Bucket{Queue: queue, Tasks: []string{"line0"}}
+	t.Run("from url", func(t *testing.T) {
+		job := testflinger.NewJob(&types.Options{Spread: spread}, bucket)
+		expected := "curl -s -L -o spread.tar.gz https://example.com/spread-amd64.tar.gz && echo 'myspreadhash  spread.tar.gz' | sha256sum -c - && tar xzvf spread.tar.gz"
+		if job.TestCmds[2] != expected {
+			t.Errorf("expected %q, got %q", expected, job.TestCmds[2])
+		}
+	})
+	t.Run("from local path", func(t *testing.T) {
+		job := testflinger.NewJob(&types.Options{Spread: types.Spread{Path: "/tmp/my-spread.tar.gz", Hash: "myspreadhash"}}, bucket)
+		expected := "echo 'myspreadhash  attachments/test/spread.tar.gz' | sha256sum -c - && tar xzvf attachments/test/spread.tar.gz"
+		if job.TestCmds[2] != expected {
+			t.Errorf("expected %q, got %q", expected, job.TestCmds[2])
+		}
+		attachment := testflinger.Attachment{Local: "/tmp/my-spread.tar.gz", Agent: "spread.tar.gz"}
+		if len(job.Attachments) != 1 || job.Attachments[0] != attachment {
+			t.Errorf("expected attachment %v, got %v", attachment, job.Attachments)
+		}
+	})
+}
+
+func TestNewJobTimeout(t *testing.T) {
+	bucket := &types.Bucket{Queue: queue, Tasks: []string{"line0"}}
+	job := testflinger.NewJob(&types.Options{Release: "myrelease", Timeout: 90 * time.Minute}, bucket)
+	if !strings.HasPrefix(string(job.Marshal()), "job_queue: myqueue\nglobal_timeout: 5400\n") {
+		t.Errorf("expected global timeout in seconds, got %s", job.Marshal())
+	}
+}
+
+func TestNewReserveJob(t *testing.T) {
+	bucket := &types.Bucket{Queue: queue, Tasks: []string{"line0", "line1"}}
+	options := &types.Options{Release: "myrelease", Spread: spread, Timeout: time.Hour}
+	t.Run("prepare only", func(t *testing.T) {
+		job := testflinger.NewReserveJob(options, bucket, &testflinger.Reservation{SSHKeys: []string{"lp:me"}, Timeout: 600})
+		if last := job.TestCmds[len(job.TestCmds)-1]; last != "cd snapd && git checkout myrelease" {
+			t.Errorf("expected spread not to be run, got %q", last)
+		}
+		if job.GlobalTimeout != 0 {
+			t.Errorf("expected the reservation not to be limited by the run timeout, got %d", job.GlobalTimeout)
+		}
+		if job.ReserveData == nil || job.ReserveData.Timeout != 600 || len(job.ReserveData.SSHKeys) != 1 {
+			t.Errorf("unexpected reserve data %+v", job.ReserveData)
+		}
+	})
+	t.Run("run with spread args", func(t *testing.T) {
+		job := testflinger.NewReserveJob(options, bucket, &testflinger.Reservation{SSHKeys: []string{"lp:me"}, Timeout: 600, Run: true, SpreadArgs: []string{"-debug"}})
+		if last := job.TestCmds[len(job.TestCmds)-1]; !strings.HasSuffix(last, "../spread -v -debug line0 line1") {
+			t.Errorf("expected spread to be run with -debug, got %q", last)
+		}
+	})
 }
@@ -0,0 +1,290 @@
+// Package tfapi is a client of the REST API of a testflinger server, it can
+// be used instead of the testflinger command line client
+package tfapi
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/fgimenez/validator/pkg/testflinger"
+	"github.com/fgimenez/validator/pkg/types"
+)
+
+// Defaults used by New
+const (
+	DefaultRetries = 3
+	DefaultBackoff = 2 * time.Second
+	DefaultTimeout = time.Minute
+)
+
+// Client manages jobs in a testflinger server through its REST API
+type Client struct {
+	// URL is the address of the server, ie https://testflinger.canonical.com
+	URL  string
+	HTTP *http.Client
+	// Retries is the number of times a GET request is repeated after a
+	// network error or a server error, waiting Backoff times the attempt in
+	// between
+	Retries int
+	Backoff time.Duration
+}
+
+// New returns a client of the server at the given URL with the default
+// timeout and retries
+func New(url string) *Client {
+	return &Client{
+		URL:     strings.TrimSuffix(url, "/"),
+		HTTP:    &http.Client{Timeout: DefaultTimeout},
+		Retries: DefaultRetries,
+		Backoff: DefaultBackoff,
+	}
+}
+
+// StatusError is returned when the server answers with an unexpected status
+type StatusError struct {
+	Method string
+	URL    string
+	Code   int
+	Body   string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s: %s", e.Method, e.URL, e.Code, http.StatusText(e.Code), strings.TrimSpace(e.Body))
+}
+
+// job is the JSON representation of a job accepted by the server
+type job struct {
+	JobQueue      string            `json:"job_queue"`
+	GlobalTimeout int               `json:"global_timeout,omitempty"`
+	ProvisionData map[string]string `json:"provision_data,omitempty"`
+	TestData      testData          `json:"test_data"`
+	ReserveData   *reserveData      `json:"reserve_data,omitempty"`
+}
+
+type testData struct {
+	Attachments []attachment `json:"attachments,omitempty"`
+	TestCmds    []string     `json:"test_cmds"`
+}
+
+type attachment struct {
+	Agent string `json:"agent"`
+}
+
+type reserveData struct {
+	SSHKeys []string `json:"ssh_keys"`
+	Timeout int      `json:"timeout"`
+}
+
+// Submit sends the given job and returns the job id, cfg is the file the job
+// was written to and only identifies it in errors. The attachments are sent
+// once the job is created
+func (c *Client) Submit(cfg string, job *testflinger.Job) (string, error) {
+	body, err := json.Marshal(toJSON(job))
+	if err != nil {
+		return "", fmt.Errorf("cannot submit %s: %v", cfg, err)
+	}
+	data, err := c.do("POST", "/v1/job", "application/json", body)
+	if err != nil {
+		return "", fmt.Errorf("cannot submit %s: %v", cfg, err)
+	}
+	var response struct {
+		JobID string `json:"job_id"`
+	}
+	if err := json.Unmarshal(data, &response); err != nil || response.JobID == "" {
+		return "", fmt.Errorf("cannot submit %s: no job id returned", cfg)
+	}
+
+	if len(job.Attachments) != 0 {
+		if err := c.attach(response.JobID, job.Attachments); err != nil {
+			return response.JobID, fmt.Errorf("cannot submit %s: %v", cfg, err)
+		}
+	}
+	return response.JobID, nil
+}
+
+// Status returns the current state of the given job
+func (c *Client) Status(id string) (string, error) {
+	results, err := c.Results(id)
+	if err != nil {
+		return "", fmt.Errorf("cannot get status of job %s: %v", id, err)
+	}
+	return results.JobState, nil
+}
+
+// Results returns the outcome of the given job, the fields of the phases not
+// run yet are empty
+func (c *Client) Results(id string) (*types.Results, error) {
+	data, err := c.do("GET", "/v1/result/"+id, "", nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get results of job %s: %v", id, err)
+	}
+	var results types.Results
+	if len(data) == 0 {
+		return &results, nil
+	}
+	if err := json.Unmarshal(data, &results); err != nil {
+		return nil, fmt.Errorf("cannot decode results of job %s: %v", id, err)
+	}
+	return &results, nil
+}
+
+// Output returns the output produced by the given job since the last call
+func (c *Client) Output(id string) (string, error) {
+	data, err := c.do("GET", "/v1/result/"+id+"/output", "", nil)
+	if err != nil {
+		return "", fmt.Errorf("cannot get output of job %s: %v", id, err)
+	}
+	return string(data), nil
+}
+
+// Artifacts writes the tarball of artifacts saved by the given job to w
+func (c *Client) Artifacts(id string, w io.Writer) error {
+	data, err := c.do("GET", "/v1/result/"+id+"/artifact", "", nil)
+	if err != nil {
+		return fmt.Errorf("cannot get artifacts of job %s: %v", id, err)
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// Cancel stops the given job
+func (c *Client) Cancel(id string) error {
+	body, _ := json.Marshal(map[string]string{"action": "cancel"})
+	if _, err := c.do("POST", "/v1/job/"+id+"/action", "application/json", body); err != nil {
+		return fmt.Errorf("cannot cancel job %s: %v", id, err)
+	}
+	return nil
+}
+
+// Queues returns the queues advertised by the server with their description
+func (c *Client) Queues() (map[string]string, error) {
+	data, err := c.do("GET", "/v1/agents/queues", "", nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get queues: %v", err)
+	}
+	queues := map[string]string{}
+	if err := json.Unmarshal(data, &queues); err != nil {
+		return nil, fmt.Errorf("cannot decode queues: %v", err)
+	}
+	return queues, nil
+}
+
+// attach sends the given attachments as a gzipped tarball with the files
+// under the test phase directory, where the agent expects them
+func (c *Client) attach(id string, attachments []testflinger.Attachment) error {
+	var archive bytes.Buffer
+	gz := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gz)
+	for _, a := range attachments {
+		content, err := ioutil.ReadFile(a.Local)
+		if err != nil {
+			return err
+		}
+		header := &tar.Header{Name: path.Join("test", a.Agent), Mode: 0644, Size: int64(len(content))}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(content); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", "attachments.tar.gz")
+	if err != nil {
+		return err
+	}
+	part.Write(archive.Bytes())
+	if err := mw.Close(); err != nil {
+		return err
+	}
+	_, err = c.do("POST", "/v1/job/"+id+"/attachments", mw.FormDataContentType(), body.Bytes())
+	return err
+}
+
+// do sends a request and returns the response body, network errors and server
+// errors of GET requests are retried, the rest of the requests are not
+// idempotent and are sent once as the server may have handled them already,
+// ie retrying a job submission could create it twice
+func (c *Client) do(method, endpoint, contentType string, body []byte) ([]byte, error) {
+	url := c.URL + endpoint
+	retries := c.Retries
+	if method != "GET" {
+		retries = 0
+	}
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * c.Backoff)
+		}
+		var data []byte
+		var retry bool
+		data, retry, err = c.request(method, url, contentType, body)
+		if err == nil || !retry {
+			return data, err
+		}
+	}
+	return nil, err
+}
+
+func (c *Client) request(method, url, contentType string, body []byte) (data []byte, retry bool, err error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+	data, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, resp.StatusCode >= 500, &StatusError{Method: method, URL: url, Code: resp.StatusCode, Body: string(data)}
+	}
+	return data, false, nil
+}
+
+// toJSON returns the representation of the job expected by the server
+func toJSON(definition *testflinger.Job) *job {
+	j := &job{
+		JobQueue:      definition.Queue,
+		GlobalTimeout: definition.GlobalTimeout,
+		TestData:      testData{TestCmds: definition.TestCmds},
+	}
+	if len(definition.ProvisionData) != 0 {
+		j.ProvisionData = map[string]string{}
+		for _, field := range definition.ProvisionData {
+			j.ProvisionData[field.Key] = field.Value
+		}
+	}
+	for _, a := range definition.Attachments {
+		j.TestData.Attachments = append(j.TestData.Attachments, attachment{Agent: a.Agent})
+	}
+	if definition.ReserveData != nil {
+		j.ReserveData = &reserveData{SSHKeys: definition.ReserveData.SSHKeys, Timeout: definition.ReserveData.Timeout}
+	}
+	return j
+}
@@ -0,0 +1,201 @@
+package tfapi_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fgimenez/validator/pkg/testflinger"
+	"github.com/fgimenez/validator/pkg/tfapi"
+)
+
+func newClient(t *testing.T, handler http.HandlerFunc) *tfapi.Client {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	client := tfapi.New(server.URL + "/")
+	client.Backoff = 0
+	return client
+}
+
+// writeAttachments writes the local files of the attachments of the job
+func writeAttachments(t *testing.T, job *testflinger.Job) {
+	dir, err := ioutil.TempDir("", "tfapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	for i, a := range job.Attachments {
+		job.Attachments[i].Local = filepath.Join(dir, a.Agent)
+		ioutil.WriteFile(job.Attachments[i].Local, []byte("content of "+a.Agent), 0644)
+	}
+}
+
+func TestSubmit(t *testing.T) {
+	job := &testflinger.Job{
+		Queue:         "myqueue",
+		ProvisionData: []testflinger.Field{{Key: "channel", Value: "edge"}},
+		Attachments:   []testflinger.Attachment{{Agent: "snapd.snap"}},
+		TestCmds:      []string{"echo hello"},
+	}
+	writeAttachments(t, job)
+
+	var submitted map[string]interface{}
+	var archived []string
+	client := newClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "POST /v1/job":
+			json.NewDecoder(r.Body).Decode(&submitted)
+			w.Write([]byte(`{"job_id": "myjobid"}`))
+		case "POST /v1/job/myjobid/attachments":
+			file, _, err := r.FormFile("file")
+			if err != nil {
+				t.Errorf("expected attachments file, got %v", err)
+				return
+			}
+			gz, _ := gzip.NewReader(file)
+			tr := tar.NewReader(gz)
+			for header, err := tr.Next(); err == nil; header, err = tr.Next() {
+				content, _ := ioutil.ReadAll(tr)
+				archived = append(archived, header.Name+"="+string(content))
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	id, err := client.Submit("job.yaml", job)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if id != "myjobid" {
+		t.Errorf("expected job id myjobid, got %q", id)
+	}
+	if submitted["job_queue"] != "myqueue" {
+		t.Errorf("expected job queue to be sent, got %v", submitted)
+	}
+	testData, _ := json.Marshal(submitted["test_data"])
+	if string(testData) != `{"attachments":[{"agent":"snapd.snap"}],"test_cmds":["echo hello"]}` {
+		t.Errorf("unexpected test data %s", testData)
+	}
+	if len(archived) != 1 || archived[0] != "test/snapd.snap=content of snapd.snap" {
+		t.Errorf("expected attachment under the test phase, got %v", archived)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	t.Run("server errors are retried", func(t *testing.T) {
+		calls := 0
+		client := newClient(t, func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if calls < 3 {
+				http.Error(w, "try again", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(`{"job_state": "test"}`))
+		})
+		state, err := client.Status("myjobid")
+		if err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+		if state != "test" || calls != 3 {
+			t.Errorf("expected state test after 3 calls, got %q after %d", state, calls)
+		}
+	})
+	t.Run("retries are limited", func(t *testing.T) {
+		calls := 0
+		client := newClient(t, func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			http.Error(w, "down", http.StatusInternalServerError)
+		})
+		_, err := client.Status("myjobid")
+		if _, ok := err.(*tfapi.StatusError); ok || err == nil {
+			t.Errorf("expected wrapped status error, got %v", err)
+		}
+		if calls != tfapi.DefaultRetries+1 {
+			t.Errorf("expected %d calls, got %d", tfapi.DefaultRetries+1, calls)
+		}
+	})
+	t.Run("submissions are not retried", func(t *testing.T) {
+		calls := 0
+		client := newClient(t, func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			http.Error(w, "timed out after creating the job", http.StatusGatewayTimeout)
+		})
+		if _, err := client.Submit("job.yaml", &testflinger.Job{Queue: "myqueue"}); err == nil || !strings.Contains(err.Error(), "job.yaml") {
+			t.Errorf("expected submit error, got %v", err)
+		}
+		if calls != 1 {
+			t.Errorf("expected 1 call, got %d", calls)
+		}
+	})
+	t.Run("client errors are not retried", func(t *testing.T) {
+		calls := 0
+		client := newClient(t, func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			http.Error(w, "no such job", http.StatusNotFound)
+		})
+		if err := client.Cancel("myjobid"); err == nil || !strings.Contains(err.Error(), "no such job") {
+			t.Errorf("expected error including the body, got %v", err)
+		}
+		if calls != 1 {
+			t.Errorf("expected 1 call, got %d", calls)
+		}
+	})
+}
+
+func TestJobs(t *testing.T) {
+	var cancelled string
+	client := newClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /v1/result/myjobid":
+			w.Write([]byte(`{"job_state": "complete", "provision_status": 0, "test_status": 1, "test_output": "failed"}`))
+		case "GET /v1/result/newjobid":
+			w.WriteHeader(http.StatusNoContent)
+		case "GET /v1/result/myjobid/output":
+			w.Write([]byte("some output\n"))
+		case "GET /v1/result/myjobid/artifact":
+			w.Write([]byte("tarball"))
+		case "POST /v1/job/myjobid/action":
+			var action map[string]string
+			json.NewDecoder(r.Body).Decode(&action)
+			cancelled = action["action"]
+		case "GET /v1/agents/queues":
+			w.Write([]byte(`{"dragonboard": "DragonBoard 410c", "pi4": "Raspberry Pi 4"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	results, err := client.Results("myjobid")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if results.JobState != "complete" || results.TestStatus != 1 || results.TestOutput != "failed" || results.Passed() {
+		t.Errorf("unexpected results %+v", results)
+	}
+	if results, err := client.Results("newjobid"); err != nil || results.JobState != "" {
+		t.Errorf("expected empty results for a job without them, got %+v, %v", results, err)
+	}
+	if output, err := client.Output("myjobid"); err != nil || output != "some output\n" {
+		t.Errorf("expected job output, got %q, %v", output, err)
+	}
+	var artifacts bytes.Buffer
+	if err := client.Artifacts("myjobid", &artifacts); err != nil || artifacts.String() != "tarball" {
+		t.Errorf("expected artifacts, got %q, %v", artifacts.String(), err)
+	}
+	if err := client.Cancel("myjobid"); err != nil || cancelled != "cancel" {
+		t.Errorf("expected job to be cancelled, got %q, %v", cancelled, err)
+	}
+	queues, err := client.Queues()
+	if err != nil || len(queues) != 2 || queues["pi4"] != "Raspberry Pi 4" {
+		t.Errorf("unexpected queues %v, %v", queues, err)
+	}
+}
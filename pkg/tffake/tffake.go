@@ -0,0 +1,239 @@
+// Package tffake implements a fake testflinger server for testing the tool
+// without access to a lab. Jobs don't run anywhere, they go through their
+// lifecycle one state each time their status is requested
+package tffake
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/fgimenez/validator/pkg/types"
+)
+
+// Lifecycle is the default list of states of a job
+var Lifecycle = []string{"waiting", "setup", "provision", "test", "cleanup", "complete"}
+
+// ReserveLifecycle is the list of states of a job with reserve_data, which
+// stays in the last one until cancelled
+var ReserveLifecycle = []string{"waiting", "setup", "provision", "test", "reserve"}
+
+// ReservedAddress is the address printed in the output of reserved jobs
+const ReservedAddress = "ubuntu@10.0.0.1"
+
+// Outcome is the result of a job once complete
+type Outcome struct {
+	ProvisionStatus int
+	TestStatus      int
+	TestOutput      string
+	Artifact        []byte
+}
+
+// Job is a job submitted to the fake server
+type Job struct {
+	ID          string
+	Queue       string
+	Definition  map[string]interface{}
+	Attachments []byte
+	States      []string
+	// State is the index of the current state in States
+	State   int
+	Outcome *Outcome
+	output  []string
+}
+
+// Server is a fake testflinger server, the exported fields can be changed
+// before handling requests
+type Server struct {
+	// Queues are the queues advertised, when not empty jobs for other queues
+	// are rejected
+	Queues map[string]string
+	// Outcome returns the result of the given job, all jobs pass when nil
+	Outcome func(job *Job) *Outcome
+
+	mu       sync.Mutex
+	jobs     map[string]*Job
+	order    []string
+	failures map[string]int
+}
+
+// New returns a fake server advertising the given queues
+func New(queues map[string]string) *Server {
+	return &Server{Queues: queues}
+}
+
+// Fail makes the next n requests whose method and path start with the given
+// prefix, ie "POST /v1/job", answer with an internal server error
+func (s *Server) Fail(prefix string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures == nil {
+		s.failures = map[string]int{}
+	}
+	s.failures[prefix] = n
+}
+
+// Jobs returns the jobs submitted so far, in submission order
+func (s *Server) Jobs() []*Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var jobs []*Job
+	for _, id := range s.order {
+		jobs = append(jobs, s.jobs[id])
+	}
+	return jobs
+}
+
+// ServeHTTP implements the subset of the testflinger API used by the tool
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	request := r.Method + " " + r.URL.Path
+	for prefix, n := range s.failures {
+		if n > 0 && strings.HasPrefix(request, prefix) {
+			s.failures[prefix] = n - 1
+			http.Error(w, "injected failure", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case request == "GET /v1/agents/queues":
+		writeJSON(w, s.Queues)
+	case request == "POST /v1/job":
+		s.submit(w, r)
+	case r.Method == "POST" && len(parts) == 4 && parts[1] == "job" && parts[3] == "attachments":
+		s.withJob(w, parts[2], func(job *Job) { s.attach(w, r, job) })
+	case r.Method == "POST" && len(parts) == 4 && parts[1] == "job" && parts[3] == "action":
+		s.withJob(w, parts[2], func(job *Job) { s.action(w, r, job) })
+	case r.Method == "GET" && len(parts) == 3 && parts[1] == "result":
+		s.withJob(w, parts[2], func(job *Job) { s.result(w, job) })
+	case r.Method == "GET" && len(parts) == 4 && parts[1] == "result" && parts[3] == "output":
+		s.withJob(w, parts[2], func(job *Job) {
+			w.Write([]byte(strings.Join(job.output, "")))
+			job.output = nil
+		})
+	case r.Method == "GET" && len(parts) == 4 && parts[1] == "result" && parts[3] == "artifact":
+		s.withJob(w, parts[2], func(job *Job) {
+			if job.Outcome == nil || job.Outcome.Artifact == nil {
+				http.Error(w, "no artifacts for job "+job.ID, http.StatusNotFound)
+				return
+			}
+			w.Write(job.Outcome.Artifact)
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) withJob(w http.ResponseWriter, id string, f func(job *Job)) {
+	job, ok := s.jobs[id]
+	if !ok {
+		http.Error(w, "unknown job "+id, http.StatusNotFound)
+		return
+	}
+	f(job)
+}
+
+func (s *Server) submit(w http.ResponseWriter, r *http.Request) {
+	var definition map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&definition); err != nil {
+		http.Error(w, "invalid job: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	queue, _ := definition["job_queue"].(string)
+	if queue == "" {
+		http.Error(w, "invalid job: job_queue is required", http.StatusUnprocessableEntity)
+		return
+	}
+	if _, ok := s.Queues[queue]; len(s.Queues) != 0 && !ok {
+		http.Error(w, "unknown queue "+queue, http.StatusUnprocessableEntity)
+		return
+	}
+
+	if s.jobs == nil {
+		s.jobs = map[string]*Job{}
+	}
+	job := &Job{
+		ID:         fmt.Sprintf("job-%d", len(s.order)+1),
+		Queue:      queue,
+		Definition: definition,
+		States:     Lifecycle,
+	}
+	if _, ok := definition["reserve_data"]; ok {
+		job.States = ReserveLifecycle
+	}
+	job.output = []string{job.States[0] + "\n"}
+	s.jobs[job.ID] = job
+	s.order = append(s.order, job.ID)
+	writeJSON(w, map[string]string{"job_id": job.ID})
+}
+
+func (s *Server) attach(w http.ResponseWriter, r *http.Request, job *Job) {
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "invalid attachments: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	if job.Attachments, err = ioutil.ReadAll(file); err != nil {
+		http.Error(w, "invalid attachments: "+err.Error(), http.StatusBadRequest)
+	}
+}
+
+func (s *Server) action(w http.ResponseWriter, r *http.Request, job *Job) {
+	var action map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&action); err != nil || action["action"] != "cancel" {
+		http.Error(w, "invalid action", http.StatusBadRequest)
+		return
+	}
+	switch job.state() {
+	case "complete", "cancelled":
+		http.Error(w, "job "+job.ID+" already finished", http.StatusBadRequest)
+		return
+	}
+	job.States = append(job.States[:job.State+1:job.State+1], "cancelled")
+	job.State++
+	job.output = append(job.output, "cancelled\n")
+}
+
+// result answers with the job results and moves the job to its next state
+func (s *Server) result(w http.ResponseWriter, job *Job) {
+	results := types.Results{JobState: job.state()}
+	if job.Outcome != nil {
+		results.ProvisionStatus = job.Outcome.ProvisionStatus
+		results.TestStatus = job.Outcome.TestStatus
+		results.TestOutput = job.Outcome.TestOutput
+	}
+	writeJSON(w, results)
+
+	if job.State == len(job.States)-1 {
+		return
+	}
+	job.State++
+	state := job.state()
+	job.output = append(job.output, state+"\n")
+	switch state {
+	case "complete":
+		job.Outcome = &Outcome{}
+		if s.Outcome != nil {
+			job.Outcome = s.Outcome(job)
+		}
+	case "reserve":
+		job.output = append(job.output, "*** TESTFLINGER SYSTEM RESERVED ***\n", "You can now connect to "+ReservedAddress+"\n")
+	}
+}
+
+func (j *Job) state() string {
+	return j.States[j.State]
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
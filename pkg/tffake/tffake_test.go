@@ -0,0 +1,137 @@
+package tffake_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fgimenez/validator/pkg/testflinger"
+	"github.com/fgimenez/validator/pkg/tfapi"
+	"github.com/fgimenez/validator/pkg/tffake"
+)
+
+func setup(t *testing.T, fake *tffake.Server) *tfapi.Client {
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	client := tfapi.New(server.URL)
+	client.Backoff = 0
+	return client
+}
+
+func states(t *testing.T, client *tfapi.Client, id string, n int) []string {
+	var result []string
+	for i := 0; i < n; i++ {
+		state, err := client.Status(id)
+		if err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+		result = append(result, state)
+	}
+	return result
+}
+
+func TestLifecycle(t *testing.T) {
+	fake := tffake.New(map[string]string{"myqueue": "my devices"})
+	fake.Outcome = func(job *tffake.Job) *tffake.Outcome {
+		return &tffake.Outcome{TestStatus: 1, TestOutput: "failed in " + job.Queue, Artifact: []byte("tarball")}
+	}
+	client := setup(t, fake)
+
+	id, err := client.Submit("job.yaml", &testflinger.Job{Queue: "myqueue", TestCmds: []string{"echo hello"}})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	all := strings.Join(states(t, client, id, 7), " ")
+	if all != "waiting setup provision test cleanup complete complete" {
+		t.Errorf("unexpected states %s", all)
+	}
+	results, err := client.Results(id)
+	if err != nil || results.TestStatus != 1 || results.TestOutput != "failed in myqueue" {
+		t.Errorf("expected configured outcome, got %+v, %v", results, err)
+	}
+	var artifact bytes.Buffer
+	if err := client.Artifacts(id, &artifact); err != nil || artifact.String() != "tarball" {
+		t.Errorf("expected configured artifact, got %q, %v", artifact.String(), err)
+	}
+	if err := client.Cancel(id); err == nil {
+		t.Error("expected error cancelling a finished job")
+	}
+
+	t.Run("unknown queue", func(t *testing.T) {
+		if _, err := client.Submit("job.yaml", &testflinger.Job{Queue: "otherqueue"}); err == nil || !strings.Contains(err.Error(), "unknown queue") {
+			t.Errorf("expected unknown queue error, got %v", err)
+		}
+	})
+	t.Run("queues", func(t *testing.T) {
+		queues, err := client.Queues()
+		if err != nil || queues["myqueue"] != "my devices" {
+			t.Errorf("expected advertised queues, got %v, %v", queues, err)
+		}
+		// the path of the testflinger server
+		resp, err := http.Get(client.URL + "/v1/agents/queues")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		queues = nil
+		if err := json.NewDecoder(resp.Body).Decode(&queues); err != nil || resp.StatusCode != http.StatusOK || queues["myqueue"] != "my devices" {
+			t.Errorf("expected the queues at /v1/agents/queues, got %d %v, %v", resp.StatusCode, queues, err)
+		}
+	})
+}
+
+func TestCancel(t *testing.T) {
+	client := setup(t, tffake.New(nil))
+	id, err := client.Submit("job.yaml", &testflinger.Job{Queue: "anyqueue"})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	states(t, client, id, 2)
+	if err := client.Cancel(id); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if all := strings.Join(states(t, client, id, 2), " "); all != "cancelled cancelled" {
+		t.Errorf("expected job to stay cancelled, got %s", all)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	client := setup(t, tffake.New(nil))
+	id, err := client.Submit("job.yaml", &testflinger.Job{
+		Queue:       "anyqueue",
+		ReserveData: &testflinger.ReserveData{SSHKeys: []string{"lp:me"}, Timeout: 60},
+	})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if all := strings.Join(states(t, client, id, 6), " "); all != "waiting setup provision test reserve reserve" {
+		t.Errorf("unexpected states %s", all)
+	}
+	output, err := client.Output(id)
+	if err != nil || !strings.Contains(output, "You can now connect to "+tffake.ReservedAddress+"\n") {
+		t.Errorf("expected connection details in output, got %q, %v", output, err)
+	}
+	if output, _ := client.Output(id); output != "" {
+		t.Errorf("expected output to be returned once, got %q", output)
+	}
+}
+
+func TestFail(t *testing.T) {
+	fake := tffake.New(nil)
+	client := setup(t, fake)
+	client.Retries = 0
+
+	fake.Fail("POST /v1/job", 1)
+	if _, err := client.Submit("job.yaml", &testflinger.Job{Queue: "anyqueue"}); err == nil || !strings.Contains(err.Error(), "injected failure") {
+		t.Errorf("expected injected failure, got %v", err)
+	}
+	if _, err := client.Submit("job.yaml", &testflinger.Job{Queue: "anyqueue"}); err != nil {
+		t.Errorf("expected failures to be limited, got %v", err)
+	}
+	if jobs := fake.Jobs(); len(jobs) != 1 || jobs[0].Queue != "anyqueue" {
+		t.Errorf("expected one job recorded, got %v", jobs)
+	}
+}
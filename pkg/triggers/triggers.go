@@ -0,0 +1,152 @@
+// Package triggers decides which images of the image sets need rebuilding,
+// comparing the revisions of their trigger snaps in the store with the ones
+// seeded in the last built images, as image-generator does
+package triggers
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/fgimenez/validator/pkg/imagedb"
+	"github.com/fgimenez/validator/pkg/imagesets"
+	"github.com/fgimenez/validator/pkg/platforms"
+	"github.com/fgimenez/validator/pkg/seed"
+)
+
+// DefaultOutputDir is where image-generator leaves the images it builds, each
+// in a directory named after the image
+const DefaultOutputDir = "images/output"
+
+// Manifest sources, the remote manifest of the published image takes
+// precedence over the local one
+const (
+	SourceRemote = "remote"
+	SourceLocal  = "local"
+)
+
+// Revisions returns the revision released to a channel, it is implemented
+// by store.Client
+type Revisions interface {
+	Revision(name, channel, arch string) (int, error)
+}
+
+// Evaluator decides whether the images need rebuilding
+type Evaluator struct {
+	Store Revisions
+	// RemoteURL is where the images are published, ie seed.PublicURL, the
+	// remote manifests aren't checked when empty
+	RemoteURL string
+	// OutputDir holds the local images, the local manifests aren't checked
+	// when empty
+	OutputDir string
+}
+
+// Decision tells whether an image needs rebuilding and why, Kind tells if it
+// comes from the images or the metadata sets, whose images are built only to
+// keep their manifest
+type Decision struct {
+	Image    string     `json:"image"`
+	Kind     string     `json:"kind"`
+	Platform string     `json:"platform"`
+	Rebuild  bool       `json:"rebuild"`
+	Reasons  []string   `json:"reasons,omitempty"`
+	Triggers []*Trigger `json:"triggers"`
+	// Warnings are the manifests which couldn't be used and the lines
+	// skipped in the ones used
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Trigger is the state of a trigger snap of an image, Image is the revision
+// in the manifest given by Source, 0 when not found
+type Trigger struct {
+	Snap    string `json:"snap"`
+	Channel string `json:"channel"`
+	Store   int    `json:"store"`
+	Image   int    `json:"image"`
+	Source  string `json:"source,omitempty"`
+	Rebuild bool   `json:"rebuild"`
+}
+
+func (d *Decision) rebuild(format string, a ...interface{}) {
+	d.Rebuild = true
+	d.Reasons = append(d.Reasons, fmt.Sprintf(format, a...))
+}
+
+// Evaluate returns a decision for each image of the file, the ones of the
+// images sets followed by the ones of the metadata sets as image-generator
+// processes them, in the order of the sets and their platforms
+func (e *Evaluator) Evaluate(file *imagesets.File) []*Decision {
+	var decisions []*Decision
+	for _, sets := range []struct {
+		kind string
+		sets []*imagesets.ImageSet
+	}{{imagedb.KindImage, file.Images}, {imagedb.KindMetadata, file.Metadata}} {
+		for _, set := range sets.sets {
+			for _, platform := range set.Platforms {
+				decisions = append(decisions, e.evaluate(set, platform, sets.kind))
+			}
+		}
+	}
+	return decisions
+}
+
+func (e *Evaluator) evaluate(set *imagesets.ImageSet, platform, kind string) *Decision {
+	d := &Decision{Image: imagesets.ImageName(set, platform), Kind: kind, Platform: platform}
+	p, err := platforms.Get(platform)
+	if err != nil {
+		d.rebuild("%v", err)
+		return d
+	}
+
+	manifests := map[string]seed.Manifest{}
+	if e.RemoteURL != "" {
+		m, warnings, err := seed.Load(e.RemoteURL + "/" + d.Image + "/" + seed.FileName)
+		if err != nil {
+			d.Warnings = append(d.Warnings, fmt.Sprintf("cannot use the remote manifest: %v", err))
+		} else {
+			d.Warnings = append(d.Warnings, warnings...)
+			manifests[SourceRemote] = m
+		}
+	}
+	if e.OutputDir != "" {
+		m, warnings, err := seed.Load(filepath.Join(e.OutputDir, d.Image, seed.FileName))
+		if err != nil {
+			d.Warnings = append(d.Warnings, fmt.Sprintf("cannot use the local manifest: %v", err))
+		} else {
+			d.Warnings = append(d.Warnings, warnings...)
+			manifests[SourceLocal] = m
+		}
+	}
+	previous := len(manifests[SourceRemote]) != 0 || len(manifests[SourceLocal]) != 0
+	if !previous {
+		d.rebuild("no manifest of a previous image")
+	}
+
+	for _, t := range set.Triggers {
+		trigger := &Trigger{Snap: t.Snap.Name, Channel: t.Snap.Channel}
+		d.Triggers = append(d.Triggers, trigger)
+		for _, source := range []string{SourceRemote, SourceLocal} {
+			if revision, ok := manifests[source][t.Snap.Name]; ok {
+				trigger.Image, trigger.Source = revision, source
+				break
+			}
+		}
+
+		trigger.Store, err = e.Store.Revision(t.Snap.Name, t.Snap.Channel, p.Architecture)
+		switch {
+		case err != nil:
+			trigger.Rebuild = true
+			d.rebuild("cannot get the revision of %s in %s for %s: %v", t.Snap.Name, t.Snap.Channel, p.Architecture, err)
+		case trigger.Image == 0:
+			trigger.Rebuild = true
+			// without a previous image the reason is already given
+			if previous {
+				d.rebuild("%s is not in the manifest of the previous image", t.Snap.Name)
+			}
+		case trigger.Store > trigger.Image:
+			trigger.Rebuild = true
+			d.rebuild("%s %d in %s is newer than %d in the %s manifest", t.Snap.Name, trigger.Store, t.Snap.Channel, trigger.Image, trigger.Source)
+		}
+	}
+	return d
+}
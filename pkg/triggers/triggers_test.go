@@ -0,0 +1,168 @@
+package triggers_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fgimenez/validator/pkg/imagedb"
+	"github.com/fgimenez/validator/pkg/imagesets"
+	"github.com/fgimenez/validator/pkg/seed"
+	"github.com/fgimenez/validator/pkg/store"
+	"github.com/fgimenez/validator/pkg/store/storetest"
+	"github.com/fgimenez/validator/pkg/triggers"
+)
+
+var file = &imagesets.File{Images: []*imagesets.ImageSet{{
+	Version:   18,
+	Channel:   "edge",
+	Platforms: []string{"pc-amd64", "pi3"},
+	Triggers: []*imagesets.Trigger{
+		{Snap: &imagesets.Snap{Name: "snapd", Channel: "edge"}},
+		{Snap: &imagesets.Snap{Name: "core18", Channel: "edge"}},
+	},
+}}}
+
+// setup returns an evaluator using a fake store and remote and local
+// manifests with the given content by image name
+func setup(t *testing.T, remote, local map[string]string) (*storetest.Store, *triggers.Evaluator) {
+	fake := storetest.New()
+	storeServer := httptest.NewServer(fake)
+	t.Cleanup(storeServer.Close)
+
+	remoteServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := remote[strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), "/"+seed.FileName)]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	t.Cleanup(remoteServer.Close)
+
+	dir, err := ioutil.TempDir("", "triggers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	for image, content := range local {
+		os.MkdirAll(filepath.Join(dir, image), 0755)
+		ioutil.WriteFile(filepath.Join(dir, image, seed.FileName), []byte(content), 0644)
+	}
+	return fake, &triggers.Evaluator{Store: store.New(storeServer.URL), RemoteURL: remoteServer.URL, OutputDir: dir}
+}
+
+func TestEvaluate(t *testing.T) {
+	fake, e := setup(t, map[string]string{
+		"pc-amd64-18-edge": "snapd 100\ncore18 20\nbroken\n",
+	}, map[string]string{
+		"pc-amd64-18-edge": "snapd 90\ncore18 10\n",
+		"pi3-18-edge":      "snapd 100\ncore18 20\n",
+	})
+	fake.Release("snapd", "edge", "amd64", 100)
+	fake.Release("core18", "edge", "amd64", 20)
+	fake.Release("snapd", "edge", "armhf", 101)
+	fake.Release("core18", "edge", "armhf", 20)
+
+	decisions := e.Evaluate(file)
+	if len(decisions) != 2 {
+		t.Fatalf("expected a decision per platform, got %d", len(decisions))
+	}
+
+	amd64 := decisions[0]
+	if amd64.Image != "pc-amd64-18-edge" || amd64.Kind != imagedb.KindImage || amd64.Rebuild || len(amd64.Reasons) != 0 {
+		t.Errorf("expected no rebuild of the amd64 image, got %+v", amd64)
+	}
+	if trigger := amd64.Triggers[0]; trigger.Image != 100 || trigger.Source != triggers.SourceRemote || trigger.Store != 100 {
+		t.Errorf("expected the revision of the remote manifest, got %+v", trigger)
+	}
+	if len(amd64.Warnings) != 1 || !strings.HasSuffix(amd64.Warnings[0], `3: expected <snap> <revision>, got "broken"`) {
+		t.Errorf("expected a warning for the invalid line of the remote manifest, got %v", amd64.Warnings)
+	}
+
+	pi3 := decisions[1]
+	if !pi3.Rebuild || len(pi3.Reasons) != 1 || pi3.Reasons[0] != "snapd 101 in edge is newer than 100 in the local manifest" {
+		t.Errorf("expected rebuild of the pi3 image for snapd, got %+v", pi3)
+	}
+	if len(pi3.Warnings) != 1 || !strings.HasPrefix(pi3.Warnings[0], "cannot use the remote manifest") {
+		t.Errorf("expected a warning for the remote manifest, got %v", pi3.Warnings)
+	}
+	if !pi3.Triggers[0].Rebuild || pi3.Triggers[1].Rebuild {
+		t.Errorf("expected only the snapd trigger to rebuild, got %+v %+v", pi3.Triggers[0], pi3.Triggers[1])
+	}
+}
+
+func TestEvaluateMetadata(t *testing.T) {
+	fake, e := setup(t, nil, map[string]string{
+		"pi3-18-edge":                   "snapd 100\ncore18 20\n",
+		"pi3-18-edge-pi-kernel_18/beta": "snapd 100\n",
+	})
+	fake.Release("snapd", "edge", "armhf", 100)
+	fake.Release("core18", "edge", "armhf", 20)
+	file := &imagesets.File{
+		Images: []*imagesets.ImageSet{{
+			Version:   18,
+			Channel:   "edge",
+			Platforms: []string{"pi3"},
+			Triggers:  []*imagesets.Trigger{{Snap: &imagesets.Snap{Name: "core18", Channel: "edge"}}},
+		}},
+		Metadata: []*imagesets.ImageSet{{
+			Version:   18,
+			Channel:   "edge",
+			Snaps:     []*imagesets.Snap{{Name: "pi-kernel", Channel: "18/beta"}},
+			Platforms: []string{"pi3"},
+			Triggers:  []*imagesets.Trigger{{Snap: &imagesets.Snap{Name: "snapd", Channel: "edge"}}},
+		}},
+	}
+	fake.Release("snapd", "edge", "armhf", 101)
+
+	decisions := e.Evaluate(file)
+	if len(decisions) != 2 {
+		t.Fatalf("expected a decision for the image and the metadata, got %d", len(decisions))
+	}
+	if d := decisions[0]; d.Image != "pi3-18-edge" || d.Kind != imagedb.KindImage || d.Rebuild {
+		t.Errorf("expected the image to be up to date, got %+v", d)
+	}
+	d := decisions[1]
+	if d.Image != "pi3-18-edge-pi-kernel_18/beta" || d.Kind != imagedb.KindMetadata {
+		t.Errorf("expected the decision of the metadata set, got %+v", d)
+	}
+	if !d.Rebuild || len(d.Reasons) != 1 || d.Reasons[0] != "snapd 101 in edge is newer than 100 in the local manifest" {
+		t.Errorf("expected rebuild of the metadata for snapd, got %+v", d)
+	}
+}
+
+func TestEvaluateReasons(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		remote   string
+		local    string
+		release  bool
+		expected string
+	}{
+		{"no manifests", "", "", true, "no manifest of a previous image"},
+		{"trigger not in manifest", "core18 20\n", "", true, "snapd is not in the manifest of the previous image"},
+		{"not in the store", "snapd 100\ncore18 20\n", "", false, "cannot get the revision of snapd in edge for amd64: "},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			remote := map[string]string{}
+			if tc.remote != "" {
+				remote["pc-amd64-18-edge"] = tc.remote
+			}
+			fake, e := setup(t, remote, nil)
+			if tc.release {
+				fake.Release("snapd", "edge", "amd64", 100)
+			}
+			fake.Release("core18", "edge", "amd64", 20)
+
+			d := e.Evaluate(file)[0]
+			if !d.Rebuild || len(d.Reasons) != 1 || !strings.HasPrefix(d.Reasons[0], tc.expected) {
+				t.Errorf("expected rebuild because %q, got %+v", tc.expected, d.Reasons)
+			}
+		})
+	}
+}
@@ -1,30 +1,119 @@
 package types
 
+import (
+	"io"
+	"time"
+)
+
 // Options gathers the given parsed flags
 type Options struct {
-	System    string
+	Systems   []string
 	Executors int
 	Channel   string
 	From      string
+	Image     string
+	ImageHash string
+	Refresh   []Refresh
+	Repo      string
+	Ref       string
+	Commit    string
 	Release   string
-	Queue     string
+	Spread    Spread
+	Queues    []Queue
+	// SystemQueues are the queues of the systems which don't run in Queues,
+	// keyed by system, ie those of the boards of each profile
+	SystemQueues map[string][]Queue
+	// Profile is the comma separated list of the profiles given
+	Profile   string
+	Timeout   time.Duration
+	OutputDir string
+}
+
+// Refresh is a snap to refresh in the device before running spread, either
+// from a channel, to a revision or sideloading a local file and its assertion
+type Refresh struct {
+	Name      string
+	Channel   string
+	Revision  string
+	File      string
+	Assertion string
+}
+
+// Spread tells where the spread binary used by the jobs comes from, a
+// tarball given by URL or local path and verified with Hash
+type Spread struct {
+	URL  string
+	Path string
+	Hash string
+	// Version is the release whose tarball is given in URL, empty when the
+	// tarball was given directly
+	Version string
+}
+
+// Queue is a testflinger queue with the relative share of buckets it gets
+type Queue struct {
+	Name   string
+	Weight int
+}
+
+// Bucket is a group of spread tasks of a system to be run in a queue
+type Bucket struct {
+	System string
+	Index  int
+	Queue  string
+	Tasks  []string
+}
+
+// Job is a testflinger job executing a bucket of spread tasks
+type Job struct {
+	ID     string   `json:"id"`
+	System string   `json:"system"`
+	Bucket int      `json:"bucket"`
+	Queue  string   `json:"queue"`
+	Cfg    string   `json:"cfg"`
+	Tasks  []string `json:"tasks"`
+	State  string   `json:"state,omitempty"`
+	// TimedOut is set when tpr cancelled the job because it stalled
+	TimedOut bool `json:"timed_out,omitempty"`
+	// Attempt counts the times the bucket was rescheduled after stalling,
+	// Previous holds the ids of the jobs which stalled
+	Attempt  int      `json:"attempt,omitempty"`
+	Previous []string `json:"previous,omitempty"`
+}
+
+// Manifest records the jobs submitted in a run and the options used
+type Manifest struct {
+	Created time.Time `json:"created"`
+	Commit  string    `json:"commit,omitempty"`
+	Options *Options  `json:"options"`
+	Jobs    []*Job    `json:"jobs"`
+}
+
+// Results holds the outcome of a testflinger job
+type Results struct {
+	JobState        string `json:"job_state"`
+	ProvisionStatus int    `json:"provision_status"`
+	TestStatus      int    `json:"test_status"`
+	TestOutput      string `json:"test_output"`
 }
 
-// RunnerDependencies entails all the dependencies needed by a runner instance
-type RunnerDependencies struct {
-	Cli         Cli
-	Testflinger Testflinger
-	Splitter    Splitter
+// Passed returns true if both the provision and the test phases succeeded
+func (r *Results) Passed() bool {
+	return r.ProvisionStatus == 0 && r.TestStatus == 0
 }
 
-// Cli comprises the methods required by a command manager
+// Cli comprises the methods required by a command manager, ExecCommand
+// returns the combined output, OutputCommand only the standard output and
+// StreamCommand writes the output to the writer while the command runs
 type Cli interface {
 	ExecCommand(...string) (string, error)
+	OutputCommand(...string) (string, error)
+	StreamCommand(io.Writer, ...string) error
 }
 
 // Testflinger represents the methods to interact with the testflinger cli
 type Testflinger interface {
-	GenerateCfg(*Options, [][]string) []string
+	GenerateCfg(*Options, []*Bucket) ([]string, error)
 }
 
 // Splitter has the methods needed to split the output of spread -list
@@ -0,0 +1,177 @@
+// Package ubuntuimage builds the command lines of ubuntu-image for the images
+// of the image sets and runs them
+package ubuntuimage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/fgimenez/validator/pkg/channels"
+	"github.com/fgimenez/validator/pkg/imagesets"
+	"github.com/fgimenez/validator/pkg/models"
+	"github.com/fgimenez/validator/pkg/platforms"
+	"github.com/fgimenez/validator/pkg/seed"
+	"github.com/fgimenez/validator/pkg/types"
+)
+
+// DefaultBinary is the ubuntu-image installed from its snap
+const DefaultBinary = "/snap/bin/ubuntu-image"
+
+const (
+	// ImageExt is the extension of the images written by ubuntu-image
+	ImageExt = ".img"
+	// CompressedExt is the extension of the images once compressed, as they
+	// are published
+	CompressedExt = ImageExt + ".xz"
+)
+
+var snapNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// Build is the build of an image of a platform
+type Build struct {
+	// Binary is the ubuntu-image executable, DefaultBinary when empty
+	Binary   string
+	Platform string
+	Version  int
+	Channel  string
+	Snaps    []*imagesets.Snap
+	// ModelsDir holds the models, named <platform>-<version>.model
+	ModelsDir string
+	OutputDir string
+	// SnapCommand makes the build use the snap subcommand of ubuntu-image,
+	// which is always used from 20 and required by newer versions of it
+	SnapCommand bool
+}
+
+// FromImageSet returns the build of the image of the set for the platform,
+// written to a directory named after the image in outputDir
+func FromImageSet(set *imagesets.ImageSet, platform, modelsDir, outputDir string) *Build {
+	return &Build{
+		Platform:  platform,
+		Version:   set.Version,
+		Channel:   set.Channel,
+		Snaps:     set.Snaps,
+		ModelsDir: modelsDir,
+		OutputDir: filepath.Join(outputDir, imagesets.ImageName(set, platform)),
+	}
+}
+
+// Model returns the path of the model the image is built from
+func (b *Build) Model() string {
+	modelsDir := b.ModelsDir
+	if modelsDir == "" {
+		modelsDir = models.DefaultDir
+	}
+	return filepath.Join(modelsDir, fmt.Sprintf("%s-%d.model", b.Platform, b.Version))
+}
+
+// Args returns the command line building the image
+func (b *Build) Args() ([]string, error) {
+	p, err := platforms.Get(b.Platform)
+	if err != nil {
+		return nil, err
+	}
+	if !p.Supports(b.Version) {
+		return nil, fmt.Errorf("platform %s has no images of version %d", b.Platform, b.Version)
+	}
+	if err := channels.Validate(b.Channel); err != nil {
+		return nil, fmt.Errorf("channel %v", err)
+	}
+	if b.OutputDir == "" {
+		return nil, fmt.Errorf("the output dir is required")
+	}
+
+	var snaps []string
+	seen := map[string]bool{}
+	for _, snap := range b.Snaps {
+		if !snapNameRegexp.MatchString(snap.Name) {
+			return nil, fmt.Errorf("invalid snap name %q", snap.Name)
+		}
+		if err := channels.Validate(snap.Channel); err != nil {
+			return nil, fmt.Errorf("snap %s channel %v", snap.Name, err)
+		}
+		if seen[snap.Name] {
+			return nil, fmt.Errorf("snap %s is listed more than once", snap.Name)
+		}
+		seen[snap.Name] = true
+		snaps = append(snaps, snap.Name+"="+snap.Channel)
+	}
+	sort.Strings(snaps)
+
+	binary := b.Binary
+	if binary == "" {
+		binary = DefaultBinary
+	}
+	args := []string{binary}
+	if b.SnapCommand || b.Version >= 20 {
+		args = append(args, "snap")
+	}
+	if size := p.ImageSizeFor(b.Version); size != "" {
+		args = append(args, "--image-size", size)
+	}
+	for _, snap := range snaps {
+		args = append(args, "--snap", snap)
+	}
+	return append(args, "-c", b.Channel, "-O", b.OutputDir, b.Model()), nil
+}
+
+// Run builds the image in a clean output dir, writing the output of
+// ubuntu-image to w, compresses it with xz and returns the manifest of the
+// snaps seeded in it
+func (b *Build) Run(cli types.Cli, w io.Writer) (seed.Manifest, error) {
+	args, err := b.Args()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(b.Model()); err != nil {
+		return nil, err
+	}
+	if err := os.RemoveAll(b.OutputDir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(b.OutputDir, 0755); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(w, "running %s\n", strings.Join(args, " "))
+	if err := cli.StreamCommand(w, args...); err != nil {
+		return nil, fmt.Errorf("cannot build %s: %v", b.OutputDir, err)
+	}
+	m, warnings, err := seed.Load(filepath.Join(b.OutputDir, seed.FileName))
+	if err != nil {
+		return nil, err
+	}
+	for _, warning := range warnings {
+		fmt.Fprintf(w, "warning: %s\n", warning)
+	}
+	if err := b.compress(cli, w); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// compress replaces the images of the output dir by their xz compressed
+// copies, which are the ones published
+func (b *Build) compress(cli types.Cli, w io.Writer) error {
+	images, err := filepath.Glob(filepath.Join(b.OutputDir, "*"+ImageExt))
+	if err != nil {
+		return err
+	}
+	for _, image := range images {
+		fmt.Fprintf(w, "compressing %s\n", image)
+		if err := cli.StreamCommand(w, "xz", image); err != nil {
+			return fmt.Errorf("cannot compress %s: %v", image, err)
+		}
+		if _, err := os.Stat(image); !os.IsNotExist(err) {
+			return fmt.Errorf("cannot compress %s: image still exists", image)
+		}
+		if _, err := os.Stat(image + ".xz"); err != nil {
+			return fmt.Errorf("cannot compress %s: %v", image, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package ubuntuimage_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fgimenez/validator/pkg/imagesets"
+	"github.com/fgimenez/validator/pkg/seed"
+	"github.com/fgimenez/validator/pkg/ubuntuimage"
+)
+
+func TestArgs(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		build    *ubuntuimage.Build
+		expected string
+	}{
+		{
+			"pi3 18 without size",
+			&ubuntuimage.Build{Platform: "pi3", Version: 18, Channel: "beta", OutputDir: "out"},
+			"/snap/bin/ubuntu-image -c beta -O out images/models/pi3-18.model",
+		},
+		{
+			"pc with size and sorted snaps",
+			&ubuntuimage.Build{Platform: "pc-amd64", Version: 18, Channel: "edge", OutputDir: "out", ModelsDir: "models", Snaps: []*imagesets.Snap{
+				{Name: "snapd", Channel: "beta"},
+				{Name: "pc-kernel", Channel: "18/edge"},
+			}},
+			"/snap/bin/ubuntu-image --image-size 3G --snap pc-kernel=18/edge --snap snapd=beta -c edge -O out models/pc-amd64-18.model",
+		},
+		{
+			"snap command from 20",
+			&ubuntuimage.Build{Binary: "ubuntu-image", Platform: "pi4", Version: 20, Channel: "edge", OutputDir: "out"},
+			"ubuntu-image snap --image-size 8G -c edge -O out images/models/pi4-20.model",
+		},
+		{
+			"snap command forced",
+			&ubuntuimage.Build{Platform: "pi2", Version: 16, Channel: "stable", OutputDir: "out", SnapCommand: true},
+			"/snap/bin/ubuntu-image snap -c stable -O out images/models/pi2-16.model",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			args, err := tc.build.Args()
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if cmd := strings.Join(args, " "); cmd != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, cmd)
+			}
+		})
+	}
+}
+
+func TestArgsErrors(t *testing.T) {
+	valid := func() *ubuntuimage.Build {
+		return &ubuntuimage.Build{Platform: "pi3", Version: 18, Channel: "beta", OutputDir: "out"}
+	}
+	for _, tc := range []struct {
+		name     string
+		change   func(b *ubuntuimage.Build)
+		expected string
+	}{
+		{"unknown platform", func(b *ubuntuimage.Build) { b.Platform = "pi5" }, `unknown platform "pi5"`},
+		{"unsupported version", func(b *ubuntuimage.Build) { b.Platform = "pi4" }, "platform pi4 has no images of version 18"},
+		{"invalid channel", func(b *ubuntuimage.Build) { b.Channel = "betta" }, "channel must refer to one of the risks"},
+		{"no output dir", func(b *ubuntuimage.Build) { b.OutputDir = "" }, "the output dir is required"},
+		{"invalid snap name", func(b *ubuntuimage.Build) {
+			b.Snaps = []*imagesets.Snap{{Name: "snapd; rm -rf /", Channel: "edge"}}
+		}, `invalid snap name "snapd; rm -rf /"`},
+		{"invalid snap channel", func(b *ubuntuimage.Build) {
+			b.Snaps = []*imagesets.Snap{{Name: "snapd", Channel: "-edge"}}
+		}, "snap snapd channel must refer to one of the risks"},
+		{"repeated snap", func(b *ubuntuimage.Build) {
+			b.Snaps = []*imagesets.Snap{{Name: "snapd", Channel: "edge"}, {Name: "snapd", Channel: "beta"}}
+		}, "snap snapd is listed more than once"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := valid()
+			tc.change(b)
+			if _, err := b.Args(); err == nil || !strings.HasPrefix(err.Error(), tc.expected) {
+				t.Errorf("expected error starting with %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestFromImageSet(t *testing.T) {
+	set := &imagesets.ImageSet{Version: 18, Channel: "beta", Snaps: []*imagesets.Snap{{Name: "pc-kernel", Channel: "18/edge"}}}
+	b := ubuntuimage.FromImageSet(set, "pc-amd64", "models", "output")
+	if b.OutputDir != filepath.Join("output", "pc-amd64-18-beta-pc-kernel_18/edge") || b.Model() != filepath.Join("models", "pc-amd64-18.model") {
+		t.Errorf("unexpected build %+v", b)
+	}
+}
+
+// fakeCli writes the manifest and an image to the output dir of the command
+// and compresses the images as xz does
+type fakeCli struct {
+	args       []string
+	compressed []string
+	manifest   string
+	err        error
+	xzErr      error
+}
+
+func (c *fakeCli) ExecCommand(cmds ...string) (string, error) {
+	return "", errors.New("unexpected call")
+}
+
+func (c *fakeCli) OutputCommand(cmds ...string) (string, error) {
+	return "", errors.New("unexpected call")
+}
+
+func (c *fakeCli) StreamCommand(w io.Writer, cmds ...string) error {
+	if cmds[0] == "xz" {
+		c.compressed = append(c.compressed, cmds[1:]...)
+		if c.xzErr != nil {
+			return c.xzErr
+		}
+		return os.Rename(cmds[1], cmds[1]+".xz")
+	}
+	c.args = cmds
+	io.WriteString(w, "building\n")
+	if c.err != nil {
+		return c.err
+	}
+	for i, arg := range cmds {
+		if arg == "-O" {
+			ioutil.WriteFile(filepath.Join(cmds[i+1], "pi.img"), []byte("image"), 0644)
+			return ioutil.WriteFile(filepath.Join(cmds[i+1], seed.FileName), []byte(c.manifest), 0644)
+		}
+	}
+	return nil
+}
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ubuntuimage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "pi3-18.model"), []byte("type: model\n"), 0644)
+	out := filepath.Join(dir, "out")
+	os.MkdirAll(out, 0755)
+	ioutil.WriteFile(filepath.Join(out, "stale.img"), nil, 0644)
+
+	b := &ubuntuimage.Build{Platform: "pi3", Version: 18, Channel: "beta", ModelsDir: dir, OutputDir: out}
+	cli := &fakeCli{manifest: "core18 1705\nsnapd 7264\n"}
+	var w bytes.Buffer
+	m, err := b.Run(cli, &w)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(m, seed.Manifest{"core18": 1705, "snapd": 7264}) {
+		t.Errorf("unexpected manifest %v", m)
+	}
+	if args, _ := b.Args(); !reflect.DeepEqual(cli.args, args) {
+		t.Errorf("expected %v to run, got %v", args, cli.args)
+	}
+	if !strings.HasPrefix(w.String(), "running /snap/bin/ubuntu-image ") || !strings.HasSuffix(w.String(), "building\ncompressing "+filepath.Join(out, "pi.img")+"\n") {
+		t.Errorf("unexpected output %q", w.String())
+	}
+	if !reflect.DeepEqual(cli.compressed, []string{filepath.Join(out, "pi.img")}) {
+		t.Errorf("expected the image to be compressed, got %v", cli.compressed)
+	}
+	if _, err := os.Stat(filepath.Join(out, "pi"+ubuntuimage.CompressedExt)); err != nil {
+		t.Errorf("expected the compressed image, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "stale.img")); !os.IsNotExist(err) {
+		t.Errorf("expected the output dir to be cleaned, got %v", err)
+	}
+
+	cli = &fakeCli{xzErr: errors.New("exit status 1")}
+	if _, err := b.Run(cli, &w); err == nil || !strings.HasPrefix(err.Error(), "cannot compress ") {
+		t.Errorf("expected the compression error, got %v", err)
+	}
+
+	cli = &fakeCli{err: errors.New("exit status 1")}
+	if _, err := b.Run(cli, &w); err == nil || !strings.HasSuffix(err.Error(), "exit status 1") {
+		t.Errorf("expected the build error, got %v", err)
+	}
+	b.Platform = "pc-amd64"
+	if _, err := b.Run(cli, &w); !os.IsNotExist(err) {
+		t.Errorf("expected missing model error, got %v", err)
+	}
+}